@@ -0,0 +1,111 @@
+package goreader
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	errIllegalState = errors.New("rollback position doesn't exist")
+	errZeroState    = errors.New("illegal non-initialized state")
+)
+
+// bufferState holds a read state of a charBuffer. It could be used to roll back to a previously saved state.
+type bufferState struct {
+	read int // Absolute index of the next Char to read
+	init bool
+}
+
+// charBuffer is a FIFO buffer holding the Chars read by a Reader. The buffer supports one Char lookahead using the
+// next/consume pattern, multiple Char lookahead using Peek and rollback to a previously collected read state. Written
+// Chars are still available in the buffer after a rollback.
+//
+// Consumed Chars are kept in the buffer until the buffer is committed. A commit removes the Chars before a read state
+// and the space of the removed Chars is reused by the following writes. A buffer that is committed regularly will
+// therefore not allocate once it has grown to hold the Chars written between the commits.
+type charBuffer struct {
+	chars     []Char // Buffered Chars, the first Char has absolute index start
+	start     int    // Absolute index of the first Char in chars
+	read      int    // Absolute index of the next Char to read
+	committed int    // Absolute index of the first Char not removed by a commit
+}
+
+// newCharBuffer creates a new buffer preallocated to hold rows * rowSize Chars. If row size or number of rows is <= 0
+// then a panic is raised.
+func newCharBuffer(rowSize, rows int) *charBuffer {
+	if rowSize <= 0 {
+		panic(fmt.Errorf("illegal non-positive row size %d", rowSize))
+	}
+	if rows <= 0 {
+		panic(fmt.Errorf("illegal non-positive number of rows %d", rows))
+	}
+	return &charBuffer{chars: make([]Char, 0, rowSize*rows)}
+}
+
+// Next returns the next unconsumed Char. If there is no unconsumed Char false is returned.
+func (b *charBuffer) Next() (Char, bool) {
+	return b.Peek(0)
+}
+
+// Peek returns the n-th unconsumed Char (Peek(0) is the next Char). If there are not more than n unconsumed Chars
+// false is returned.
+func (b *charBuffer) Peek(n int) (Char, bool) {
+	if n >= b.Buffered() {
+		return Char{}, false
+	}
+	return b.chars[b.read-b.start+n], true
+}
+
+// Consume consumes the next unconsumed Char (if any).
+func (b *charBuffer) Consume() {
+	if b.Buffered() > 0 {
+		b.read++
+	}
+}
+
+// Write adds the provided Char to the end of the buffer. If the buffer is full the space of the Chars removed by a
+// commit is reused.
+func (b *charBuffer) Write(c Char) {
+	if len(b.chars) == cap(b.chars) && b.committed > b.start {
+		b.compact()
+	}
+	b.chars = append(b.chars, c)
+}
+
+// Buffered returns the number of unconsumed Chars in the buffer.
+func (b *charBuffer) Buffered() int {
+	return b.start + len(b.chars) - b.read
+}
+
+// State returns the current read state of the buffer.
+func (b *charBuffer) State() bufferState {
+	return bufferState{read: b.read, init: true}
+}
+
+// Rollback resets the read state of the buffer to the provided state. If the provided state is a zero state or if
+// the Chars of the state have been removed by a commit an error is returned.
+func (b *charBuffer) Rollback(state bufferState) error {
+	if !state.init {
+		return errZeroState
+	}
+	if state.read < b.committed {
+		return errIllegalState
+	}
+	b.read = state.read
+	return nil
+}
+
+// Commit removes the Chars before the provided read state (which must not be after the current read state) from the
+// buffer. The space of the removed Chars is reclaimed when the buffer is full (see charBuffer.Write).
+func (b *charBuffer) Commit(state bufferState) {
+	b.committed = max(b.committed, state.read)
+}
+
+// compact moves the Chars not removed by a commit to the start of the buffer.
+func (b *charBuffer) compact() {
+	n := copy(b.chars, b.chars[b.committed-b.start:])
+	// Clear the moved Chars to not retain the source text of removed Chars
+	clear(b.chars[n:])
+	b.chars = b.chars[:n]
+	b.start = b.committed
+}
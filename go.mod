@@ -1,9 +1,9 @@
 module github.com/habak67/goreader
 
-go 1.22
+go 1.23
 
 require (
 	github.com/habak67/goerrors v0.1.0
-	github.com/habak67/gobuffer v0.4.1
 	github.com/habak67/gostrings v0.4.0
+	golang.org/x/text v0.21.0
 )
@@ -0,0 +1,26 @@
+//go:build !unix
+
+package goreader
+
+import (
+	"io"
+	"os"
+)
+
+// mappedFile is the io.Closer of a file read into memory on platforms not supporting memory-mapped files.
+type mappedFile struct{}
+
+func (m *mappedFile) Close() error {
+	return nil
+}
+
+// mapFile reads the named file into memory as memory-mapped files are not supported on this platform. The read data
+// is returned together with an io.Closer (doing nothing). If there was an error reading the file the error is
+// returned.
+func mapFile(name string) ([]byte, io.Closer, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	return data, &mappedFile{}, nil
+}
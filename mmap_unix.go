@@ -0,0 +1,51 @@
+//go:build unix
+
+package goreader
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"syscall"
+)
+
+// mappedFile is a file mapped into memory. Closing the mappedFile unmaps the file.
+type mappedFile struct {
+	data []byte
+}
+
+func (m *mappedFile) Close() error {
+	if m.data == nil {
+		return nil
+	}
+	data := m.data
+	m.data = nil
+	return syscall.Munmap(data)
+}
+
+// mapFile maps the named file read-only into memory. The mapped data is returned together with an io.Closer
+// unmapping the file. If there was an error mapping the file the error is returned.
+func mapFile(name string) ([]byte, io.Closer, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, nil, err
+	}
+	size := info.Size()
+	if size == 0 {
+		// An empty file can't be mapped
+		return nil, &mappedFile{}, nil
+	}
+	if int64(int(size)) != size {
+		return nil, nil, fmt.Errorf("file %s is too large to be mapped", name)
+	}
+	data, err := syscall.Mmap(int(f.Fd()), 0, int(size), syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		return nil, nil, &os.PathError{Op: "mmap", Path: name, Err: err}
+	}
+	return data, &mappedFile{data: data}, nil
+}
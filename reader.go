@@ -2,44 +2,450 @@ package goreader
 
 import (
 	"bufio"
+	"bytes"
+	"container/heap"
+	"encoding/base64"
+	"encoding/binary"
 	"errors"
 	"fmt"
-	"github.com/habak67/gobuffer"
 	"github.com/habak67/goerrors"
 	"github.com/habak67/gostrings"
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/htmlindex"
+	"golang.org/x/text/encoding/unicode/utf32"
+	"golang.org/x/text/transform"
+	"golang.org/x/text/unicode/norm"
+	"golang.org/x/text/width"
+	"html"
 	"io"
+	"iter"
+	"mime/quotedprintable"
+	"os"
+	"regexp"
+	"slices"
 	"strconv"
 	"strings"
+	"time"
+	"unicode"
+	"unicode/utf16"
+	"unicode/utf8"
 )
 
-// Position represents the position in a two-dimensional space containing rows and columns.
+// Position represents the position in a two-dimensional space containing rows and columns. If the Reader source
+// is a named file (see Builder.WithFileName) the position also contains the file name. If the Reader source is named
+// (see Builder.WithSourceName) the position also contains the source name. If the Reader tracks byte
+// offsets (see Builder.WithByteOffsets) the position also contains the byte offset from the start of the source and
+// if the Reader tracks rune indexes (see Builder.WithRuneIndex) the position also contains the index of the rune in
+// the source.
 type Position struct {
-	Row int
-	Col int
+	Row    int
+	Col    int
+	File   string
+	Source string
+	Offset int
+	Index  int
+	format PositionFormat // Format of the string representation (see Builder.WithPositionFormat)
 }
 
+// PositionFormat is the format of the string representation of a Position (see Builder.WithPositionFormat).
+type PositionFormat int
+
+const (
+	// PositionRowCol formats positions as <row>/<column> (the default).
+	PositionRowCol PositionFormat = iota
+	// PositionLineCol formats positions as <line>:<column> (e.g. for "file:line:col" compiler style errors).
+	PositionLineCol
+)
+
 // String returns a string representation of a Position using the format;
 //
 //	<row>/<column>
+//
+// If the position contains a file name the format is;
+//
+//	<file>:<row>/<column>
+//
+// If the position contains no file name but a source name the source name is used as the file name. If the position
+// is read by a Reader using the line and column format (see Builder.WithPositionFormat) the row and column are
+// separated by a colon (e.g. "main.cfg:2:5").
 func (p Position) String() string {
+	if name := p.name(); name != "" {
+		return name + ":" + p.rowCol()
+	}
+	return p.rowCol()
+}
+
+// name returns the file name of the position or, if the position contains no file name, the source name.
+func (p Position) name() string {
+	if p.File != "" {
+		return p.File
+	}
+	return p.Source
+}
+
+// rowCol returns the row and column of the position according to the format of the position.
+func (p Position) rowCol() string {
+	if p.format == PositionLineCol {
+		return fmt.Sprintf("%d:%d", p.Row, p.Col)
+	}
 	return fmt.Sprintf("%d/%d", p.Row, p.Col)
 }
 
+// Compare compares the position with the provided position by row and column. The result is -1 if the position is
+// before the provided position, +1 if the position is after the provided position and 0 if the positions are equal.
+// The file name, source name, byte offset and rune index of the positions are not compared.
+func (p Position) Compare(other Position) int {
+	switch {
+	case p.Row < other.Row || p.Row == other.Row && p.Col < other.Col:
+		return -1
+	case p.Row > other.Row || p.Row == other.Row && p.Col > other.Col:
+		return +1
+	}
+	return 0
+}
+
+// Before returns true if the position is before the provided position (see Position.Compare).
+func (p Position) Before(other Position) bool {
+	return p.Compare(other) < 0
+}
+
+// After returns true if the position is after the provided position (see Position.Compare).
+func (p Position) After(other Position) bool {
+	return p.Compare(other) > 0
+}
+
+// Lexeme is the source text consumed between a call to Reader.StartLexeme and Reader.EndLexeme (e.g. the text of a
+// token). The Span holds the position of the first consumed Char (the position of the next Char if no Char has been
+// consumed) and the position of the next Char after the lexeme.
+type Lexeme struct {
+	Text string
+	Span
+}
+
+// Span represents a range of source text from the position Start up to, but not including, the position End (e.g.
+// the source text of a Char, see Char.End). A span where End is not after Start is empty.
+type Span struct {
+	Start Position
+	End   Position
+}
+
+// Contains returns true if the provided position is inside the span.
+func (s Span) Contains(pos Position) bool {
+	return !pos.Before(s.Start) && pos.Before(s.End)
+}
+
+// Overlap returns true if the span and the provided span have any position in common. An empty span doesn't
+// overlap any span.
+func (s Span) Overlap(other Span) bool {
+	return s.Start.Before(other.End) && other.Start.Before(s.End) && s.Start.Before(s.End) &&
+		other.Start.Before(other.End)
+}
+
+// FileError is an error occurring when reading from a named file source (see Builder.WithFileName). The error
+// message is prefixed with the file name (e.g. "main.cfg:2/5: unexpected EOF reading unicode escape" or
+// "main.cfg:2:5: unexpected EOF reading unicode escape", see Builder.WithPositionFormat).
+type FileError struct {
+	File string
+	Err  error
+}
+
+func (e *FileError) Error() string {
+	return fmt.Sprintf("%s:%s", e.File, e.Err)
+}
+
+func (e *FileError) Unwrap() error {
+	return e.Err
+}
+
+// Sentinel errors wrapped by the errors returned by a Reader. Use errors.Is to check for a kind of error. Note that
+// the message of a returned error is the message describing the specific error (e.g. "unknown escape sequence \q").
+var (
+	// ErrIncompleteEscape is wrapped by errors for escape sequences, entities and character references not
+	// completed before the end of the source.
+	ErrIncompleteEscape = errors.New("incomplete escape sequence")
+	// ErrInvalidEscape is wrapped by errors for malformed or unknown escape sequences, entities and character
+	// references.
+	ErrInvalidEscape = errors.New("invalid escape sequence")
+	// ErrInvalidUTF8 is wrapped by errors for invalid UTF-8 encoded bytes (see InvalidUTF8Error).
+	ErrInvalidUTF8 = errors.New("invalid UTF-8 encoded byte")
+	// ErrUnexpectedRune is wrapped by errors for runes not matching the expected rune (see Reader.Expect).
+	ErrUnexpectedRune = errors.New("unexpected rune")
+	// ErrIllegalCharacter is wrapped by errors for illegal characters (see Builder.WithControlCharPolicy and
+	// Builder.WithBidiPolicy).
+	ErrIllegalCharacter = errors.New("illegal character")
+	// ErrUnterminatedComment is wrapped by errors for block comments not terminated before the end of the source.
+	ErrUnterminatedComment = errors.New("unterminated comment")
+	// ErrMalformedDirective is wrapped by errors for malformed include and line directives.
+	ErrMalformedDirective = errors.New("malformed directive")
+	// ErrRollbackInvalid is wrapped by errors for rollbacks to states (or unconsumes) that are no longer valid.
+	ErrRollbackInvalid = errors.New("invalid rollback")
+	// ErrUnexpectedBOM is wrapped by warnings for byte order marks not at the start of the source (see
+	// Builder.WithWarningHandler).
+	ErrUnexpectedBOM = errors.New("unexpected byte order mark")
+	// ErrMixedLineEndings is wrapped by warnings for line endings differing from the first line ending of the source
+	// (see Builder.WithWarningHandler).
+	ErrMixedLineEndings = errors.New("mixed line endings")
+	// ErrReplacementCharacter is wrapped by warnings for replacement characters (U+FFFD) in the source (see
+	// Builder.WithWarningHandler).
+	ErrReplacementCharacter = errors.New("replacement character")
+	// ErrErrorState is wrapped by errors for failed reads from the source putting the Reader in an error state (see
+	// Reader.Err).
+	ErrErrorState = errors.New("reader in error state")
+	// ErrInvalidArgument is wrapped by errors for illegal arguments (e.g. a negative offset to Reader.Peek).
+	ErrInvalidArgument = errors.New("invalid argument")
+	// ErrInvalidSeek is wrapped by errors for seeks that are not supported or not possible (see Reader.Seek).
+	ErrInvalidSeek = errors.New("invalid seek")
+	// ErrUnknownMark is wrapped by errors for marks never created or already released (see Reader.Mark).
+	ErrUnknownMark = errors.New("unknown mark")
+	// ErrUnknownTransformer is wrapped by errors for transformer names not used by the Reader (see
+	// Reader.DisableTransformer).
+	ErrUnknownTransformer = errors.New("unknown transformer")
+	// ErrNotAvailable is wrapped by errors for source text no longer (or never) recorded by the Reader (see
+	// Reader.Line and Reader.SourceRange).
+	ErrNotAvailable = errors.New("not available")
+	// ErrIncludeFailed is wrapped by errors for included sources that could not be resolved or read (see
+	// Builder.WithInclude).
+	ErrIncludeFailed = errors.New("include failed")
+)
+
+// kindError is an error of a kind (one of the sentinel errors). The message of a kindError is the message of the
+// wrapped error.
+type kindError struct {
+	kind error
+	err  error
+}
+
+func (e *kindError) Error() string {
+	return e.err.Error()
+}
+
+func (e *kindError) Unwrap() []error {
+	return []error{e.kind, e.err}
+}
+
+// errorOf returns the provided error as an error of the provided kind.
+func errorOf(kind, err error) error {
+	return &kindError{kind: kind, err: err}
+}
+
+// PositionalError is an error occurring at a position in the source of a Reader. The errors returned by a Reader
+// (except io.EOF) are positional errors (possibly wrapped in a FileError) and the position may be retrieved using
+// errors.As. The error message is prefixed with the row and column of the position (see
+// goerrors.PositionalError).
+type PositionalError struct {
+	Pos Position
+	// End holds the position directly after the source text causing the error (e.g. a malformed escape sequence).
+	// If the end is unknown End is the zero Position.
+	End Position
+	Err error
+}
+
+// NewPositionalError creates a new PositionalError occurring at the provided position.
+func NewPositionalError(pos Position, err error) *PositionalError {
+	return &PositionalError{Pos: pos, Err: err}
+}
+
+func (e *PositionalError) Error() string {
+	// The file name is added by a wrapping FileError
+	if e.Pos.File == "" && e.Pos.Source != "" {
+		return e.Pos.Source + ":" + e.Pos.rowCol() + ": " + e.Err.Error()
+	}
+	if e.Pos.format == PositionLineCol {
+		return e.Pos.rowCol() + ": " + e.Err.Error()
+	}
+	return goerrors.NewPositionalError(e.Pos.Row, e.Pos.Col, e.Err).Error()
+}
+
+func (e *PositionalError) Unwrap() error {
+	return e.Err
+}
+
+// Diagnostic returns a Diagnostic for the error spanning from Pos to End (see FormatDiagnostic). The message of the
+// Diagnostic is the message of the wrapped error (without position).
+func (e *PositionalError) Diagnostic() Diagnostic {
+	return Diagnostic{Pos: e.Pos, End: e.End, Message: e.Err.Error()}
+}
+
+// TimeoutError is an error returned when a read from the source timed out (see Builder.WithReadTimeout). A
+// TimeoutError is retryable. That is, the Reader is left in the state before the failed read and the failed method
+// (e.g. Reader.Next) may be called again.
+type TimeoutError struct {
+	Err error
+}
+
+func (e *TimeoutError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *TimeoutError) Unwrap() error {
+	return e.Err
+}
+
+// Timeout returns true as a TimeoutError is always a timeout (see net.Error).
+func (e *TimeoutError) Timeout() bool {
+	return true
+}
+
+// Diagnostic is a message (e.g. an error) about a span of the source rendered by FormatDiagnostic.
+type Diagnostic struct {
+	Pos     Position // Start of the span
+	End     Position // End of the span (not included). If End is not after Pos on the same row the span is one column.
+	Message string
+}
+
+// FormatDiagnostic renders the provided diagnostic together with the provided source line (the line of the start of
+// the span, see Reader.Line) and a caret line marking the span in the source line. Example;
+//
+//	main.cfg:2/5: unexpected EOF reading unicode escape
+//	x = \u00
+//	    ^^^^
+//
+// If the source line is empty only the position and message are rendered. Tabs in the source line before the span
+// are kept in the caret line so the carets line up regardless of the tab width of the output. Note that columns are
+// assumed to be counted in runes from 1 (the default, see Builder.WithColumnUnit).
+func FormatDiagnostic(d Diagnostic, line string) string {
+	var sb strings.Builder
+	sb.WriteString(d.Pos.String())
+	sb.WriteString(": ")
+	sb.WriteString(d.Message)
+	if line == "" {
+		return sb.String()
+	}
+	sb.WriteByte('\n')
+	sb.WriteString(line)
+	sb.WriteByte('\n')
+	// Indent the carets to the start of the span
+	runes := []rune(line)
+	for i := 0; i < d.Pos.Col-startPosition.Col; i++ {
+		if i < len(runes) && runes[i] == '\u0009' {
+			sb.WriteByte('\t')
+		} else {
+			sb.WriteByte(' ')
+		}
+	}
+	carets := 1
+	if d.End.Row == d.Pos.Row && d.End.Col > d.Pos.Col {
+		carets = d.End.Col - d.Pos.Col
+	}
+	sb.WriteString(strings.Repeat("^", carets))
+	return sb.String()
+}
+
 // Char represent a rune read by the Reader. A Char contains the read Rune, the Position of the rune in the
-// Reader source and an indication if the rune was escaped (\<rune>).
+// Reader source and an indication if the rune was escaped (\<rune>). If the Reader records raw source text (see
+// Builder.WithRawText) the Char also contains the original source text that was transformed into the rune.
 type Char struct {
 	Rune    rune
 	Pos     Position
 	Escaped bool
+	// Raw holds the original source text (e.g. `\u0058` for 'X') that produced the Char. If several Chars are
+	// produced from the same source text (e.g. an expanding escape) each Char holds the full source text. Raw is
+	// only recorded if the Reader is created using Builder.WithRawText.
+	Raw string
+	// End holds the position directly after the original source text that produced the Char. That is, the source
+	// text of the Char spans from Pos up to (but not including) End. If several Chars are produced from the same
+	// source text each Char holds the end of the full source text. End is only recorded if the Reader is created
+	// using Builder.WithSpans.
+	End Position
 }
 
 func (c Char) String() string {
 	return fmt.Sprintf("<%s%s,[%s]>", gostrings.CondString(c.Escaped, "\\", ""), string(c.Rune), c.Pos)
 }
 
-// State holds a state for a Reader. It is used by the methods Reader.State and Reader.Rollback.
+// LineEnding represents the rune sequence terminating a line.
+type LineEnding int
+
+const (
+	// NoLineEnding is used for the last line in a Reader source if not terminated by a newline.
+	NoLineEnding LineEnding = iota
+	// LF is a line terminated by newline (\u000A).
+	LF
+	// CR is a line terminated by carriage return (\u000D).
+	CR
+	// CRLF is a line terminated by carriage return + newline (\u000D\u000A).
+	CRLF
+)
+
+// String returns a string representation of a LineEnding.
+func (e LineEnding) String() string {
+	switch e {
+	case LF:
+		return "LF"
+	case CR:
+		return "CR"
+	case CRLF:
+		return "CRLF"
+	default:
+		return "none"
+	}
+}
+
+// Line represents a line read by the Reader. A Line contains the Chars of the line (excluding the line ending), the
+// text of the line, the row of the line and the line ending terminating the line.
+type Line struct {
+	Chars  []Char
+	Text   string
+	Row    int
+	Ending LineEnding
+}
+
+// State holds a state for a Reader. It is used by the methods Reader.State and Reader.Rollback. If the Reader tracks
+// live States (see Builder.WithLiveStates) a State created by Reader.State is live until it is released using
+// State.Release. A live State prevents Reader.Commit from removing runes read after the State was created.
+//
+// A State holds the complete read state of the Reader (unconsumed, pushed back and previous Chars). Transformers are
+// applied when runes are read from the source into the internal buffer of the Reader, and a rollback never
+// rereads runes from the source. Any transformer state is therefore consistent with the buffered Chars also after a
+// rollback, and the position of the next Char (see Reader.Pos) is exact.
 type State struct {
-	bufState gobuffer.State
+	bufState bufferState
+	offset   int // Number of consumed buffered chars when the state was created
+	pushed   []Char
+	prev     Char
+	hasPrev  bool
+	reader   *Reader // Reader tracking the state (nil if not tracked)
+	id       int
+	lexeme   int // Number of runes in the current lexeme (see Reader.StartLexeme)
+	consumed int // Number of consumed Chars (see Reader.Stats)
+}
+
+// Release releases the State. After the State has been released it will no longer prevent Reader.Commit from
+// removing runes read after the State was created. A released State may still be used in a call to
+// Reader.Rollback, but the rollback may fail if the Reader has been committed after the State was released.
+// Releasing a State more than once, or a State not tracked as live (see Builder.WithLiveStates), has no effect.
+func (s State) Release() {
+	if s.reader == nil {
+		return
+	}
+	r := s.reader
+	read, ok := r.states[s.id]
+	if !ok {
+		return
+	}
+	delete(r.states, s.id)
+	if r.liveReads[read]--; r.liveReads[read] == 0 {
+		delete(r.liveReads, read)
+	}
+}
+
+// zero returns true if the State is the zero state (not created by Reader.State).
+func (s State) zero() bool {
+	return s.bufState == bufferState{}
+}
+
+// readHeap is a min-heap of buffer read indices (see container/heap).
+type readHeap []int
+
+func (h readHeap) Len() int           { return len(h) }
+func (h readHeap) Less(i, j int) bool { return h[i] < h[j] }
+func (h readHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *readHeap) Push(x any)        { *h = append(*h, x.(int)) }
+func (h *readHeap) Pop() any {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
 }
 
 // New creates a new Reader with a source, a decent buffer size and no transformers. For more configuration of the
@@ -48,356 +454,4939 @@ func New(source io.Reader) *Reader {
 	return Builder{}.WithSource(source).Reader()
 }
 
+// NewFromString creates a new Reader reading from the provided string (see Builder.WithString).
+func NewFromString(s string) *Reader {
+	return Builder{}.WithString(s).Reader()
+}
+
+// NewFromBytes creates a new Reader reading from the provided byte slice (see Builder.WithBytes).
+func NewFromBytes(b []byte) *Reader {
+	return Builder{}.WithBytes(b).Reader()
+}
+
+// NewFromFile creates a new Reader reading from the named file. The file is read into memory and closed before the
+// Reader is returned. The file name is included in the positions of the read Chars and in the errors returned by
+// the Reader (see Builder.WithFileName). Use the Builder (see Builder.WithPositionFormat) for "file:line:col"
+// positions. If there was an error reading the file the error is returned.
+func NewFromFile(name string) (*Reader, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	return Builder{}.WithBytes(data).WithFileName(name).Reader(), nil
+}
+
+// NewFromMappedFile creates a new Reader reading from the named file mapped into memory. As the file is not copied
+// into memory very large files may be read with a stable memory use. The runes are decoded directly from the mapped
+// file and the Reader supports Reader.Seek. The file name is included in the positions of the read Chars and in the
+// errors returned by the Reader (see Builder.WithFileName). The returned io.Closer unmaps the file and must be
+// closed when the Reader is no longer used. On platforms not supporting memory-mapped files the file is read into
+// memory (see NewFromFile). If there was an error mapping the file the error is returned.
+func NewFromMappedFile(name string) (*Reader, io.Closer, error) {
+	data, closer, err := mapFile(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	return Builder{}.WithBytes(data).WithFileName(name).Reader(), closer, nil
+}
+
 // Builder is a Reader generator. It is used to create a more customized Reader.
 type Builder struct {
 	reader *Reader
 }
 
-// WithSource adds the source to the Reader to be created.
+// WithFileName specifies the file name of the source for the Reader to be created. The file name is included in the
+// positions of the read Chars (see Position.File) and errors returned by the Reader are wrapped in a FileError.
+// WithFileName must be called after Builder.WithSource.
+func (b Builder) WithFileName(name string) Builder {
+	b.reader.file = name
+	b.reader.pos.File = name
+	return b
+}
+
+// WithSourceName specifies the name of the source (e.g. "config.yaml") for the Reader to be created. The source name
+// is included in the positions of the read Chars (see Position.Source) and the positions and positional errors are
+// rendered as "source:line:col" (e.g. "config.yaml:12:7", see Builder.WithPositionFormat). Unlike a file name (see
+// Builder.WithFileName) the source name is not changed by line directives and included sources, and errors are not
+// wrapped in a FileError. WithSourceName must be called after Builder.WithSource.
+func (b Builder) WithSourceName(name string) Builder {
+	b.reader.pos.Source = name
+	b.reader.posFormat = PositionLineCol
+	return b
+}
+
+// WithString adds a string source to the Reader to be created. The runes are decoded directly from the string
+// without an intermediate buffered reader.
+func (b Builder) WithString(s string) Builder {
+	source := strings.NewReader(s)
+	return Builder{reader: &Reader{
+		reader: source,
+		seeker: source,
+		pos:    startPosition,
+	}}
+}
+
+// WithBytes adds a byte slice source to the Reader to be created. The runes are decoded directly from the byte slice
+// without an intermediate buffered reader. The byte slice must not be modified while the Reader is in use.
+func (b Builder) WithBytes(bs []byte) Builder {
+	source := bytes.NewReader(bs)
+	return Builder{reader: &Reader{
+		reader: source,
+		seeker: source,
+		pos:    startPosition,
+	}}
+}
+
+// WithSource adds the source to the Reader to be created. If the source implements io.Seeker the created Reader
+// supports Reader.Seek.
 func (b Builder) WithSource(source io.Reader) Builder {
+	seeker, _ := source.(io.ReadSeeker)
+	conn, _ := source.(readDeadliner)
 	return Builder{reader: &Reader{
 		reader: bufio.NewReader(source),
+		seeker: seeker,
+		conn:   conn,
+		pos:    startPosition,
+	}}
+}
+
+// WithRuneSource adds a rune source to the Reader to be created. The runes are read directly from the rune source
+// without an intermediate buffered reader and UTF-8 decoding. WithRuneSource may be used when the source already
+// produces runes (e.g. another scanner).
+func (b Builder) WithRuneSource(source io.RuneReader) Builder {
+	return Builder{reader: &Reader{
+		reader: &runeReaderSource{src: source},
 		pos:    startPosition,
 	}}
 }
 
+// readDeadliner is a source supporting read deadlines (e.g. net.Conn).
+type readDeadliner interface {
+	SetReadDeadline(t time.Time) error
+}
+
+// WithReadTimeout specifies a timeout for each read from the source of the Reader to be created. The source must
+// support read deadlines (e.g. a net.Conn) and a read deadline is set before each read from the source. If a read
+// times out a TimeoutError is returned and the Reader is left in the state before the failed read. That is, the
+// failed method (e.g. Reader.Next) may be retried. Note that retrying is not supported for decoded sources (e.g.
+// Builder.WithEncoding). WithReadTimeout must be called after Builder.WithSource. If the source doesn't support read
+// deadlines a panic is raised.
+func (b Builder) WithReadTimeout(timeout time.Duration) Builder {
+	if b.reader.conn == nil {
+		panic("source doesn't support read deadlines")
+	}
+	b.reader.readTimeout = timeout
+	b.reader.wrapSource(deadlineReader{src: b.reader.reader, conn: b.reader.conn, timeout: timeout})
+	return b
+}
+
+// deadlineReader sets a read deadline on the connection before each read from the source.
+type deadlineReader struct {
+	src     io.Reader
+	conn    readDeadliner
+	timeout time.Duration
+}
+
+func (d deadlineReader) Read(p []byte) (int, error) {
+	if err := d.conn.SetReadDeadline(time.Now().Add(d.timeout)); err != nil {
+		return 0, err
+	}
+	return d.src.Read(p)
+}
+
+// WithReader adds another Reader as the source of the Reader to be created. The Chars read from the source Reader
+// are transformed by the transformers of the created Reader. The positions of the Chars from the source Reader are
+// preserved. That is, the positions of the Chars read from the created Reader are positions in the original source.
+// WithReader may be used to create multi-pass pipelines where each pass is a separate Reader (e.g. stripping
+// comments before decoding escapes). Note that the newline policy of the created Reader has no effect as rows are
+// tracked by the source Reader. The source Reader should not be read from other than by the created Reader.
+func (b Builder) WithReader(source *Reader) Builder {
+	return Builder{reader: &Reader{
+		upstream: source,
+		pos:      source.Pos(),
+	}}
+}
+
 // WithSize specifies the number of initial rows and the row size for the internal buffer for the Reader to be
-// created.
+// created. The buffer is preallocated to hold rows * rowSize Chars. If row size or number of rows is <= 0 then a
+// panic is raised.
 func (b Builder) WithSize(rowSize, rows int) Builder {
-	b.reader.buffer = gobuffer.NewWithSize[Char](rowSize, rows)
+	b.reader.buffer = newCharBuffer(rowSize, rows)
 	return b
 }
 
-// WithNormalizeNewline adds a newline normalizer to the Reader to be created. The newline normalizer
-// transforms the following rune sequences to a single newline (\u000A).
-//
-//	CR (\u000D)
-//	CR (\u000D) + NL (\u000A)
-func (b Builder) WithNormalizeNewline() Builder {
-	b.reader.transformers = append(b.reader.transformers, normalizeNewline{})
+// WithLiveStates makes the Reader to be created track the States created by Reader.State as live until they are
+// released using State.Release. A live State prevents Reader.Commit from removing the runes needed to rollback to the
+// State. Note that every State must then be released, or the internal buffer of the Reader will grow with the runes
+// read after the oldest unreleased State. By default States are not tracked and a commit invalidates all States.
+func (b Builder) WithLiveStates() Builder {
+	b.reader.liveStates = true
 	return b
 }
 
-// WithUnicodeEscape adds a unicode escape transformer to the Reader to be created. A unicode escape transformer
-// transform the common unicode escape rune sequence '\uhhhh' to the unicode rune represented by the hexadecimal
-// number '0xhhhh'.
-func (b Builder) WithUnicodeEscape() Builder {
-	b.reader.transformers = append(b.reader.transformers, unicodeEscape{})
+// WithTransformer adds a custom Transformer to the Reader to be created. Transformers are applied in the order they
+// are added to the Builder (see Transformer for the order to add the built-in transformers in).
+func (b Builder) WithTransformer(t Transformer) Builder {
+	return b.withTransformer("", singleTransformer{t})
+}
+
+// WithMultiTransformer adds a custom MultiTransformer to the Reader to be created. A MultiTransformer may transform
+// a rune into zero Chars (filtering) or several Chars (expansion). Transformers (including MultiTransformers) are
+// applied in the order they are added to the Builder.
+func (b Builder) WithMultiTransformer(t MultiTransformer) Builder {
+	return b.withTransformer("", multiTransformer{t})
+}
+
+// WithTee makes the Reader to be created write every consumed rune (UTF-8 encoded) to the provided writer. If raw is
+// true the original source text of each consumed Char (see Char.Raw) is written instead, and the source text is
+// recorded (see Builder.WithRawText). A rune consumed again (e.g. after Reader.Rollback) is written again. If there
+// is an error writing to the writer no more runes are written and the error is returned by Reader.TeeError.
+func (b Builder) WithTee(w io.Writer, raw bool) Builder {
+	b.reader.tee = w
+	b.reader.teeRaw = raw
+	b.reader.rawText = b.reader.rawText || raw
 	return b
 }
 
-// WithRuneEscape adds a rune escape transformer to the Reader to be created. A rune escape transformer
-// transform a rune sequence '\<from rune>' to the corresponding <to rune>. The rune escape transformations
-// to be used is specified in a map where the <from rune> is the map key and the <to rune> is the map value.
-// When reading a rune using Reader.Next we identify an escape sequence that is not configured ('\<rune>' where
-// <rune> is not configured in the map) an error is returned from Reader.Next.
-//
-// When reading runes from the Reader source we read an escaped rune (\<rune>)  Reader.Next will return
-// <to rune> if there exist a specified escape <rune> => <to rune>. Otherwise Reader.Next will return <rune>.
-// In both cases the Char wrapping the rune will have Char.Escaped set to true.
-//
-// An example of a rune escape specification:
-//
-//	map[rune]rune{'t': '\u0009'} will transform a rune sequence "\r" to the tab rune (\u0009).
-func (b Builder) WithRuneEscape(escapes map[rune]rune) Builder {
-	b.reader.transformers = append(b.reader.transformers, runeEscape{escapes: escapes})
+// WithByteOffsets makes the Reader to be created track the byte offset from the start of the source in the positions
+// of the read Chars (see Position.Offset). The byte offsets are offsets in the UTF-8 encoded source (after any
+// decoding of the source, see Builder.WithEncoding). Without this option the Offset of all positions is 0.
+func (b Builder) WithByteOffsets() Builder {
+	b.reader.byteOffsets = true
 	return b
 }
 
-// Reader returns the Reader created from the builder. If no buffer size has been specified using method WithSize
-// then a decent default size will be used for the created Reader. If a reader source has not been specified, using
-// Builder.WithSource, then a panic is raised.
-func (b Builder) Reader() *Reader {
-	reader := b.reader
-	if reader.reader == nil {
-		panic("method WithSource has not been called to set the source for the reader to be created")
+// WithRuneIndex makes the Reader to be created track the index of the runes in the source in the positions of the
+// read Chars (see Position.Index). The index of the first rune in the source is 0. An invalid UTF-8 encoded byte is
+// counted as one rune (as when converting a string to a rune slice) even if it is skipped (see
+// Builder.WithInvalidUTF8Policy). Without this option the Index of all positions is 0, which can't be told apart
+// from the first rune.
+func (b Builder) WithRuneIndex() Builder {
+	b.reader.runeIndex = true
+	return b
+}
+
+// WithSourceMap makes the Reader to be created record a source map from the position of each read Char to the byte
+// range of the source text that produced the Char (see Reader.SourceRange), also across transformers (e.g. newline
+// normalization and escape decoding). The source map enables tools to apply fixes to the original source. The byte
+// offsets are offsets in the UTF-8 encoded source (see Builder.WithByteOffsets). The byte ranges are therefore exact
+// in the original source if the source is UTF-8 encoded. Chars read from an included source (see
+// Builder.WithInclude) are not mapped. Note that the source map grows with the size of the source.
+func (b Builder) WithSourceMap() Builder {
+	b.reader.byteOffsets = true
+	b.reader.sourceMap = []sourceRange{}
+	return b
+}
+
+// WithProgress makes the Reader to be created call the provided callback with the progress of reading the source
+// (see Reader.Progress) each time at least the provided number of bytes have been read since the last call, and when
+// the end of the source is reached. If every is less than 1 a panic is raised.
+func (b Builder) WithProgress(every int64, callback func(read, total int64)) Builder {
+	if every < 1 {
+		panic(fmt.Errorf("illegal progress interval %d", every))
 	}
-	if reader.buffer == nil {
-		reader.buffer = gobuffer.NewWithSize[Char](100, 10)
+	b.reader.progress = callback
+	b.reader.progressEvery = every
+	return b
+}
+
+// WithLineCache makes the Reader to be created cache the source text of the provided number of most recently read
+// lines (see Reader.Line). The lines are cached as read from the source, before any transformers are applied.
+// Lines read from an included source (see Builder.WithInclude) or a source Reader (see Builder.WithReader) are not
+// cached. If lines is less than 1 a panic is raised.
+func (b Builder) WithLineCache(lines int) Builder {
+	if lines < 1 {
+		panic(fmt.Errorf("illegal line cache size %d", lines))
+	}
+	b.reader.lineCacheSize = lines
+	return b
+}
+
+// WithSpans makes the Reader to be created record the end position of the source text of each read Char (see
+// Char.End). Without this option End is the zero Position for all read Chars.
+func (b Builder) WithSpans() Builder {
+	b.reader.spans = true
+	return b
+}
+
+// WithRawText makes the Reader to be created record the original source text of each read Char (see Char.Raw).
+// Recording the source text has a cost and is therefore not done by default.
+func (b Builder) WithRawText() Builder {
+	b.reader.rawText = true
+	return b
+}
+
+// ErrorRecovery specifies how a Reader recovers from a transformer error (see Builder.WithErrorRecovery).
+type ErrorRecovery int
+
+const (
+	// RecoverSkip skips the Char and the runes read by the failing transformer.
+	RecoverSkip ErrorRecovery = iota
+	// RecoverRaw returns the Char and the runes read by the failing transformer untransformed.
+	RecoverRaw
+)
+
+// WithErrorRecovery specifies how the Reader to be created recovers from a transformer error (e.g. a malformed
+// unicode escape). The error is always returned, but the Reader is not left in an error state. That is, reading may
+// continue after the error to report several errors in the same source. As default (RecoverSkip) the runes read by
+// the failing transformer are skipped and reading continues after them. Using RecoverRaw the runes read by the
+// failing transformer are returned untransformed (passed through any following transformers) by the following
+// reads. Note that errors reading from the source are not recovered from.
+func (b Builder) WithErrorRecovery(recovery ErrorRecovery) Builder {
+	b.reader.recovery = recovery
+	return b
+}
+
+// WithErrorLimit makes the Reader to be created collect up to the provided number of errors not putting the Reader
+// in an error state (see Reader.Err), e.g. malformed escapes and invalid UTF-8. A collected error is not returned, the
+// Reader recovers from the error (see Builder.WithErrorRecovery) and reading continues. The collected errors are
+// returned by Reader.Errors. When the limit has been reached any further errors are returned as usual. If limit is
+// less than 1 a panic is raised.
+func (b Builder) WithErrorLimit(limit int) Builder {
+	if limit < 1 {
+		panic(fmt.Errorf("illegal error limit %d", limit))
+	}
+	b.reader.errorLimit = limit
+	return b
+}
+
+// WithLenientEOF makes the transformers of the Reader to be created lenient at the end of the source. If a
+// transformer fails after reaching the end of the source (e.g. a trailing lone backslash or an incomplete unicode
+// escape "\u12") the Char and the runes read by the transformer are returned untransformed instead of an error.
+// Interactive consumers may then continue reading despite an incomplete escape sequence.
+func (b Builder) WithLenientEOF() Builder {
+	b.reader.lenientEOF = true
+	return b
+}
+
+// Encoding specifies the encoding of the source of a Reader (see Builder.WithEncoding).
+type Encoding int
+
+const (
+	// UTF8 is the UTF-8 encoding (default).
+	UTF8 Encoding = iota
+	// UTF16LE is the UTF-16 little-endian encoding.
+	UTF16LE
+	// UTF16BE is the UTF-16 big-endian encoding.
+	UTF16BE
+	// UTF32LE is the UTF-32 little-endian encoding.
+	UTF32LE
+	// UTF32BE is the UTF-32 big-endian encoding.
+	UTF32BE
+)
+
+// WithEncoding specifies the encoding of the source for the Reader to be created. As default the source is UTF-8
+// encoded. For UTF-16 encodings surrogate pairs are decoded into a single rune and an unpaired surrogate (or a
+// trailing odd byte) is decoded as the unicode replacement character (U+FFFD). Positions are still counted in runes.
+// WithEncoding must be called after Builder.WithSource.
+func (b Builder) WithEncoding(encoding Encoding) Builder {
+	if encoding != UTF8 {
+		b.reader.wrapSource(decodeReader(bufio.NewReader(b.reader.reader), encoding))
+	}
+	return b
+}
+
+// WithDetectEncoding makes the Reader to be created detect the encoding of the source from a byte order mark (BOM)
+// at the start of the source. UTF-8, UTF-16LE, UTF-16BE, UTF-32LE and UTF-32BE byte order marks are detected. The
+// byte order mark is removed from the source. If there is no byte order mark the source is assumed to be UTF-8
+// encoded. WithDetectEncoding must be called after Builder.WithSource.
+func (b Builder) WithDetectEncoding() Builder {
+	b.reader.wrapSource(&bomReader{src: bufio.NewReader(b.reader.reader)})
+	return b
+}
+
+// WithSniffCharset makes the Reader to be created sniff the charset of a markup source (HTML or XML). The first
+// 1024 bytes of the source are inspected for an XML declaration (<?xml ... encoding="..."?>) or an HTML meta charset
+// declaration (<meta charset="..."> or <meta ... content="...; charset=...">). If a charset is declared the source
+// is decoded accordingly (see Builder.WithCharset). If no charset is declared, or the declared charset is unknown,
+// the source is assumed to be UTF-8 encoded. WithSniffCharset must be called after Builder.WithSource.
+func (b Builder) WithSniffCharset() Builder {
+	b.reader.wrapSource(&sniffReader{src: bufio.NewReaderSize(b.reader.reader, sniffSize)})
+	return b
+}
+
+// wrapSource replaces the source of the Reader with the provided reader wrapping the source. As the byte offsets of
+// the wrapping reader don't match the byte offsets of the source seeking is no longer supported.
+func (r *Reader) wrapSource(rd io.Reader) {
+	r.reader = bufio.NewReader(rd)
+	r.seeker = nil
+}
+
+// decodeReader returns an io.Reader decoding the provided source in the provided encoding into UTF-8.
+func decodeReader(src *bufio.Reader, encoding Encoding) io.Reader {
+	switch encoding {
+	case UTF16LE:
+		return &utf16Reader{src: src, order: binary.LittleEndian}
+	case UTF16BE:
+		return &utf16Reader{src: src, order: binary.BigEndian}
+	case UTF32LE:
+		return utf32.UTF32(utf32.LittleEndian, utf32.IgnoreBOM).NewDecoder().Reader(src)
+	case UTF32BE:
+		return utf32.UTF32(utf32.BigEndian, utf32.IgnoreBOM).NewDecoder().Reader(src)
+	}
+	return src
+}
+
+// WithDecoder specifies a decoder (see golang.org/x/text/encoding) used to decode the source of the Reader to be
+// created into UTF-8. It may be used to read sources in legacy encodings (e.g. charmap.Windows1252.NewDecoder()).
+// Positions are counted in decoded runes. WithDecoder must be called after Builder.WithSource.
+func (b Builder) WithDecoder(decoder *encoding.Decoder) Builder {
+	b.reader.wrapSource(decoder.Reader(b.reader.reader))
+	return b
+}
+
+// WithTextTransformer specifies a golang.org/x/text transformer (transform.Transformer) applied to the source of the
+// Reader to be created. The text transformer is applied to the source bytes before any runes are read from the
+// source. That is, before any transformers added to the Builder and positions are counted in runes resulting from
+// the text transformer. WithTextTransformer must be called after Builder.WithSource.
+func (b Builder) WithTextTransformer(t transform.Transformer) Builder {
+	b.reader.wrapSource(transform.NewReader(b.reader.reader, t))
+	return b
+}
+
+// WithQuotedPrintable makes the Reader to be created decode a MIME quoted-printable encoded source (see RFC 2045).
+// Encoded bytes (e.g. =41 for 'A') are decoded and soft line breaks (= at the end of a line) are removed before any
+// runes are read from the source. That is, positions are counted in decoded runes and a line joined by a soft line
+// break is a single row. A malformed encoded byte is read as a literal = while an invalid unencoded byte (e.g. a
+// control character) results in an error when reading from the source.
+// WithQuotedPrintable must be called after Builder.WithSource.
+func (b Builder) WithQuotedPrintable() Builder {
+	b.reader.wrapSource(quotedprintable.NewReader(b.reader.reader))
+	return b
+}
+
+// WithBase64Source makes the Reader to be created decode a base64 encoded source (standard encoding as defined in
+// RFC 4648). The source is decoded while read and runes are read from the decoded bytes. That is, positions are
+// counted in decoded runes. Newlines (CR and LF) in the encoded source are ignored. Malformed base64 results in an
+// error when reading from the source. WithBase64Source must be called after Builder.WithSource.
+func (b Builder) WithBase64Source() Builder {
+	b.reader.wrapSource(base64.NewDecoder(base64.StdEncoding, b.reader.reader))
+	return b
+}
+
+// WithCharset specifies the charset of the source for the Reader to be created by name (e.g. "latin1", "shift_jis"
+// or "windows-1252"). The charset names are the names defined by the WHATWG Encoding Standard (see
+// golang.org/x/text/encoding/htmlindex). If the charset is unknown the created Reader returns an error when reading
+// from the source. WithCharset must be called after Builder.WithSource.
+func (b Builder) WithCharset(name string) Builder {
+	enc, err := htmlindex.Get(name)
+	if err != nil {
+		b.reader.wrapSource(errorSource{err: fmt.Errorf("unknown charset %q: %w", name, err)})
+		return b
+	}
+	return b.WithDecoder(enc.NewDecoder())
+}
+
+// InvalidUTF8Policy specifies how a Reader manages invalid UTF-8 encoded bytes in the source (see
+// Builder.WithInvalidUTF8Policy).
+type InvalidUTF8Policy int
+
+const (
+	// InvalidUTF8Replace replaces each invalid byte with the unicode replacement character (U+FFFD).
+	InvalidUTF8Replace InvalidUTF8Policy = iota
+	// InvalidUTF8Error returns a positional error (including the value of the invalid byte) for each invalid byte.
+	InvalidUTF8Error
+	// InvalidUTF8Skip skips invalid bytes.
+	InvalidUTF8Skip
+)
+
+// WithInvalidUTF8Policy specifies how the Reader to be created manages invalid UTF-8 encoded bytes in the source. As
+// default each invalid byte is replaced with the unicode replacement character (InvalidUTF8Replace).
+func (b Builder) WithInvalidUTF8Policy(policy InvalidUTF8Policy) Builder {
+	b.reader.invalidUTF8 = policy
+	return b
+}
+
+// WithWarningHandler makes the Reader to be created call the provided handler for recoverable anomalies in the
+// source. The handler is called with the position of the anomaly and an error describing it, but the read doesn't
+// fail. The reported anomalies are:
+//   - a byte order mark (U+FEFF) not at the start of the source (ErrUnexpectedBOM)
+//   - a line ending (LF, CR or CRLF) differing from the first line ending of the source (ErrMixedLineEndings)
+//   - an invalid UTF-8 encoded byte replaced or skipped (ErrInvalidUTF8, see Builder.WithInvalidUTF8Policy)
+//   - a replacement character (U+FFFD) in the source (ErrReplacementCharacter)
+//
+// Each anomaly is reported once even if the runes are read again (e.g. by a transformer). Anomalies in the source
+// Reader (see Builder.WithReader) are not reported.
+func (b Builder) WithWarningHandler(handler func(Position, error)) Builder {
+	b.reader.warn = handler
+	return b
+}
+
+// NewlinePolicy specifies how the Reader tracks rows in the source (see Builder.WithNewlinePolicy).
+type NewlinePolicy int
+
+const (
+	// NewlinePolicyNone doesn't track rows. Rows are only bumped by transformers (e.g. the newline normalizer).
+	NewlinePolicyNone NewlinePolicy = iota
+	// NewlinePolicyLF bumps the row after each newline (\u000A) read from the source.
+	NewlinePolicyLF
+	// NewlinePolicyAll bumps the row after each newline (\u000A), carriage return (\u000D) and carriage return +
+	// newline read from the source.
+	NewlinePolicyAll
+)
+
+// WithNewlinePolicy specifies how the Reader to be created tracks rows in the source. If a policy other than
+// NewlinePolicyNone is used the Reader bumps the row when reading newlines from the source, even if the newline
+// runes are passed through unmodified. Rows are then solely tracked according to the policy and transformers
+// (e.g. the newline normalizer) will not bump rows.
+func (b Builder) WithNewlinePolicy(policy NewlinePolicy) Builder {
+	b.reader.newlinePolicy = policy
+	return b
+}
+
+// ColumnUnit specifies the unit columns are counted in by the Reader (see Builder.WithColumnUnit).
+type ColumnUnit int
+
+const (
+	// ColumnRunes counts columns in runes.
+	ColumnRunes ColumnUnit = iota
+	// ColumnUTF16 counts columns in UTF-16 code units. A rune outside the basic multilingual plane (e.g. most
+	// emojis) is two columns wide. This is the column unit of the language server protocol (LSP).
+	ColumnUTF16
+	// ColumnBytes counts columns in UTF-8 encoded bytes.
+	ColumnBytes
+	// ColumnGraphemes counts columns in extended grapheme clusters (user-perceived characters). A rune extending a
+	// grapheme cluster (e.g. a combining accent or an emoji joined by a zero-width joiner) has the column of the
+	// first rune of the cluster. Note that only a subset of the Unicode grapheme cluster boundary rules (see Unicode
+	// Standard Annex #29) is implemented; combining marks, zero-width joiner sequences, variation selectors, emoji
+	// modifiers, tag sequences and regional indicator pairs (flags).
+	ColumnGraphemes
+	// ColumnDisplayWidth counts columns in display width according to the Unicode East Asian Width property (see
+	// Unicode Standard Annex #11). Wide and fullwidth runes (e.g. CJK ideographs) are two columns wide while all
+	// other runes (including ambiguous width runes) are one column wide.
+	ColumnDisplayWidth
+)
+
+// WithColumnUnit specifies the unit columns are counted in by the Reader to be created. As default columns are
+// counted in runes. The column of a rune is the column of its first unit. Note that columns are counted in the
+// runes read from the source, before any transformers are applied. For ColumnBytes the bytes are the UTF-8 encoded
+// bytes read from the source (after any decoding of the source, see Builder.WithEncoding). An invalid UTF-8 encoded
+// byte is always one column wide.
+func (b Builder) WithColumnUnit(unit ColumnUnit) Builder {
+	b.reader.columnUnit = unit
+	return b
+}
+
+// WithTabWidth makes a tab (\u0009) read by the Reader to be created advance the column to the next tab stop. Tab
+// stops are located every width columns (e.g. column 1, 9, 17 and so on for width 8). As default a tab advances the
+// column by one like any other rune. If width is less than 1 a panic is raised.
+func (b Builder) WithTabWidth(width int) Builder {
+	if width < 1 {
+		panic(fmt.Errorf("illegal tab width %d", width))
+	}
+	b.reader.tabWidth = width
+	return b
+}
+
+// WithZeroBased makes the Reader to be created count rows and columns from 0. That is, the position of the first rune
+// in the source is 0/0 and the first column of each row is 0. As default rows and columns are counted from 1.
+// WithZeroBased resets the start position and must therefore be called before Builder.WithStartPosition.
+func (b Builder) WithZeroBased() Builder {
+	b.reader.zeroBased = true
+	b.reader.pos.Row, b.reader.pos.Col = 0, 0
+	return b
+}
+
+// WithPositionFormat specifies the format of the string representation of the positions of the Chars read by the
+// Reader to be created (see Position.String). The format is also used by the positional errors returned by the
+// Reader. Using PositionLineCol together with a named file (see NewFromFile and Builder.WithFileName) errors are
+// rendered as "file:line:col" (e.g. "main.cfg:2:5: unexpected EOF reading unicode escape"). By default positions
+// are rendered as <row>/<column>.
+func (b Builder) WithPositionFormat(format PositionFormat) Builder {
+	b.reader.posFormat = format
+	return b
+}
+
+// WithStartPosition specifies the position of the first rune in the source for the Reader to be created. It may be
+// used when resuming reading in the middle of a document. The rows following the first row start at the first
+// column (1 or 0 if zero-based, see Builder.WithZeroBased). If the provided position has no file name (or source
+// name) the file name (or source name) of the source is kept (see Builder.WithFileName and Builder.WithSourceName).
+// WithStartPosition must be called after Builder.WithSource.
+func (b Builder) WithStartPosition(pos Position) Builder {
+	if pos.File == "" {
+		pos.File = b.reader.pos.File
+	}
+	if pos.Source == "" {
+		pos.Source = b.reader.pos.Source
+	}
+	b.reader.pos = pos
+	return b
+}
+
+// WithNormalizeNewline adds a newline normalizer to the Reader to be created. The newline normalizer
+// transforms the following rune sequences to a single newline (\u000A).
+//
+//	CR (\u000D)
+//	CR (\u000D) + NL (\u000A)
+func (b Builder) WithNormalizeNewline() Builder {
+	return b.withTransformer("NormalizeNewline", singleTransformer{normalizeNewline{}})
+}
+
+// Newlines is a set of additional line terminators (besides CR, NL and CR + NL) that may be normalized to a single
+// newline (see Builder.WithUnicodeNewlines). Line terminators are combined using bitwise or (NewlineNEL | NewlineLS).
+type Newlines uint
+
+const (
+	// NewlineNEL is the next line control character (\u0085).
+	NewlineNEL Newlines = 1 << iota
+	// NewlineLS is the line separator (\u2028).
+	NewlineLS
+	// NewlinePS is the paragraph separator (\u2029).
+	NewlinePS
+	// NewlineVT is the vertical tab (\u000B).
+	NewlineVT
+	// NewlineFF is the form feed (\u000C).
+	NewlineFF
+	// UnicodeNewlines is the set of additional line terminators defined by the unicode standard.
+	UnicodeNewlines = NewlineNEL | NewlineLS | NewlinePS | NewlineVT | NewlineFF
+)
+
+// newlineRunes maps the rune of each additional line terminator to the line terminator.
+var newlineRunes = map[rune]Newlines{
+	'\u0085': NewlineNEL,
+	'\u2028': NewlineLS,
+	'\u2029': NewlinePS,
+	'\u000B': NewlineVT,
+	'\u000C': NewlineFF,
+}
+
+// WithUnicodeNewlines adds an extended newline normalizer to the Reader to be created. The extended newline
+// normalizer works as the newline normalizer (see Builder.WithNormalizeNewline) but also transforms the provided
+// additional line terminators to a single newline (\u000A) and bumps the row. Line terminators not in the provided
+// set are treated as ordinary runes. The extended newline normalizer should be used instead of (not together with)
+// the newline normalizer.
+func (b Builder) WithUnicodeNewlines(newlines Newlines) Builder {
+	return b.withTransformer("UnicodeNewlines", singleTransformer{normalizeNewline{newlines: newlines}})
+}
+
+// WithUnicodeEscape adds a unicode escape transformer to the Reader to be created. A unicode escape transformer
+// transform the common unicode escape rune sequence '\uhhhh' to the unicode rune represented by the hexadecimal
+// number '0xhhhh'. Code points above the basic multilingual plane may be escaped using the eight digit unicode
+// escape rune sequence '\Uhhhhhhhh'. An escaped UTF-16 surrogate pair ('\uD83D\uDE00') is combined into the single
+// rune represented by the surrogate pair.
+func (b Builder) WithUnicodeEscape() Builder {
+	return b.withTransformer("UnicodeEscape", singleTransformer{unicodeEscape{}})
+}
+
+// WithUnicodeBraceEscape adds a unicode escape transformer also supporting the brace form "\u{h...}" (1-6 hex
+// digits) to the Reader to be created. The brace form unicode escape is transformed to the rune represented by the
+// hexadecimal number. An empty brace form unicode escape or a value that is not a valid rune (above U+10FFFF or a
+// surrogate) returns a positional error. Otherwise the transformer works as the unicode escape transformer (see
+// Builder.WithUnicodeEscape).
+func (b Builder) WithUnicodeBraceEscape() Builder {
+	return b.withTransformer("UnicodeBraceEscape", singleTransformer{unicodeEscape{braces: true}})
+}
+
+// HexEscapePolicy specifies how a hex escape transformer (see Builder.WithHexEscape) treats hex escapes with a value
+// greater than or equal to 0x80.
+type HexEscapePolicy int
+
+const (
+	// HexEscapeLatin1 treats a hex escape value as a Latin-1 (ISO-8859-1) code point. That is, '\xe5' is
+	// transformed to the rune U+00E5.
+	HexEscapeLatin1 HexEscapePolicy = iota
+	// HexEscapeASCII only accepts hex escape values in the ASCII range (< 0x80). Other values result in an error.
+	HexEscapeASCII
+)
+
+// WithHexEscape adds a hex escape transformer to the Reader to be created. A hex escape transformer transform the
+// hex escape rune sequence '\xhh' to the rune represented by the hexadecimal number '0xhh'. How to manage hex
+// escapes with values greater than or equal to 0x80 is specified by the provided policy.
+func (b Builder) WithHexEscape(policy HexEscapePolicy) Builder {
+	return b.withTransformer("HexEscape", singleTransformer{hexEscape{policy: policy}})
+}
+
+// WithEntityDecode adds a named entity decoder to the Reader to be created. The entity decoder transform HTML/XML
+// named character references ('&amp;', '&lt;', '&quot;' etc.) to the rune(s) represented by the entity. All the
+// HTML5 named entities are supported. The resulting runes get the position of the '&'. An '&' not followed by a
+// letter is returned as is. An unknown or unterminated entity results in an error.
+func (b Builder) WithEntityDecode() Builder {
+	return b.withTransformer("EntityDecode", entityDecode{})
+}
+
+// WithCharRefDecode adds a numeric character reference decoder to the Reader to be created. The decoder transform
+// decimal ('&#65;') and hexadecimal ('&#x1F600;') numeric character references to the rune represented by the
+// reference. The resulting rune gets the position of the '&'. An '&' not followed by '#' is returned as is. A
+// malformed reference or a reference to an invalid code point (surrogate or out of range) results in an error.
+func (b Builder) WithCharRefDecode() Builder {
+	return b.withTransformer("CharRefDecode", singleTransformer{charRefDecode{}})
+}
+
+// WithLineContinuation adds a line continuation transformer to the Reader to be created. The line continuation
+// transformer removes a backslash (\u005C) immediately followed by a newline (LF, CR or CR + LF). That is, physical
+// lines ending with a backslash are joined into a single logical line. The row of the position of the runes after
+// the line continuation is still bumped to the next row.
+func (b Builder) WithLineContinuation() Builder {
+	return b.withTransformer("LineContinuation", lineContinuation{})
+}
+
+// WithLineDirectives adds a line directive transformer to the Reader to be created. The line directive transformer
+// handles line directives overriding the positions of the following lines. A line directive is a line starting with
+// either a Go line directive (e.g. //line gen.y:10:5 or //line gen.y:10) or a C line directive (e.g. #line 10 or
+// #line 10 "gen.y"). The position of the line following the directive is set to the row (and column) of the
+// directive and the file name of the following positions is set to the file name of the directive (if any, see
+// Position.File). The line directive line is removed. A malformed line directive returns a positional error.
+func (b Builder) WithLineDirectives() Builder {
+	return b.withTransformer("LineDirectives", &lineDirective{})
+}
+
+// IncludeResolver resolves the name of an included source (see Builder.WithInclude) into a reader of the included
+// source. If the returned reader is an io.Closer it is closed when the included source has been read. If the name
+// can't be resolved an error is returned.
+type IncludeResolver func(name string) (io.Reader, error)
+
+// WithInclude adds an include transformer to the Reader to be created. The include transformer handles include
+// directives. An include directive is a line starting with the provided directive (e.g. "#include" or "%include")
+// followed by whitespace and a quoted file name ("<name>"). The include directive line is removed and the included
+// source, resolved by the provided resolver, is read before continuing with the rest of the source. The positions
+// of the runes read from an included source point into the included source (see Position.File). Included sources
+// may include other sources up to a maximum depth (maxIncludeDepth). A malformed include directive or a name that
+// can't be resolved returns a positional error.
+func (b Builder) WithInclude(directive string, resolver IncludeResolver) Builder {
+	return b.withTransformer("Include", &include{directive: []rune(directive), resolve: resolver})
+}
+
+// WithStripANSI adds an ANSI stripping transformer to the Reader to be created. The ANSI stripping transformer
+// removes CSI sequences (ESC '[' or \u009B followed by parameter and intermediate bytes and a final byte, e.g. color
+// codes "\x1b[31m") and OSC sequences (ESC ']' or \u009D terminated by BEL, ESC '\' or \u009C) from the source.
+// An incomplete sequence at the end of the source is removed.
+func (b Builder) WithStripANSI() Builder {
+	return b.withTransformer("StripANSI", stripANSI{})
+}
+
+// WithSkipShebang adds a shebang transformer to the Reader to be created. The shebang transformer removes a leading
+// shebang line (a first line starting with "#!") including the terminating newline (LF, CR or CR + LF). The row of
+// the next position is bumped so that the first Char after the shebang line is positioned at row 2.
+func (b Builder) WithSkipShebang() Builder {
+	return b.withTransformer("SkipShebang", &shebang{})
+}
+
+// WithTranslation adds a translation transformer to the Reader to be created. The translation transformer translates
+// rune sequences (map keys) to replacement sequences (map values) according to the provided table (e.g. CTrigraphs
+// or CDigraphs). If several sequences match at the same position the longest sequence is translated. All runes
+// resulting from a translation get the position of the first rune in the translated sequence.
+func (b Builder) WithTranslation(table map[string]string) Builder {
+	t := translation{}
+	for from, to := range table {
+		if from != "" {
+			t.from = append(t.from, []rune(from))
+			t.to = append(t.to, to)
+		}
+	}
+	return b.withTransformer("Translation", t)
+}
+
+// CTrigraphs is a translation table (see Builder.WithTranslation) for the C trigraphs.
+var CTrigraphs = map[string]string{
+	"??=": "#",
+	"??/": "\\",
+	"??'": "^",
+	"??(": "[",
+	"??)": "]",
+	"??!": "|",
+	"??<": "{",
+	"??>": "}",
+	"??-": "~",
+}
+
+// CDigraphs is a translation table (see Builder.WithTranslation) for the C digraphs.
+var CDigraphs = map[string]string{
+	"<:":   "[",
+	":>":   "]",
+	"<%":   "{",
+	"%>":   "}",
+	"%:":   "#",
+	"%:%:": "##",
+}
+
+// WithCommentStrip adds a comment stripping transformer to the Reader to be created. The comment stripping
+// transformer removes line comments (starting with lineStart and ending before the next newline) and block comments
+// (starting with blockStart and ending with blockEnd) from the source. An empty lineStart disables line comments and
+// an empty blockStart (or blockEnd) disables block comments. If both a line comment and a block comment start match,
+// the longest start is used. A block comment not terminated before the end of the source results in an error.
+//
+// Newlines (LF, CR or CR + LF) in a removed block comment bump the row of the position of the runes after the block
+// comment. The newline terminating a line comment is not removed.
+//
+// Note that the comment stripping transformer has no knowledge about the syntax of the source (e.g. string
+// literals).
+func (b Builder) WithCommentStrip(lineStart, blockStart, blockEnd string) Builder {
+	return b.withTransformer("CommentStrip", newCommentStrip(lineStart, blockStart, blockEnd, false))
+}
+
+// WithCommentReplace adds a comment replacing transformer to the Reader to be created. The comment replacing
+// transformer works as the comment stripping transformer (see Builder.WithCommentStrip) except that each comment is
+// replaced with a single space (\u0020) having the position of the start of the comment.
+func (b Builder) WithCommentReplace(lineStart, blockStart, blockEnd string) Builder {
+	return b.withTransformer("CommentReplace", newCommentStrip(lineStart, blockStart, blockEnd, true))
+}
+
+// WithCollapseWhitespace adds a whitespace collapsing transformer to the Reader to be created. The whitespace
+// collapsing transformer collapses runs of spaces (\u0020) and tabs (\u0009) into a single space having the position
+// of the first rune in the run. If trim is true runs of spaces and tabs at the start of a line (leading) or before
+// a newline or the end of the source (trailing) are removed.
+func (b Builder) WithCollapseWhitespace(trim bool) Builder {
+	return b.withTransformer("CollapseWhitespace", &collapseWhitespace{trim: trim, lineStart: true})
+}
+
+// ControlCharAction specifies what a control character transformer (see Builder.WithControlCharPolicy) does with a
+// control character that is not allowed.
+type ControlCharAction int
+
+const (
+	// ControlCharError returns a positional error for a control character.
+	ControlCharError ControlCharAction = iota
+	// ControlCharStrip removes a control character.
+	ControlCharStrip
+	// ControlCharReplace replaces a control character with the unicode replacement character (U+FFFD).
+	ControlCharReplace
+)
+
+// WithControlCharPolicy adds a control character transformer to the Reader to be created. The control character
+// transformer manages C0 and C1 control characters (as defined by unicode.IsControl) that are not in the provided
+// set of allowed control characters (e.g. tab and newline) according to the provided action.
+func (b Builder) WithControlCharPolicy(allow []rune, action ControlCharAction) Builder {
+	return b.withTransformer("ControlCharPolicy", controlChar{allow: allow, action: action})
+}
+
+// BidiPolicy specifies what a bidi transformer (see Builder.WithBidiPolicy) does with a bidirectional control
+// character or a zero-width character.
+type BidiPolicy int
+
+const (
+	// BidiError returns a positional error for a bidirectional control character or a zero-width character.
+	BidiError BidiPolicy = iota
+	// BidiStrip removes a bidirectional control character or a zero-width character.
+	BidiStrip
+)
+
+// WithBidiPolicy adds a bidi transformer to the Reader to be created. The bidi transformer manages bidirectional
+// control characters (\u061C, \u200E, \u200F, \u202A-\u202E and \u2066-\u2069) and zero-width characters
+// (\u200B-\u200D, \u2060 and \uFEFF) according to the provided policy. Such invisible characters may be used to make
+// source code look different to a human than to a compiler (Trojan Source attacks).
+func (b Builder) WithBidiPolicy(policy BidiPolicy) Builder {
+	return b.withTransformer("BidiPolicy", bidi{policy: policy})
+}
+
+// WithRuneEscape adds a rune escape transformer to the Reader to be created. A rune escape transformer
+// transform a rune sequence '\<from rune>' to the corresponding <to rune>. The rune escape transformations
+// to be used is specified in a map where the <from rune> is the map key and the <to rune> is the map value.
+//
+// When reading runes from the Reader source we read an escaped rune (\<rune>)  Reader.Next will return
+// <to rune> if there exist a specified escape <rune> => <to rune>. Otherwise Reader.Next will return <rune>.
+// In both cases the Char wrapping the rune will have Char.Escaped set to true.
+//
+// An example of a rune escape specification:
+//
+//	map[rune]rune{'t': '\u0009'} will transform a rune sequence "\r" to the tab rune (\u0009).
+func (b Builder) WithRuneEscape(escapes map[rune]rune) Builder {
+	return b.withTransformer("RuneEscape", runeEscape{escapes: escapes})
+}
+
+// WithRuneEscapeExpand adds an expanding rune escape transformer to the Reader to be created. An expanding rune
+// escape transformer works as the rune escape transformer (see Builder.WithRuneEscape) except that an escape
+// sequence '\<from rune>' is transformed to a sequence of runes (<to string>). The rune escape transformations to
+// be used is specified in a map where the <from rune> is the map key and the <to string> is the map value. All
+// the resulting Chars get the position of the escape sequence and have Char.Escaped set to true. Note that an empty
+// <to string> removes the escape sequence.
+//
+// An example of an expanding rune escape specification:
+//
+//	map[rune]string{'e': "\x1b["} will transform a rune sequence "\e" to the two runes ESC (\u001B) and '['.
+func (b Builder) WithRuneEscapeExpand(escapes map[rune]string) Builder {
+	return b.withTransformer("RuneEscapeExpand", runeEscape{expansions: escapes})
+}
+
+// WithStrictRuneEscape adds a strict rune escape transformer to the Reader to be created. A strict rune escape
+// transformer works as the rune escape transformer (see Builder.WithRuneEscape) except that an escape sequence
+// that is not configured ('\<rune>' where <rune> is not configured in the map) results in an "unknown escape
+// sequence" error returned from Reader.Next. Note that an escaped backslash ('\\') must then be configured
+// explicitly (map[rune]rune{'\\': '\\'}).
+func (b Builder) WithStrictRuneEscape(escapes map[rune]rune) Builder {
+	return b.withTransformer("StrictRuneEscape", runeEscape{escapes: escapes, strict: true})
+}
+
+// WithDoubledEscape adds a doubled escape transformer to the Reader to be created. A doubled escape transformer
+// transforms a pair of the same rune (e.g. two apostrophes inside SQL strings or two quotation marks inside CSV
+// fields), for any of the provided runes, into a single rune marked as escaped (see Char.Escaped). The escaped rune
+// gets the position of the first rune in the pair.
+func (b Builder) WithDoubledEscape(runes ...rune) Builder {
+	return b.withTransformer("DoubledEscape", singleTransformer{doubledEscape{runes: runes}})
+}
+
+// WithYAMLEscape adds a YAML escape transformer to the Reader to be created. The YAML escape transformer transforms
+// the escape sequences of YAML double-quoted scalars. That is, the rune escapes \0, \a, \b, \t, \<tab>, \n, \v, \f,
+// \r, \e, \<space>, \", \/, \\, \N (\u0085), \_ (\u00A0), \L (\u2028) and \P (\u2029) and the hex escapes \xXX,
+// \uXXXX and \UXXXXXXXX. Rune escapes are marked as escaped (see Char.Escaped). An unknown escape sequence or an
+// invalid hex escape returns a positional error.
+func (b Builder) WithYAMLEscape() Builder {
+	return b.withTransformer("YAMLEscape", singleTransformer{yamlEscape{}})
+}
+
+// WithNormalization adds a unicode normalization transformer to the Reader to be created. The normalization
+// transformer normalizes the read runes to the provided unicode normalization form (norm.NFC, norm.NFD, norm.NFKC
+// or norm.NFKD). A sequence of runes may be composed into a single rune and a single rune may be decomposed into
+// multiple runes. All runes resulting from normalizing a sequence of runes get the position of the first rune in
+// the sequence.
+func (b Builder) WithNormalization(form norm.Form) Builder {
+	return b.withTransformer("Normalization", normalization{form: form})
+}
+
+// WithTypographicNormalization adds a typographic normalization transformer to the Reader to be created. The
+// typographic normalization transformer maps typographic characters, commonly introduced by word processors, to
+// their ASCII equivalents. Curly single quotes (\u2018, \u2019, \u201A, \u201B) are mapped to an apostrophe
+// (\u0027), curly double quotes (\u201C, \u201D, \u201E, \u201F) to a quotation mark (\u0022), en and em dashes
+// (\u2013, \u2014) to a hyphen-minus (\u002D) and ellipsis (\u2026) to three full stops (\u002E). All runes
+// resulting from mapping a typographic character get the position of the typographic character.
+func (b Builder) WithTypographicNormalization() Builder {
+	return b.withTransformer("TypographicNormalization", typographic{})
+}
+
+// WithSpaceNormalization adds a space normalization transformer to the Reader to be created. The space normalization
+// transformer maps unicode space separators (unicode.Zs, e.g. no-break space \u00A0, figure space \u2007 and narrow
+// no-break space \u202F) to a regular space (\u0020). The position of the space is kept. If the provided warn
+// function is not nil it is called with each mapped space (before it is mapped) so that the application may report
+// the exotic space.
+func (b Builder) WithSpaceNormalization(warn func(c Char)) Builder {
+	return b.withTransformer("SpaceNormalization", singleTransformer{spaceNormalization{warn: warn}})
+}
+
+// WithConfusables adds a confusable normalization transformer to the Reader to be created. The confusable
+// normalization transformer maps confusable runes (homoglyphs, e.g. Cyrillic '\u0430' looking like Latin 'a') to the
+// rune they may be confused with according to the provided table. If the table is nil LatinConfusables is used. If
+// the provided report function is not nil it is called with each confusable Char (before it is mapped) together with
+// the rune it is mapped to. The position of the rune is kept.
+func (b Builder) WithConfusables(table map[rune]rune, report func(c Char, to rune)) Builder {
+	if table == nil {
+		table = LatinConfusables
+	}
+	return b.withTransformer("Confusables", singleTransformer{confusables{table: table, report: report}})
+}
+
+// LatinConfusables is the default table used by the confusable normalization transformer (see
+// Builder.WithConfusables). It holds the subset of the UTS #39 confusable mappings (confusables.txt) mapping
+// Cyrillic and Greek letters to the single Latin letter they are visually confused with. Applications requiring
+// the full UTS #39 table should provide it to Builder.WithConfusables.
+var LatinConfusables = map[rune]rune{
+	// Cyrillic
+	'\u0430': 'a', '\u0435': 'e', '\u043E': 'o', '\u0440': 'p', '\u0441': 'c', '\u0443': 'y', '\u0445': 'x',
+	'\u0455': 's', '\u0456': 'i', '\u0458': 'j', '\u0501': 'd', '\u04BB': 'h', '\u051B': 'q', '\u051D': 'w',
+	'\u0410': 'A', '\u0412': 'B', '\u0415': 'E', '\u041A': 'K', '\u041C': 'M', '\u041D': 'H', '\u041E': 'O',
+	'\u0420': 'P', '\u0421': 'C', '\u0422': 'T', '\u0425': 'X', '\u0405': 'S', '\u0406': 'I', '\u0408': 'J',
+	'\u04AE': 'Y',
+	// Greek
+	'\u03B1': 'a', '\u03BF': 'o', '\u03BD': 'v', '\u03C1': 'p', '\u0391': 'A', '\u0392': 'B', '\u0395': 'E',
+	'\u0396': 'Z', '\u0397': 'H', '\u0399': 'I', '\u039A': 'K', '\u039C': 'M', '\u039D': 'N', '\u039F': 'O',
+	'\u03A1': 'P', '\u03A4': 'T', '\u03A5': 'Y', '\u03A7': 'X',
+}
+
+// WithMapFunc adds a map function transformer to the Reader to be created. The map function transformer replaces
+// each read rune with the rune returned by the provided function. The position of the rune is kept. It may be used
+// for simple stateless rune substitutions (e.g. unicode.ToUpper) without implementing a Transformer.
+func (b Builder) WithMapFunc(f func(rune) rune) Builder {
+	return b.withTransformer("MapFunc", singleTransformer{mapFunc{f: f}})
+}
+
+// WithName names the transformer last added to the Builder replacing any default name (see Builder.Transformers).
+// The name may be used to disable and enable the transformer on the created Reader (see Reader.DisableTransformer
+// and Reader.EnableTransformer). Several transformers may share the same name and are then disabled and enabled
+// together. If no transformer has been added to the Builder a panic is raised.
+func (b Builder) WithName(name string) Builder {
+	if len(b.reader.transformers) == 0 {
+		panic("no transformer has been added to name")
+	}
+	b.reader.transformers[len(b.reader.transformers)-1].name = name
+	return b
+}
+
+// WithRegion restricts the transformer last added to the Builder to be active only in regions bounded by the
+// provided delimiters. A region starts with the open delimiter and ends with the close delimiter (open and close
+// may be the same rune, e.g. '"'). The delimiters themselves are not transformed by the restricted transformer. The
+// Reader tracks the region state itself when reading runes from the source. Note that the delimiters are detected
+// in the Chars passed to the restricted transformer. A delimiter transformed by a previous transformer (e.g. an
+// escaped '"') is therefore only detected if it has not been marked as escaped. If no transformer has been added
+// to the Builder a panic is raised.
+//
+// An example where unicode escapes are only transformed inside quotes:
+//
+//	Builder{}.WithSource(source).WithUnicodeEscape().WithRegion('"', '"').Reader()
+func (b Builder) WithRegion(open, close rune) Builder {
+	if len(b.reader.transformers) == 0 {
+		panic("no transformer has been added to restrict to a region")
+	}
+	t := &b.reader.transformers[len(b.reader.transformers)-1]
+	t.region = true
+	t.open = open
+	t.close = close
+	return b
+}
+
+// Transformers returns the names of the transformers added to the Builder in the order they are applied. The
+// transformers added by the Builder methods get the name of the method without the "With" prefix (e.g.
+// "UnicodeEscape" for Builder.WithUnicodeEscape). Custom transformers are unnamed (empty name) unless named using
+// Builder.WithName.
+func (b Builder) Transformers() []string {
+	names := make([]string, len(b.reader.transformers))
+	for i, t := range b.reader.transformers {
+		names[i] = t.name
+	}
+	return names
+}
+
+// InsertBefore moves the transformer last added to the Builder to just before the first transformer with the
+// provided name. If no transformer has been added to the Builder or if there is no other transformer with the
+// provided name a panic is raised.
+//
+// An example where a unicode escape transformer is applied before an already added rune escape transformer:
+//
+//	builder.WithUnicodeEscape().InsertBefore("RuneEscape")
+func (b Builder) InsertBefore(name string) Builder {
+	t, ts := b.popTransformer()
+	i := slices.IndexFunc(ts, func(t namedTransformer) bool { return t.name == name })
+	if i < 0 {
+		panic(fmt.Sprintf("unknown transformer %q", name))
+	}
+	b.reader.transformers = slices.Insert(ts, i, t)
+	return b
+}
+
+// InsertAfter moves the transformer last added to the Builder to just after the last (other) transformer with the
+// provided name. If no transformer has been added to the Builder or if there is no other transformer with the
+// provided name a panic is raised.
+func (b Builder) InsertAfter(name string) Builder {
+	t, ts := b.popTransformer()
+	i := len(ts) - 1
+	for i >= 0 && ts[i].name != name {
+		i--
+	}
+	if i < 0 {
+		panic(fmt.Sprintf("unknown transformer %q", name))
+	}
+	b.reader.transformers = slices.Insert(ts, i+1, t)
+	return b
+}
+
+// Remove removes all transformers with the provided name from the Builder. If there is no transformer with the
+// provided name a panic is raised.
+func (b Builder) Remove(name string) Builder {
+	ts := slices.DeleteFunc(b.reader.transformers, func(t namedTransformer) bool { return t.name == name })
+	if len(ts) == len(b.reader.transformers) {
+		panic(fmt.Sprintf("unknown transformer %q", name))
+	}
+	b.reader.transformers = ts
+	return b
+}
+
+// popTransformer removes the transformer last added to the Builder. The removed transformer and the remaining
+// transformers are returned. If no transformer has been added to the Builder a panic is raised.
+func (b Builder) popTransformer() (namedTransformer, []namedTransformer) {
+	n := len(b.reader.transformers)
+	if n == 0 {
+		panic("no transformer has been added to insert")
+	}
+	return b.reader.transformers[n-1], b.reader.transformers[:n-1]
+}
+
+// WithEscapeChar sets the escape rune of the transformer last added to the Builder. The escape rune replaces the
+// backslash (\u005C) introducing escape sequences (e.g. '`' for PowerShell-like dialects). The escape rune is
+// supported by the unicode, hex, rune and YAML escape transformers and by the line continuation transformer. If no
+// transformer has been added to the Builder or if the last added transformer doesn't support an escape rune a panic
+// is raised.
+//
+// An example where rune escapes are introduced by '%':
+//
+//	Builder{}.WithSource(source).WithRuneEscape(escapes).WithEscapeChar('%').Reader()
+func (b Builder) WithEscapeChar(escape rune) Builder {
+	if len(b.reader.transformers) == 0 {
+		panic("no transformer has been added to set escape rune for")
+	}
+	t := &b.reader.transformers[len(b.reader.transformers)-1]
+	var inner any = t.transformer
+	if single, ok := t.transformer.(singleTransformer); ok {
+		inner = single.Transformer
+	}
+	e, ok := inner.(escapable)
+	if !ok {
+		panic(fmt.Sprintf("transformer %q doesn't support an escape rune", t.name))
+	}
+	t.transformer = e.withEscape(escape)
+	return b
+}
+
+// withTransformer adds the provided internal transformer with the provided name to the Reader to be created.
+func (b Builder) withTransformer(name string, t transformer) Builder {
+	b.reader.transformers = append(b.reader.transformers, namedTransformer{transformer: t, name: name})
+	return b
+}
+
+// Reader returns the Reader created from the builder. If no buffer size has been specified using method WithSize
+// then a decent default size will be used for the created Reader. If a reader source has not been specified, using
+// Builder.WithSource, then a panic is raised.
+func (b Builder) Reader() *Reader {
+	reader := b.reader
+	if reader.reader == nil && reader.upstream == nil {
+		panic("method WithSource has not been called to set the source for the reader to be created")
+	}
+	if reader.buffer == nil {
+		reader.buffer = newCharBuffer(100, 10)
+	}
+	if reader.upstream == nil {
+		reader.pos.format = reader.posFormat
+	}
+	reader.transformers = slices.Clone(reader.transformers)
+	reader.transparent = true
+	for i := range reader.transformers {
+		t := &reader.transformers[i]
+		t.apply = transformFuncOf(t.transformer)
+		t.ascii = asciiTransparentOf(t.transformer)
+		reader.transparent = reader.transparent && t.ascii != nil
+	}
+	reader.size = -1
+	if reader.seeker != nil {
+		// Index the start of the first row at the current offset of the source.
+		offset, err := reader.seeker.Seek(0, io.SeekCurrent)
+		if err != nil {
+			reader.seeker = nil
+		} else {
+			reader.srcOffset, reader.srcStart = offset, offset
+			reader.lines = []lineStart{{offset: offset, pos: reader.pos}}
+			reader.size = sourceSize(reader.seeker, offset)
+		}
+	}
+	return reader
+}
+
+// sourceSize returns the number of bytes from the provided offset to the end of the provided source. The source is
+// sought back to the offset. If the size can't be determined -1 is returned.
+func sourceSize(seeker io.Seeker, offset int64) int64 {
+	end, err := seeker.Seek(0, io.SeekEnd)
+	if err != nil {
+		return -1
+	}
+	if _, err = seeker.Seek(offset, io.SeekStart); err != nil {
+		return -1
+	}
+	return end - offset
+}
+
+// The start position of the Reader source. Note that the first row is 1 and first column is 1.
+var startPosition = Position{
+	Row: 1,
+	Col: 1,
+}
+
+// origin returns the position of the first rune in a source (and the first column of each row). The origin is 1/1
+// unless the Reader counts rows and columns from 0 (see Builder.WithZeroBased).
+func (r *Reader) origin() Position {
+	if r.zeroBased {
+		return Position{}
+	}
+	return startPosition
+}
+
+// Reader reads runes from an io.Reader specified when creating the Reader. The io.Reader is wrapped in a
+// bufio.Reader for better performance and support for reading runes. The read runes are transformed using the
+// configured transformers (specified using a reader Builder).
+//
+// The Reader treats the source as a two-dimensional rune document containing rows and columns. The Reader returns
+// the starting position of the read rune. The Reader will bump to a new line when it reads a newline rune (\u000A).
+// The Reader may also manage some other common newline sequences using the normalize newline transformer
+// (configured with Builder.WithNormalizeNewline). Note that a transformer may convert a sequence of runes into a
+// single rune (e.g. parsing escape sequences) read by method Read. The position of each rune will therefore not
+// necessarily be consecutive positions.
+//
+// The Reader supports two models for lookahead.
+//
+// Reader supports one rune lookahead using the common next/consume pattern. When calling Reader.Next the
+// next unread element is returned. Consecutive calls to Reader.Next will return the same element. The current
+// next element may be consumed by calling Reader.Consume. The next call to Reader.Next will return the element
+// after the consumed element. Reader.Peek may be used to look further ahead than the next element without
+// consuming any elements.
+//
+// Reader also supports multiple element lookahead using rollbacks to a saved state. Reader.State creates a
+// state. A call to Reader.Rollback will rollback to the provided state. After a rollback the next element
+// returned by Reader.Next will be the "next element" when the state was created.
+//
+// To mitigate the Reader internal buffer to grow infinitely a Reader may be committed to remove previously read
+// elements by calling Reader.Commit. A commit removes the runes consumed before the oldest live state (see
+// Builder.WithLiveStates), or all consumed runes if there is no live state. The last consumed rune is kept as long as
+// it may be unconsumed (see Reader.Unconsume). The space of the removed runes is reclaimed when the internal buffer
+// is full, so a Reader committed regularly will not grow beyond the runes read between the commits (and the runes
+// kept for live states).
+type Reader struct {
+	reader        source
+	upstream      *Reader          // Source Reader (see WithReader)
+	seeker        io.ReadSeeker    // The source if seekable (see Seek)
+	conn          readDeadliner    // The source if it supports read deadlines (see WithReadTimeout)
+	readTimeout   time.Duration    // Timeout for each read from the source (zero if no timeout)
+	attempt       []sizedRune      // Runes read from the source while buffering the current Char (see WithReadTimeout)
+	attemptStart  unreadState      // Read state before buffering the current Char
+	retry         []sizedRune      // Runes to read again after a timed out read
+	fromRetry     bool             // True if the last read rune was read from retry
+	timedOut      bool             // True if the last read from the source timed out
+	srcOffset     int64            // Byte offset in the source of "next rune"
+	srcStart      int64            // Byte offset in the source of the first rune
+	size          int64            // Number of bytes in the source (-1 if unknown, see Progress)
+	lines         []lineStart      // Start of the rows read from a seekable source (index 0 is the first row)
+	file          string           // Name of the source file (if any)
+	includes      []includedSource // Stack of sources including the current source (see WithInclude)
+	pos           Position         // Position of "next rune"
+	buffer        *charBuffer
+	transformers  []namedTransformer
+	transformed   [2][]Char // Scratch buffers used when transforming a read rune
+	transparent   bool      // True if plain ASCII runes may pass all transformers (see passThrough)
+	pushed        []Char    // Pushed back chars (stack where the last element is the next char)
+	prev          Char      // Most recently consumed char
+	hasPrev       bool
+	unconsume     State // State before the most recent consume (zero state if none)
+	marks         map[string]State
+	offset        int         // Number of consumed buffered chars
+	liveStates    bool        // True if States are tracked until released (see WithLiveStates)
+	states        map[int]int // Buffer read index of each live State by State id
+	liveReads     map[int]int // Number of live States by buffer read index
+	oldestReads   readHeap    // Buffer read indices of live States (may hold indices of released States)
+	nextStateID   int
+	invalidUTF8   InvalidUTF8Policy
+	bypass        bool                  // True if transformers are bypassed (see SetRaw)
+	rawText       bool                  // True if the source text of each Char is recorded
+	spans         bool                  // True if the end position of each Char is recorded
+	lineCache     []cachedLine          // Most recently read lines (see WithLineCache)
+	lineCacheSize int                   // Maximum number of cached lines (zero if lines are not cached)
+	line          []rune                // Runes read from the source on the current row (if lines are cached)
+	lineRow       int                   // Row of the runes in line
+	tee           io.Writer             // Writer consumed runes are written to (see WithTee)
+	teeRaw        bool                  // True if the source text of consumed Chars are written to tee
+	teeErr        error                 // The first error writing to tee
+	err           error                 // Error returned by the last read from the source (see Err)
+	pending       error                 // Error returned by fill in AtEOF not yet returned by a read (see AtEOF)
+	errors        []error               // Collected errors (see WithErrorLimit)
+	errorLimit    int                   // Maximum number of collected errors (zero if errors are not collected)
+	recovery      ErrorRecovery         // How to recover from transformer errors (see WithErrorRecovery)
+	sourceMap     []sourceRange         // Byte ranges of the read Chars (nil if not recorded, see WithSourceMap)
+	counts        readCounts            // Counters of runes, bytes and rows read from the source (see Stats)
+	consumed      int                   // Number of consumed Chars
+	escapes       int                   // Number of read Chars decoded from escape sequences
+	progress      func(int64, int64)    // Progress callback (see WithProgress)
+	progressEvery int64                 // Number of read bytes between calls to progress
+	progressLast  int64                 // Number of read bytes when progress was last called
+	lexing        bool                  // True if consumed runes are captured (see StartLexeme)
+	lexeme        []rune                // Runes consumed since the lexeme was started
+	lexStart      Position              // Position of the start of the lexeme
+	warn          func(Position, error) // Handler of anomalies in the source (see WithWarningHandler)
+	reread        bool                  // True if the next rune read from the source has been unread
+	lineEnding    string                // The first line ending of the source (if anomalies are reported)
+	crPos         Position              // Position of the last CR read from the source (if anomalies are reported)
+	lenientEOF    bool                  // True if runes are passed through when a transformer fails at EOF
+	raw           []Char                // Source runes read for the Char(s) currently being transformed
+	eof           bool                  // True if EOF has been read from the source by the current transformer
+	// Row tracking according to newline policy
+	newlinePolicy NewlinePolicy
+	zeroBased     bool // True if rows and columns are counted from 0 (see WithZeroBased)
+	columnUnit    ColumnUnit
+	posFormat     PositionFormat
+	grapheme      graphemeState // State of the grapheme cluster being read (see ColumnGraphemes)
+	tabWidth      int           // Number of columns between tab stops (zero if tabs are one column wide)
+	byteOffsets   bool          // True if byte offsets are tracked in positions (see WithByteOffsets)
+	runeIndex     bool          // True if rune indexes are tracked in positions (see WithRuneIndex)
+	cr            bool          // True if the last read rune was CR
+	crEnd         Position      // Position after the last read CR (before the row was bumped)
+	unread        unreadState   // State to restore when unreading the last read rune
+	// Anchored regular expressions (see MatchRegexp)
+	regexps map[anchoredKey]*regexp.Regexp
+}
+
+// unreadState holds the position state of a Reader to restore when unreading a rune.
+type unreadState struct {
+	pos      Position
+	cr       bool
+	crEnd    Position
+	offset   int64
+	width    int           // Column width of the last read rune
+	grapheme graphemeState // Grapheme state before the last read rune
+	counts   readCounts    // Read counters before the last read rune
+}
+
+// readCounts holds the counters of the runes, bytes and rows read from the source (see Reader.Stats).
+type readCounts struct {
+	runes int
+	bytes int
+	rows  int
+}
+
+// cachedLine holds the source text of a read line (see Builder.WithLineCache).
+type cachedLine struct {
+	row  int
+	text string
+}
+
+// sizedRune holds a rune read from the source and the number of bytes of the rune.
+type sizedRune struct {
+	ru   rune
+	size int
+}
+
+// sourceRange is the byte range of the source text producing the Char at a position (see Builder.WithSourceMap).
+type sourceRange struct {
+	pos   Position
+	start int
+	end   int
+}
+
+// lineStart holds the state of a Reader at the start of a row in a seekable source.
+type lineStart struct {
+	offset int64    // Byte offset of the first rune of the row
+	cr     bool     // True if the previous row was ended by CR (see Reader.cr)
+	pos    Position // Position of the first rune of the row
+	crEnd  Position // Position after the CR ending the previous row
+}
+
+// Next returns the next Char from the Reader. The source Position of the rune is returned. If there are no
+// more runes to be read from the configured source an io.EOF error is returned.
+//
+// If there was an error reading a rune from the source the error is returned. If the source fails the Reader is put in
+// an error state (see Reader.Err) and all subsequent reads from the source will try to read from the source again
+// (typically returning the same error). Errors returned by transformers (e.g. a malformed escape) and invalid UTF-8
+// do not put the Reader in an error state.
+func (r *Reader) Next() (c Char, err error) {
+	// Pushed back chars are returned before any buffered chars.
+	if len(r.pushed) > 0 {
+		c = r.pushed[len(r.pushed)-1]
+		return
+	}
+	// If no buffered rune read new transformed runes from the source and save in the buffer
+	err = r.fill(1)
+	if err != nil {
+		return
+	}
+	// Read next rune (Char) in buffer.
+	var ok bool
+	c, ok = r.buffer.Next()
+	if !ok {
+		// Should really not happen as we have written a char to the buffer above if empty buffer...
+		err = fmt.Errorf("unexpected empty buffer")
+	}
+	return
+}
+
+// TryNext returns the next Char from the Reader. TryNext works like Reader.Next except that the end of the Reader
+// source is signaled by returning false instead of an io.EOF error. If a Char is returned then true is returned.
+//
+// If there was an error reading a rune from the source the error is returned.
+func (r *Reader) TryNext() (c Char, ok bool, err error) {
+	c, err = r.Next()
+	if errors.Is(err, io.EOF) {
+		err = nil
+		return
+	}
+	ok = err == nil
+	return
+}
+
+// AtEOF returns true if there are no more Chars to be read from the Reader. If needed a rune is read from the
+// Reader source (but not consumed) to determine if the end of the source has been reached. If there was an error
+// reading a rune from the source (or an error returned by a transformer) false is returned. The error will then be
+// returned by the next call to Reader.Next (or Reader.Peek or Reader.Window).
+func (r *Reader) AtEOF() bool {
+	err := r.fill(1)
+	if err != nil && !errors.Is(err, io.EOF) {
+		r.pending = err
+	}
+	return errors.Is(err, io.EOF)
+}
+
+// Peek returns the n-th unconsumed Char from the Reader without consuming any Char. Peek(0) returns the same
+// Char as Reader.Next, Peek(1) returns the Char after that and so on. If there are less than n+1 unconsumed
+// runes left in the Reader source an io.EOF error is returned. A negative n will return an error.
+//
+// If there was an error reading a rune from the source the error is returned.
+func (r *Reader) Peek(n int) (c Char, err error) {
+	if n < 0 {
+		err = errorOf(ErrInvalidArgument, fmt.Errorf("illegal negative peek offset %d", n))
+		return
+	}
+	err = r.fill(n + 1)
+	if err != nil {
+		return
+	}
+	c = r.peek(n)
+	return
+}
+
+// Window returns up to k unconsumed Chars from the Reader without consuming any Char. The first Char in the
+// returned slice is the same Char as returned by Reader.Next. If there are less than k unconsumed runes left in
+// the Reader source then the remaining Chars are returned. If there are no more runes to be read from the source
+// an io.EOF error is returned. A negative k will return an error.
+//
+// If there was an error reading a rune from the source the error is returned.
+func (r *Reader) Window(k int) (cs []Char, err error) {
+	if k < 0 {
+		err = errorOf(ErrInvalidArgument, fmt.Errorf("illegal negative window size %d", k))
+		return
+	}
+	err = r.fill(k)
+	if errors.Is(err, io.EOF) && r.buffered() > 0 {
+		err = nil
+	}
+	if err != nil {
+		return
+	}
+	n := min(k, r.buffered())
+	cs = make([]Char, n)
+	for i := range cs {
+		cs[i] = r.peek(i)
+	}
+	return
+}
+
+// Pos returns the position of the "next char". That is, the char returned by method Next(). The position is derived
+// from the unconsumed Chars in the Reader and is therefore exact also after a call to Reader.Rollback or
+// Reader.PushBack. If there are no unconsumed Chars in the Reader the position of the next rune to read from the
+// source is returned.
+func (r *Reader) Pos() Position {
+	if len(r.pushed) > 0 {
+		return r.pushed[len(r.pushed)-1].Pos
+	}
+	if c, ok := r.buffer.Next(); ok {
+		return c.Pos
+	}
+	return r.pos
+}
+
+// Line returns the source text of the provided row (without the terminating newline). The text is the text read
+// from the source, before any transformers are applied. The text of the current row is the text read so far. Only
+// the most recently read lines are available and lines must be cached (see Builder.WithLineCache). If the text of the
+// row is not available an error is returned.
+func (r *Reader) Line(row int) (string, error) {
+	if r.lineCacheSize > 0 {
+		if row == r.lineRow && len(r.line) > 0 {
+			return r.lineText(), nil
+		}
+		for _, line := range r.lineCache {
+			if line.row == row {
+				return line.text, nil
+			}
+		}
+	}
+	return "", errorOf(ErrNotAvailable, fmt.Errorf("line %d is not available", row))
+}
+
+// SourceRange returns the byte range (from start up to, but not including, end) of the source text that produced the
+// Char at the provided position (see Builder.WithSourceMap). Only the row and column of the position are used. If the
+// position is not the position of a read Char, or if the Reader doesn't record a source map, an error is returned.
+func (r *Reader) SourceRange(pos Position) (start, end int, err error) {
+	i, ok := slices.BinarySearchFunc(r.sourceMap, pos, func(sr sourceRange, pos Position) int {
+		return sr.pos.Compare(pos)
+	})
+	if !ok {
+		return 0, 0, errorOf(ErrNotAvailable, fmt.Errorf("no source range for position %d/%d", pos.Row, pos.Col))
+	}
+	return r.sourceMap[i].start, r.sourceMap[i].end, nil
+}
+
+// FormatDiagnostic renders the provided diagnostic together with the cached source line of the start of the span
+// (see Reader.Line and FormatDiagnostic). If the source line is not available only the position and message are
+// rendered.
+func (r *Reader) FormatDiagnostic(d Diagnostic) string {
+	line, _ := r.Line(d.Pos.Row)
+	return FormatDiagnostic(d, line)
+}
+
+// Seek moves the Reader to the provided position in the source. The next Char returned by Reader.Next is the first
+// Char at or after the provided position. Seek is only supported if the source implements io.Seeker (see
+// Builder.WithSource) and is not wrapped by a decoding reader (e.g. Builder.WithEncoding). The Reader keeps an index
+// of the byte offsets of the rows read so far. Seeking to an indexed row is done directly in the source while
+// seeking beyond the indexed rows reads (and discards) the source from the last indexed row. Seeking resets the
+// lookahead of the Reader (pushed back and buffered Chars) and invalidates all States and marks created before the
+// seek. Note that the internal state of stateful transformers is not reset. If the Reader doesn't support seeking,
+// the provided position is before the start of the source or beyond the end of the source, an error is returned. If
+// the provided position is beyond the end of the source the Reader is moved back to the position of the next Char
+// before the seek (the lookahead, States and marks are still reset).
+func (r *Reader) Seek(pos Position) error {
+	if r.seeker == nil {
+		return errorOf(ErrInvalidSeek, errors.New("source doesn't support seeking"))
+	}
+	if len(r.includes) > 0 {
+		return errorOf(ErrInvalidSeek, errors.New("seeking is not supported when reading an included source"))
+	}
+	if pos.Row < r.lines[0].pos.Row || pos.Col < r.origin().Col {
+		return errorOf(ErrInvalidSeek, fmt.Errorf("illegal seek position %d/%d", pos.Row, pos.Col))
+	}
+	prev := r.Pos()
+	err := r.seek(pos)
+	if errors.Is(err, io.EOF) {
+		// Move back to the position before the seek. If the Reader was at the end of the source it still is.
+		if err := r.seek(prev); err != nil && !errors.Is(err, io.EOF) {
+			return err
+		}
+		return errorOf(ErrInvalidSeek, fmt.Errorf("seek position %d/%d is beyond the end of the source", pos.Row,
+			pos.Col))
+	}
+	return err
+}
+
+// seek moves the Reader to the provided (valid) position in the source. If the position is beyond the end of the
+// source io.EOF is returned.
+func (r *Reader) seek(pos Position) error {
+	// Seek to the start of the closest indexed row
+	row := min(pos.Row-r.lines[0].pos.Row, len(r.lines)-1)
+	line := r.lines[row]
+	if _, err := r.seeker.Seek(line.offset, io.SeekStart); err != nil {
+		return r.fileError(errorOf(ErrInvalidSeek, fmt.Errorf("error seeking source: %w", err)))
+	}
+	if src, ok := r.seeker.(source); ok {
+		r.reader = src
+	} else {
+		r.reader = bufio.NewReader(r.seeker)
+	}
+	// Reset the lookahead and read state
+	r.pushed = nil
+	for r.buffer.Buffered() > 0 {
+		r.buffer.Consume()
+		r.offset++
+	}
+	r.states, r.liveReads, r.oldestReads, r.marks = nil, nil, nil, nil
+	r.Commit()
+	r.pos, r.srcOffset, r.cr, r.crEnd = line.pos, line.offset, line.cr, line.crEnd
+	r.grapheme = graphemeState{}
+	r.raw, r.eof, r.err, r.pending = nil, false, nil, nil
+	r.prev, r.hasPrev, r.unconsume = Char{}, false, State{}
+	r.lexing, r.lexeme = false, nil
+	// Skip Chars before the provided position
+	for {
+		c, err := r.Next()
+		if err != nil {
+			return err
+		}
+		if c.Pos.Row > pos.Row || c.Pos.Row == pos.Row && c.Pos.Col >= pos.Col {
+			return nil
+		}
+		r.buffer.Consume()
+		r.offset++
+	}
+}
+
+// Consume will consume the next rune (returned by Reader.Next) from the Reader. The next rune (returned by
+// Reader.Next) will be the rune after the previous next rune.
+func (r *Reader) Consume() {
+	if r.buffered() == 0 {
+		return
+	}
+	r.unconsume = r.state()
+	prev, hasPrev := r.prev, r.hasPrev
+	r.prev = r.peek(0)
+	r.hasPrev = true
+	r.consumed++
+	r.teeChar(r.prev, hasPrev && sameSource(prev, r.prev))
+	if r.lexing {
+		if len(r.lexeme) == 0 {
+			r.lexStart = r.prev.Pos
+		}
+		r.lexeme = append(r.lexeme, r.prev.Rune)
+	}
+	if len(r.pushed) > 0 {
+		r.pushed = r.pushed[:len(r.pushed)-1]
+		return
+	}
+	r.buffer.Consume()
+	r.offset++
+}
+
+// PushBack pushes a Char back to the Reader. The pushed back Char will be returned by the next call to
+// Reader.Next. Chars pushed back are returned in the reverse order they were pushed back (that is, the last
+// pushed back Char is returned first). The pushed back Char may be any Char and need not be a Char previously
+// read from the Reader. It may therefore be used to inject synthetic Chars into the Reader.
+//
+// Note that a rollback to a state created before the call to PushBack will remove the pushed back Char.
+func (r *Reader) PushBack(c Char) {
+	r.pushed = append(r.pushed, c)
+	r.unconsume = State{}
+}
+
+// PushBackRunes pushes back a sequence of runes to the Reader. The runes are pushed back so that they are returned
+// in the provided order by subsequent calls to Reader.Next (before any previously pushed back Chars). All the
+// pushed back runes get the provided position. See Reader.PushBack for more information.
+func (r *Reader) PushBackRunes(pos Position, runes ...rune) {
+	for i := len(runes) - 1; i >= 0; i-- {
+		r.PushBack(Char{Rune: runes[i], Pos: pos})
+	}
+}
+
+// Skip reads and consumes the next n Chars from the Reader. If the Reader source runs out of runes before n Chars
+// have been consumed an io.EOF error is returned. In that case all remaining Chars have been consumed.
+//
+// If there was an error reading a rune from the source the error is returned.
+func (r *Reader) Skip(n int) error {
+	for i := 0; i < n; i++ {
+		_, err := r.Next()
+		if err != nil {
+			return err
+		}
+		r.Consume()
+	}
+	return nil
+}
+
+// ReadWhile reads and consumes consecutive Chars from the Reader as long as the provided predicate returns true
+// for the rune of the next Char. The consumed Chars are returned. Reaching the end of the Reader source is not
+// considered an error. In that case the Chars consumed before the end of the source are returned.
+//
+// If there was an error reading a rune from the source the error is returned together with the Chars consumed
+// before the error.
+func (r *Reader) ReadWhile(pred func(rune) bool) (cs []Char, err error) {
+	for {
+		var c Char
+		c, err = r.Next()
+		if errors.Is(err, io.EOF) {
+			err = nil
+			return
+		}
+		if err != nil || !pred(c.Rune) {
+			return
+		}
+		r.Consume()
+		cs = append(cs, c)
+	}
+}
+
+// ReadUntil reads and consumes Chars from the Reader up to (but not including) the first Char with a rune that
+// is one of the provided delimiters. The consumed Chars are returned. The delimiter will be the next Char
+// returned by Reader.Next. If the end of the Reader source is reached before a delimiter is found the Chars
+// consumed before the end of the source are returned together with an io.EOF error.
+//
+// If there was an error reading a rune from the source the error is returned together with the Chars consumed
+// before the error.
+func (r *Reader) ReadUntil(delims ...rune) (cs []Char, err error) {
+	cs, err = r.ReadWhile(func(ru rune) bool {
+		return !slices.Contains(delims, ru)
+	})
+	if err != nil {
+		return
+	}
+	// ReadWhile stops at a delimiter or at EOF. Check if we stopped at EOF.
+	_, err = r.Next()
+	return
+}
+
+// SkipWhitespace consumes consecutive white space Chars (as defined by unicode.IsSpace) from the Reader. Reaching
+// the end of the Reader source is not considered an error.
+//
+// If there was an error reading a rune from the source the error is returned.
+func (r *Reader) SkipWhitespace() error {
+	return r.skipWhile(unicode.IsSpace)
+}
+
+// SkipInlineWhitespace consumes consecutive white space Chars (as defined by unicode.IsSpace) from the Reader
+// except newline (\u000A) and carriage return (\u000D). Reaching the end of the Reader source is not considered
+// an error.
+//
+// If there was an error reading a rune from the source the error is returned.
+func (r *Reader) SkipInlineWhitespace() error {
+	return r.skipWhile(func(ru rune) bool {
+		return ru != '\u000A' && ru != '\u000D' && unicode.IsSpace(ru)
+	})
+}
+
+// Expect consumes the next Char from the Reader if the Char contains the expected rune. The consumed Char is
+// returned. If the next Char doesn't contain the expected rune then nothing is consumed and a positional error
+// (at the position of the next Char) is returned. If there are no more runes to be read from the Reader source a
+// positional error (at the end of the source) is returned.
+//
+// If there was an error reading a rune from the source the error is returned.
+func (r *Reader) Expect(ru rune) (c Char, err error) {
+	c, err = r.Next()
+	if errors.Is(err, io.EOF) {
+		err = r.fileError(NewPositionalError(r.pos, errorOf(ErrUnexpectedRune, fmt.Errorf("expected %q, got EOF", ru))))
+		return
+	}
+	if err != nil {
+		return
+	}
+	if c.Rune != ru {
+		err = r.fileError(NewPositionalError(c.Pos,
+			errorOf(ErrUnexpectedRune, fmt.Errorf("expected %q, got %q", ru, c.Rune))))
+		return
+	}
+	r.Consume()
+	return
+}
+
+// Accept consumes the next Char from the Reader if the Char contains the provided rune. If the Char was consumed
+// then true is returned. Otherwise, false is returned. If there was an error reading the next Char (including
+// io.EOF) then false is returned.
+func (r *Reader) Accept(ru rune) bool {
+	_, err := r.Expect(ru)
+	return err == nil
+}
+
+// Match consumes the runes of the provided literal string from the Reader if the next Chars of the Reader match
+// the literal. If the literal matched then true is returned. Otherwise, false is returned and nothing is
+// consumed. Reaching the end of the Reader source before the whole literal has been matched is a mismatch.
+//
+// If there was an error reading a rune from the source the error is returned. In that case nothing is consumed.
+func (r *Reader) Match(s string) (bool, error) {
+	runes := []rune(s)
+	cs, err := r.Window(len(runes))
+	if errors.Is(err, io.EOF) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if len(cs) < len(runes) {
+		return false, nil
+	}
+	for i, c := range cs {
+		if c.Rune != runes[i] {
+			return false, nil
+		}
+	}
+	return true, r.Skip(len(runes))
+}
+
+// MatchRegexp consumes the Chars matching the provided regular expression anchored at the current read position.
+// The consumed Chars are returned. The start and end positions of the match are therefore the positions of the
+// first and last returned Char. If the regular expression doesn't match at the current read position then nothing
+// is consumed and a nil slice is returned. If the regular expression matches the empty string an empty (non-nil)
+// slice is returned. The regular expression anchored at the read position is compiled once and cached by the Reader.
+// The anchored regular expression prefers leftmost-first matches also if the provided regular expression prefers
+// leftmost-longest matches (see Reader.MatchRegexpLongest).
+//
+// Note that the regular expression is matched against the unconsumed Chars of the Reader. The runes needed to decide
+// the match (up to the rest of the source, e.g. for a regular expression ending with ".*") are therefore read from
+// the source into the internal buffer of the Reader.
+//
+// If there was an error reading a rune from the source the error is returned. In that case nothing is consumed.
+func (r *Reader) MatchRegexp(re *regexp.Regexp) (cs []Char, err error) {
+	return r.matchRegexp(re, false)
+}
+
+// MatchRegexpLongest works like Reader.MatchRegexp except that the leftmost-longest match is consumed (see
+// regexp.Regexp.Longest).
+func (r *Reader) MatchRegexpLongest(re *regexp.Regexp) (cs []Char, err error) {
+	return r.matchRegexp(re, true)
+}
+
+func (r *Reader) matchRegexp(re *regexp.Regexp, longest bool) (cs []Char, err error) {
+	anchored, err := r.anchoredRegexp(re, longest)
+	if err != nil {
+		return
+	}
+	rr := &peekRuneReader{rd: r}
+	loc := anchored.FindReaderIndex(rr)
+	if rr.err != nil {
+		err = rr.err
+		return
+	}
+	if loc == nil {
+		return
+	}
+	// The match location is in bytes (as if the runes were UTF-8 encoded). Consume Chars until end of match.
+	cs = []Char{}
+	for size := 0; size < loc[1]; {
+		c := r.peek(0)
+		size += len(string(c.Rune))
+		r.Consume()
+		cs = append(cs, c)
+	}
+	return
+}
+
+// regexpCacheSize is the maximum number of anchored regular expressions cached by a Reader (see anchoredRegexp).
+const regexpCacheSize = 64
+
+// anchoredKey is the key of an anchored regular expression cached by a Reader (see anchoredRegexp).
+type anchoredKey struct {
+	re      *regexp.Regexp
+	longest bool
+}
+
+// anchoredRegexp returns the provided regular expression anchored at the start of the text. If longest is true the
+// anchored regular expression prefers leftmost-longest matches. The anchored regular expressions are compiled by
+// (and only used by) the Reader and are cached by the Reader.
+func (r *Reader) anchoredRegexp(re *regexp.Regexp, longest bool) (*regexp.Regexp, error) {
+	key := anchoredKey{re: re, longest: longest}
+	if anchored, ok := r.regexps[key]; ok {
+		return anchored, nil
+	}
+	anchored, err := regexp.Compile(`\A(?:` + re.String() + `)`)
+	if err != nil {
+		return nil, err
+	}
+	if longest {
+		anchored.Longest()
+	}
+	if r.regexps == nil || len(r.regexps) == regexpCacheSize {
+		r.regexps = make(map[anchoredKey]*regexp.Regexp)
+	}
+	r.regexps[key] = anchored
+	return anchored, nil
+}
+
+// All returns an iterator over the Chars of the Reader. The iterator consumes each Char before it is yielded.
+// The iteration stops when there are no more runes to be read from the Reader source (io.EOF is not yielded).
+//
+// If there was an error reading a rune from the source the error is yielded and the iteration stops.
+func (r *Reader) All() iter.Seq2[Char, error] {
+	return func(yield func(Char, error) bool) {
+		for {
+			c, err := r.Next()
+			if errors.Is(err, io.EOF) {
+				return
+			}
+			if err != nil {
+				yield(c, err)
+				return
+			}
+			r.Consume()
+			if !yield(c, nil) {
+				return
+			}
+		}
+	}
+}
+
+// Lines returns an iterator over the lines of the Reader. Each Line is consumed before it is yielded. The row of a
+// Line is the row of the first Char in the line (including the line ending). Note that if the Reader is configured
+// with the newline normalizer (see Builder.WithNormalizeNewline) all line endings will be LF as the normalizer has
+// already transformed other line endings to a newline. The iteration stops when there are no more runes to be read
+// from the Reader source (io.EOF is not yielded).
+//
+// If there was an error reading a rune from the source the error is yielded and the iteration stops.
+func (r *Reader) Lines() iter.Seq2[Line, error] {
+	return func(yield func(Line, error) bool) {
+		for {
+			line, err := r.readLine()
+			if errors.Is(err, io.EOF) {
+				return
+			}
+			if err != nil {
+				yield(line, err)
+				return
+			}
+			if !yield(line, nil) {
+				return
+			}
+		}
+	}
+}
+
+// ConsumeToEndOfLine consumes all Chars up to the next line ending (newline \u000A or carriage return \u000D).
+// If includeLineEnding is true the line ending (LF, CR or CR + LF) is consumed as well. Otherwise, the line ending
+// will be the next Char returned by Reader.Next. Reaching the end of the Reader source is not considered an error.
+//
+// If there was an error reading a rune from the source the error is returned.
+func (r *Reader) ConsumeToEndOfLine(includeLineEnding bool) error {
+	err := r.skipWhile(func(ru rune) bool {
+		return ru != '\u000A' && ru != '\u000D'
+	})
+	if err != nil || !includeLineEnding {
+		return err
+	}
+	if r.Accept('\u000D') {
+		r.Accept('\u000A')
+		return nil
+	}
+	r.Accept('\u000A')
+	return nil
+}
+
+// Unconsume undoes the most recent call to Reader.Consume. After an unconsume the next call to Reader.Next will
+// return the Char that was consumed. Only the most recent consume may be undone. If there is no consume to undo
+// (no Char has been consumed or the most recent consume has already been undone) an error is returned. Note that
+// unconsume after a call to Reader.Commit may return an error if the consumed Char has been removed from the
+// internal buffer.
+func (r *Reader) Unconsume() error {
+	if r.unconsume.zero() {
+		return errorOf(ErrRollbackInvalid, errors.New("no consumed char to unconsume"))
+	}
+	return r.Rollback(r.unconsume)
+}
+
+// StartLexeme starts capturing the runes of consumed Chars as a lexeme. Any lexeme already started is discarded. A
+// rollback (see Reader.Rollback) removes the runes consumed after the State was created from the lexeme. Use
+// Reader.EndLexeme to retrieve the captured lexeme.
+func (r *Reader) StartLexeme() {
+	r.lexing, r.lexeme, r.lexStart = true, r.lexeme[:0], r.Pos()
+}
+
+// EndLexeme stops capturing the lexeme started by Reader.StartLexeme and returns the lexeme. The end of the span of
+// the lexeme is the position of the next Char (see Reader.Pos). If no lexeme has been started an empty lexeme at the
+// position of the next Char is returned.
+func (r *Reader) EndLexeme() Lexeme {
+	end := r.Pos()
+	if !r.lexing {
+		return Lexeme{Span: Span{Start: end, End: end}}
+	}
+	r.lexing = false
+	return Lexeme{Text: string(r.lexeme), Span: Span{Start: r.lexStart, End: end}}
+}
+
+// Prev returns the most recently consumed Char. If no Char has been consumed then false is returned.
+func (r *Reader) Prev() (Char, bool) {
+	return r.prev, r.hasPrev
+}
+
+// State returns the current read state for the Reader. The state may be used in a call to Rollback() to
+// "reset" the Reader to the current state. If the Reader tracks live States (see Builder.WithLiveStates) the
+// returned State is live until it is released using State.Release. As long as the State is live Reader.Commit will
+// not remove runes needed to rollback to the State.
+func (r *Reader) State() State {
+	state := r.state()
+	if !r.liveStates {
+		return state
+	}
+	r.nextStateID++
+	state.reader = r
+	state.id = r.nextStateID
+	if r.states == nil {
+		r.states, r.liveReads = make(map[int]int), make(map[int]int)
+	}
+	read := state.bufState.read
+	r.states[state.id] = read
+	if r.liveReads[read] == 0 {
+		heap.Push(&r.oldestReads, read)
+	}
+	r.liveReads[read]++
+	return state
+}
+
+// oldestLiveRead returns the buffer read index of the oldest live State. If there is no live State false is
+// returned. Indices of released States are removed from the heap when found at the top of the heap.
+func (r *Reader) oldestLiveRead() (int, bool) {
+	for len(r.oldestReads) > 0 {
+		if read := r.oldestReads[0]; r.liveReads[read] > 0 {
+			return read, true
+		}
+		heap.Pop(&r.oldestReads)
+	}
+	return 0, false
+}
+
+// state returns the current read state for the Reader without tracking the state as live.
+func (r *Reader) state() State {
+	return State{
+		bufState: r.buffer.State(),
+		offset:   r.offset,
+		pushed:   slices.Clone(r.pushed),
+		prev:     r.prev,
+		hasPrev:  r.hasPrev,
+		lexeme:   len(r.lexeme),
+		consumed: r.consumed,
+	}
+}
+
+// CaptureSince returns the Chars consumed since the provided State was created together with their runes as a
+// string (e.g. the lexeme of a recognized token). The read state of the Reader is not changed. If the Reader can't be
+// rolled back to the State (see Reader.Rollback) nil and an empty string are returned.
+func (r *Reader) CaptureSince(state State) ([]Char, string) {
+	current, unconsume, lexeme := r.state(), r.unconsume, r.lexeme
+	if err := r.Rollback(state); err != nil {
+		return nil, ""
+	}
+	// Step forward to the current state collecting the consumed Chars
+	var cs []Char
+	for (r.offset < current.offset || len(r.pushed) > len(current.pushed)) && r.buffered() > 0 {
+		cs = append(cs, r.peek(0))
+		if len(r.pushed) > 0 {
+			r.pushed = r.pushed[:len(r.pushed)-1]
+			continue
+		}
+		r.buffer.Consume()
+		r.offset++
+	}
+	// Rollback to the current state will never fail.
+	_ = r.Rollback(current)
+	r.unconsume, r.lexeme = unconsume, lexeme
+	return cs, charsToString(cs)
+}
+
+// Rollback resets the Reader to the provided state. After a rollback the next call to method Read will return
+// the rune that was the "next rune" when the provided State was created. That is, all runes read since the state
+// was created are unread. Note that Rollback() using a released state collected before a call to Commit() is not
+// supported and may return an error if the rollback state is not valid anymore. Rollback to a zero state (not
+// created by the Reader.State method) will return an error.
+func (r *Reader) Rollback(state State) error {
+	err := r.buffer.Rollback(state.bufState)
+	if err != nil {
+		return errorOf(ErrRollbackInvalid, err)
+	}
+	r.offset = state.offset
+	r.pushed = slices.Clone(state.pushed)
+	r.prev = state.prev
+	r.hasPrev = state.hasPrev
+	r.unconsume = State{}
+	r.consumed = state.consumed
+	if state.lexeme < len(r.lexeme) {
+		r.lexeme = r.lexeme[:state.lexeme]
+	}
+	return nil
+}
+
+// Mark saves the current read state of the Reader as a named mark. The Reader may later be reset to the mark using
+// Reader.ResetTo. If a mark with the same name already exists it is replaced. A mark is valid until it is released
+// using Reader.Release. Note that marks are implemented using Reader.State and Reader.Rollback and that the same
+// restrictions regarding Reader.Commit apply.
+func (r *Reader) Mark(name string) {
+	if r.marks == nil {
+		r.marks = make(map[string]State)
+	}
+	if state, ok := r.marks[name]; ok {
+		state.Release()
+	}
+	r.marks[name] = r.State()
+}
+
+// ResetTo resets the Reader to the named mark (see Reader.Rollback). The mark is still valid after the reset. If
+// there is no mark with the provided name (never created or released) an error is returned.
+func (r *Reader) ResetTo(name string) error {
+	state, ok := r.marks[name]
+	if !ok {
+		return errorOf(ErrUnknownMark, fmt.Errorf("unknown mark %q", name))
+	}
+	return r.Rollback(state)
+}
+
+// Release releases the named mark. After the mark has been released the Reader may not be reset to the mark. If
+// there is no mark with the provided name (never created or already released) an error is returned.
+func (r *Reader) Release(name string) error {
+	state, ok := r.marks[name]
+	if !ok {
+		return errorOf(ErrUnknownMark, fmt.Errorf("unknown mark %q", name))
+	}
+	state.Release()
+	delete(r.marks, name)
+	return nil
+}
+
+// SetRaw turns raw mode on or off. In raw mode all transformers are bypassed and runes are returned verbatim from
+// the source (with their positions). Raw mode may be used to read heredocs, raw strings or other blocks where the
+// source must be left untouched. Note that rows are then only tracked according to the newline policy (see
+// Builder.WithNewlinePolicy). Runes already buffered by the Reader (e.g. by Reader.Peek) have already been
+// transformed and are not affected.
+func (r *Reader) SetRaw(raw bool) {
+	r.bypass = raw
+}
+
+// DisableTransformer disables the transformers with the provided name (see Builder.WithName). A disabled
+// transformer is skipped for runes read from the source until it is enabled again using Reader.EnableTransformer.
+// Note that runes already buffered by the Reader (e.g. by Reader.Peek) have already been transformed and are not
+// affected. If there is no transformer with the provided name an error is returned.
+func (r *Reader) DisableTransformer(name string) error {
+	return r.setTransformerDisabled(name, true)
+}
+
+// EnableTransformer enables the transformers with the provided name (see Builder.WithName) previously disabled
+// using Reader.DisableTransformer. Note that runes already buffered by the Reader (e.g. by Reader.Peek) are not
+// affected. If there is no transformer with the provided name an error is returned.
+func (r *Reader) EnableTransformer(name string) error {
+	return r.setTransformerDisabled(name, false)
+}
+
+func (r *Reader) setTransformerDisabled(name string, disabled bool) error {
+	found := false
+	for i := range r.transformers {
+		if r.transformers[i].name == name {
+			r.transformers[i].disabled = disabled
+			found = true
+		}
+	}
+	if !found {
+		return errorOf(ErrUnknownTransformer, fmt.Errorf("unknown transformer %q", name))
+	}
+	return nil
+}
+
+// Commit removes read runes from the internal buffer. It may be used to prevent the Reader from growing indefinitely.
+// Runes needed to rollback to a live State (see Builder.WithLiveStates) or to unconsume the last consumed Char (see
+// Reader.Unconsume) are not removed. States not tracked as live are invalidated by a commit. The space of the removed
+// runes is reused when reading more runes. A Reader that is committed regularly (e.g. after each token) will
+// therefore not allocate when reading runes from the source (if no transformers are used). If the source is another
+// Reader (see Builder.WithReader) the source Reader is committed as well.
+func (r *Reader) Commit() {
+	// Find the oldest state still needed
+	oldest := r.buffer.State()
+	if !r.unconsume.zero() && r.unconsume.bufState.read < oldest.read {
+		oldest = r.unconsume.bufState
+	}
+	if read, ok := r.oldestLiveRead(); ok && read < oldest.read {
+		oldest.read = read
+	}
+	r.buffer.Commit(oldest)
+	if r.upstream != nil {
+		// The Chars read from the source Reader have been consumed and transformed into the buffered Chars. Only
+		// the last consumed Char (that may be unread by a transformer) is needed by the Reader.
+		r.upstream.Commit()
+	}
+}
+
+// readLine reads and consumes the next line from the Reader. If there are no more runes to be read io.EOF is
+// returned.
+func (r *Reader) readLine() (line Line, err error) {
+	line.Chars, err = r.ReadUntil('\u000A', '\u000D')
+	if err != nil && !(errors.Is(err, io.EOF) && len(line.Chars) > 0) {
+		return
+	}
+	err = nil
+	line.Text = charsToString(line.Chars)
+	if len(line.Chars) > 0 {
+		line.Row = line.Chars[0].Pos.Row
+	}
+	// Read line ending (if any)
+	c, nErr := r.Next()
+	if nErr != nil {
+		// Last line without line ending. Any error is returned on the next read.
+		return
+	}
+	if len(line.Chars) == 0 {
+		line.Row = c.Pos.Row
+	}
+	r.Consume()
+	if c.Rune == '\u000A' {
+		line.Ending = LF
+		return
+	}
+	line.Ending = CR
+	if r.Accept('\u000A') {
+		line.Ending = CRLF
+	}
+	return
+}
+
+// charsToString returns a string containing the runes of the provided Chars.
+func charsToString(cs []Char) string {
+	var sb strings.Builder
+	for _, c := range cs {
+		sb.WriteRune(c.Rune)
+	}
+	return sb.String()
+}
+
+// skipWhile consumes consecutive Chars as long as the provided predicate returns true for the rune of the next
+// Char. Like ReadWhile but without collecting the consumed Chars.
+func (r *Reader) skipWhile(pred func(rune) bool) error {
+	for {
+		c, err := r.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if !pred(c.Rune) {
+			return nil
+		}
+		r.Consume()
+	}
+}
+
+// Err returns the error putting the Reader in an error state. The Reader is in an error state if the last read from
+// the source failed (e.g. an I/O error or a read timeout). Reaching the end of the source (io.EOF), invalid UTF-8 and
+// errors returned by transformers do not put the Reader in an error state. If the Reader is not in an error state nil
+// is returned. The Reader leaves the error state when a later read from the source succeeds (e.g. after a retried
+// read timeout or a Reader.Seek). The returned error wraps ErrErrorState.
+func (r *Reader) Err() error {
+	return r.err
+}
+
+// Errors returns the errors collected by the Reader (see Builder.WithErrorLimit) in the order they occurred. If no
+// errors have been collected nil is returned.
+func (r *Reader) Errors() []error {
+	return slices.Clone(r.errors)
+}
+
+// Progress returns the number of bytes read from the source and the total number of bytes in the source. The total
+// is only known for a seekable source (e.g. a file or a source set using Builder.WithString) not decoded from another
+// encoding (see Builder.WithEncoding). If the total is unknown -1 is returned as total. Bytes read from included
+// sources are not counted.
+func (r *Reader) Progress() (read, total int64) {
+	return r.srcOffset - r.srcStart, r.size
+}
+
+// Stats holds counters of a Reader (see Reader.Stats).
+type Stats struct {
+	RunesRead     int // Number of runes read from the source (including runes read from included sources)
+	RunesConsumed int // Number of consumed Chars (Chars unread by a rollback are not counted)
+	BytesRead     int // Number of UTF-8 encoded bytes read from the source (including skipped invalid bytes)
+	Rows          int // Number of rows read from the source (according to the newline policy)
+	Escapes       int // Number of read Chars decoded from escape sequences (see Char.Escaped)
+	Buffered      int // Number of currently unconsumed Chars in the Reader (read from the source but not consumed)
+}
+
+// Stats returns the current counters of the Reader, e.g. for monitoring. Runes read again by the Reader (e.g. after a
+// Reader.Seek) are counted again.
+func (r *Reader) Stats() Stats {
+	rows := r.counts.rows
+	if r.counts.runes > 0 {
+		// The current row
+		rows++
+	}
+	return Stats{
+		RunesRead:     r.counts.runes,
+		RunesConsumed: r.consumed,
+		BytesRead:     r.counts.bytes,
+		Rows:          rows,
+		Escapes:       r.escapes,
+		Buffered:      r.buffered(),
+	}
+}
+
+// TeeError returns the first error writing consumed runes to the tee writer (see Builder.WithTee). If there has been
+// no error nil is returned.
+func (r *Reader) TeeError() error {
+	return r.teeErr
+}
+
+// teeChar writes the provided (consumed) Char to the tee writer (if any). The flag same is true if the Char is
+// produced from the same source text as the previously consumed Char (see sameSource). The source text is then
+// already written if the source text of consumed Chars are written.
+func (r *Reader) teeChar(c Char, same bool) {
+	if r.tee == nil || r.teeErr != nil {
+		return
+	}
+	if r.teeRaw {
+		if !same {
+			_, r.teeErr = io.WriteString(r.tee, c.Raw)
+		}
+		return
+	}
+	_, r.teeErr = io.WriteString(r.tee, string(c.Rune))
+}
+
+// sameSource returns true if the provided Chars are produced from the same source text (e.g. the Chars of an expanded
+// escape sequence).
+func sameSource(c1, c2 Char) bool {
+	return c1.Pos == c2.Pos && c1.Raw == c2.Raw
+}
+
+// buffered returns the number of unconsumed Chars in the Reader (including pushed back Chars).
+func (r *Reader) buffered() int {
+	return len(r.pushed) + r.buffer.Buffered()
+}
+
+// fileError wraps the provided error in a FileError if the source is a named file. An io.EOF is never wrapped.
+func (r *Reader) fileError(err error) error {
+	if r.file == "" || errors.Is(err, io.EOF) {
+		return err
+	}
+	return &FileError{File: r.file, Err: err}
+}
+
+// fill reads transformed runes from the source into the internal buffer until there are at least n unconsumed
+// Chars in the Reader. If there was an error reading from the source the error is returned.
+func (r *Reader) fill(n int) error {
+	if r.pending != nil && r.buffered() < n {
+		// Return the error from a previous fill (see AtEOF)
+		err := r.pending
+		r.pending = nil
+		return err
+	}
+	for r.buffered() < n {
+		if r.readTimeout > 0 {
+			r.attempt, r.timedOut = r.attempt[:0], false
+			r.attemptStart = unreadState{pos: r.pos, cr: r.cr, crEnd: r.crEnd, offset: r.srcOffset, counts: r.counts}
+		}
+		err := r.bufferChar()
+		if err == nil && r.batched() {
+			r.bufferBatch()
+		}
+		if err != nil && r.timedOut {
+			err = r.retryable(err)
+		}
+		if err != nil {
+			// Record the end of the source text causing the error (if unknown)
+			var pe *PositionalError
+			if errors.As(err, &pe) && pe.End == (Position{}) {
+				pe.End = r.pos
+			}
+			err = r.fileError(err)
+			if r.err != nil {
+				r.err = err
+			} else if !errors.Is(err, io.EOF) && len(r.errors) < r.errorLimit {
+				// Collect the error and continue reading
+				r.errors = append(r.errors, err)
+				continue
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// runeBatchSize is the maximum number of Chars buffered by a Reader in one batch (see Reader.bufferBatch).
+const runeBatchSize = 64
+
+// batched returns true if the Reader reads runes from the source in batches. Runes are only read in batches if plain
+// ASCII runes may pass the transformers untransformed (see passThrough) and if reading a rune reads exactly one rune
+// from the source and never fails (e.g. by a timeout, or by an invalid UTF-8 encoded byte not replaced by the
+// replacement character).
+func (r *Reader) batched() bool {
+	return r.transparent && r.upstream == nil && r.readTimeout == 0 && r.invalidUTF8 == InvalidUTF8Replace
+}
+
+// bufferBatch buffers the runes available in the source, up to a batch of Chars in the buffer. Only runes already read
+// into memory by the source (e.g. the buffer of a bufio.Reader) are buffered. That is, reading a batch never blocks
+// on reading from the underlying source. The batch ends at the first rune not passing the transformers untransformed
+// as a transformer may read more runes than available in memory.
+func (r *Reader) bufferBatch() {
+	// At least one rune is available for each utf8.UTFMax bytes available
+	for n := r.batchSize(); n > 0; n = r.batchSize() {
+		for ; n > 0; n-- {
+			if !r.bufferPlain() {
+				return
+			}
+		}
+	}
+}
+
+// bufferPlain buffers the next rune from the source if it passes all transformers untransformed, whether enabled or
+// not (see Reader.SetRaw and Reader.DisableTransformer). Otherwise the rune is unread and false is returned. That is,
+// the Chars buffered ahead in a batch are not affected by changing the transformers in use.
+func (r *Reader) bufferPlain() bool {
+	r.raw = r.raw[:0]
+	ru, pos, err := r.readRune()
+	if err != nil {
+		// Not expected as the bytes of the rune are available in memory
+		return false
+	}
+	if !r.plain(ru) {
+		// Leave the rune to be transformed by the next call to bufferChar
+		_ = r.unreadRune()
+		return false
+	}
+	r.writeChar(Char{Rune: ru, Pos: pos}, r.rawString())
+	return true
+}
+
+// passThrough returns true if the provided rune read from the source passes the enabled transformers of the Reader
+// untransformed (see namedTransformer.passes).
+func (r *Reader) passThrough(ru rune) bool {
+	if r.bypass {
+		return true
+	}
+	for i := range r.transformers {
+		if t := &r.transformers[i]; !t.disabled && !t.passes(ru) {
+			return false
+		}
+	}
+	return true
+}
+
+// plain returns true if the provided rune read from the source passes all transformers of the Reader untransformed
+// (see namedTransformer.passes).
+func (r *Reader) plain(ru rune) bool {
+	for i := range r.transformers {
+		if !r.transformers[i].passes(ru) {
+			return false
+		}
+	}
+	return true
+}
+
+// batchSize returns the number of runes that may be buffered without blocking to fill up the current batch.
+func (r *Reader) batchSize() int {
+	return min(runeBatchSize-r.buffer.Buffered(), available(r.reader)/utf8.UTFMax)
+}
+
+// available returns the number of bytes available in memory in the provided source. Reading that number of bytes
+// from the source never blocks or fails.
+func available(src source) int {
+	switch src := src.(type) {
+	case interface{ Buffered() int }:
+		return src.Buffered()
+	case interface{ Len() int }:
+		return src.Len()
+	}
+	return 0
+}
+
+// peek returns the n-th unconsumed Char in the Reader. The caller must make sure that there are more than n
+// unconsumed Chars in the Reader (see fill).
+func (r *Reader) peek(n int) Char {
+	// Pushed back chars precede the buffered chars.
+	if n < len(r.pushed) {
+		return r.pushed[len(r.pushed)-1-n]
+	}
+	n -= len(r.pushed)
+	c, _ := r.buffer.Peek(n)
+	return c
+}
+
+func (r *Reader) bufferChar() error {
+	// Read next rune from source
+	r.raw = r.raw[:0]
+	ru, pos, err := r.readRune()
+	r.err = nil
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			// We want an unwrapped io.EOF
+			return err
+		}
+		err = fmt.Errorf("error reading rune from source: %w", err)
+		if errors.Is(err, ErrInvalidUTF8) {
+			return NewPositionalError(pos, err)
+		}
+		r.err = NewPositionalError(pos, errorOf(ErrErrorState, err))
+		return r.err
+	}
+	if r.passThrough(ru) {
+		// Fast path buffering the read rune directly
+		r.writeChar(Char{Rune: ru, Pos: pos}, r.rawString())
+		return nil
+	}
+	// Apply transformers to read rune (wrapped in a Char). As a transformer may transform a Char into multiple
+	// Chars each transformer is applied to all Chars resulting from the previous transformer.
+	cs := append(r.transformed[0][:0], Char{
+		Rune: ru,
+		Pos:  pos,
+	})
+	next := r.transformed[1][:0]
+	src := readerSource{rd: r}
+	var recovered error
+	for i := range r.transformers {
+		t := &r.transformers[i]
+		if t.disabled || r.bypass {
+			continue
+		}
+		next = next[:0]
+		for _, c := range cs {
+			if t.region && !t.inRegion(c) {
+				next = append(next, c)
+				continue
+			}
+			n, mark := len(next), len(r.raw)
+			r.eof = false
+			next, err = t.apply(src, c, next)
+			if err != nil {
+				switch {
+				case r.lenientEOF && r.eof:
+					// The transformer failed at EOF (e.g. an incomplete escape sequence).
+				case r.recovery == RecoverRaw:
+					// Return the (first) error after buffering the recovered Chars
+					if recovered == nil {
+						recovered = err
+					}
+				default:
+					return err
+				}
+				// Pass the Char and the runes read by the transformer through untransformed.
+				next = append(append(next[:n], c), r.raw[mark:]...)
+			}
+		}
+		cs, next = next, cs
+	}
+	r.transformed[0], r.transformed[1] = cs, next
+	// Buffer transformed runes (Chars) together with the source text read by the transformers (if recorded)
+	raw := r.rawString()
+	for _, c := range cs {
+		r.writeChar(c, raw)
+	}
+	return recovered
+}
+
+// rawString returns the source text read for the Char(s) currently being transformed. If the source text of each Char
+// isn't recorded (see Builder.WithRawText) an empty string is returned.
+func (r *Reader) rawString() string {
+	if !r.rawText {
+		return ""
+	}
+	return charsToString(r.raw)
+}
+
+// writeChar writes the provided Char read from the source text raw (if recorded) to the buffer.
+func (r *Reader) writeChar(c Char, raw string) {
+	c.Raw = raw
+	if r.spans {
+		c.End = r.pos
+	}
+	if r.sourceMap != nil {
+		r.mapSource(c)
+	}
+	if c.Escaped {
+		r.escapes++
+	}
+	r.buffer.Write(c)
+}
+
+// mapSource adds the byte range of the source text of the provided Char to the source map. As the source is read in
+// order the source map is sorted by position. A Char positioned before the last mapped Char (e.g. a Char read again
+// after Reader.Seek or a Char read from an included source) is not mapped.
+func (r *Reader) mapSource(c Char) {
+	if len(r.includes) > 0 || c.Pos.File != r.file {
+		return
+	}
+	if n := len(r.sourceMap); n > 0 && !c.Pos.After(r.sourceMap[n-1].pos) {
+		return
+	}
+	r.sourceMap = append(r.sourceMap, sourceRange{pos: c.Pos, start: c.Pos.Offset, end: r.pos.Offset})
+}
+
+// recordRaw returns true if the source runes read for the Char(s) currently being transformed are recorded.
+func (r *Reader) recordRaw() bool {
+	return r.rawText || r.lenientEOF || r.recovery == RecoverRaw
+}
+
+func (r *Reader) readRune() (ru rune, pos Position, err error) {
+	// Read the next rune from source and step "next position". Note that we as default treat newline
+	// as an ordinary rune and will not bump the row. If such behaviour is wanted the NormalizeNewline
+	// transformer should be used.
+	if r.upstream != nil && len(r.includes) == 0 {
+		return r.readUpstream()
+	}
+	var size int
+	warn := r.warn != nil && !r.reread
+	r.reread = false
+	for {
+		ru, size, err = r.sourceRune()
+		if errors.Is(err, io.EOF) && len(r.includes) > 0 {
+			// End of an included source. Continue reading the including source.
+			r.popInclude()
+			continue
+		}
+		if err != nil {
+			r.eof = errors.Is(err, io.EOF)
+			if r.eof && r.progress != nil && r.srcOffset-r.srcStart > r.progressLast {
+				r.reportProgress()
+			}
+			pos = r.pos
+			return
+		}
+		// An invalid UTF-8 encoded byte is returned as the replacement character with size 1.
+		if ru != utf8.RuneError || size != 1 || r.invalidUTF8 == InvalidUTF8Replace {
+			break
+		}
+		if r.invalidUTF8 == InvalidUTF8Error {
+			pos = r.step(1)
+			err = r.invalidByteError()
+			return
+		}
+		// Skip invalid byte
+		if warn && !r.fromRetry {
+			r.warn(r.pos, errorOf(ErrInvalidUTF8, errors.New("invalid UTF-8 encoded byte skipped")))
+		}
+		r.advanceOffset(size)
+		r.advanceIndex(size)
+		r.counts.bytes += size
+	}
+	width := r.columnWidth(ru, size)
+	r.unread = unreadState{pos: r.pos, cr: r.cr, crEnd: r.crEnd, offset: r.srcOffset, width: width,
+		grapheme: r.grapheme, counts: r.counts}
+	r.counts.runes++
+	r.counts.bytes += size
+	r.advanceOffset(size)
+	cr := r.cr
+	pos = r.trackRune(ru, width, size)
+	if r.lineCacheSize > 0 && len(r.includes) == 0 {
+		r.cacheRune(ru, pos.Row)
+	}
+	if r.columnUnit == ColumnGraphemes {
+		r.grapheme = r.grapheme.next(ru, width == 0)
+		if width == 0 {
+			// The rune extends the grapheme cluster of the previous rune
+			pos.Col--
+		}
+	}
+	if r.recordRaw() {
+		r.raw = append(r.raw, Char{Rune: ru, Pos: pos})
+	}
+	if warn && !r.fromRetry {
+		r.warnRune(ru, size, pos, cr)
+	}
+	return
+}
+
+// warnRune reports any anomaly of the provided rune read from the source at the provided position to the warning
+// handler (see Builder.WithWarningHandler). The flag cr is true if the previous rune read was a CR.
+func (r *Reader) warnRune(ru rune, size int, pos Position, cr bool) {
+	switch {
+	case ru == '\uFEFF' && (pos.Row != r.origin().Row || pos.Col != r.origin().Col):
+		r.warn(pos, errorOf(ErrUnexpectedBOM, errors.New("byte order mark not at the start of the source")))
+	case ru == utf8.RuneError && size == 1:
+		r.warn(pos, errorOf(ErrInvalidUTF8, errors.New("invalid UTF-8 encoded byte replaced")))
+	case ru == utf8.RuneError:
+		r.warn(pos, errorOf(ErrReplacementCharacter, errors.New("replacement character U+FFFD in the source")))
+	}
+	// A CR is a line ending of its own if not followed by LF
+	var ending string
+	endPos := pos
+	switch {
+	case ru == '\u000A' && cr:
+		ending = "CRLF"
+	case ru == '\u000A':
+		ending = "LF"
+	case cr:
+		ending, endPos = "CR", r.crPos
+	}
+	if ru == '\u000D' {
+		r.crPos = pos
+	}
+	switch {
+	case ending == "":
+	case r.lineEnding == "":
+		r.lineEnding = ending
+	case ending != r.lineEnding:
+		r.warn(endPos, errorOf(ErrMixedLineEndings,
+			fmt.Errorf("%s line ending differs from the first line ending %s", ending, r.lineEnding)))
+	}
+}
+
+// maxIncludeDepth is the maximum number of nested included sources (see Builder.WithInclude).
+const maxIncludeDepth = 64
+
+// includedSource holds the read state of a source including another source (see Builder.WithInclude).
+type includedSource struct {
+	reader source
+	pos    Position
+	cr     bool
+	crEnd  Position
+	file   string
+	closer io.Closer // Closer of the included source (if any)
+}
+
+// pushInclude continues reading from the provided included source. The current source is read again when the
+// included source has been read. If the maximum include depth is exceeded an error is returned.
+func (r *Reader) pushInclude(name string, included io.Reader) error {
+	if len(r.includes) >= maxIncludeDepth {
+		return errorOf(ErrIncludeFailed, fmt.Errorf("maximum include depth %d exceeded", maxIncludeDepth))
+	}
+	closer, _ := included.(io.Closer)
+	r.includes = append(r.includes, includedSource{
+		reader: r.reader,
+		pos:    r.pos,
+		cr:     r.cr,
+		crEnd:  r.crEnd,
+		file:   r.file,
+		closer: closer,
+	})
+	r.reader = bufio.NewReader(included)
+	r.pos = Position{Row: r.origin().Row, Col: r.origin().Col, File: name, Source: r.pos.Source, format: r.pos.format}
+	r.cr = false
+	r.file = name
+	return nil
+}
+
+// popInclude continues reading from the source including the current (read) source.
+func (r *Reader) popInclude() {
+	inc := r.includes[len(r.includes)-1]
+	r.includes = r.includes[:len(r.includes)-1]
+	if inc.closer != nil {
+		_ = inc.closer.Close()
+	}
+	r.reader, r.pos, r.cr, r.crEnd, r.file = inc.reader, inc.pos, inc.cr, inc.crEnd, inc.file
+}
+
+// trackRune steps the "next position" for the provided rune (just read from the source). If the rune is a newline
+// according to the newline policy the row is bumped. The position of the rune is returned.
+func (r *Reader) trackRune(ru rune, width, size int) Position {
+	cr := r.cr
+	r.cr = ru == '\u000D'
+	switch {
+	case r.newlinePolicy == NewlinePolicyAll && ru == '\u000A' && cr:
+		// NL of CR + NL. The row has already been bumped by CR so NL is positioned directly after CR.
+		r.advanceIndex(size)
+		return r.crEnd
+	case r.newlinePolicy == NewlinePolicyAll && ru == '\u000D':
+		pos := r.advance(width, size)
+		r.crEnd = r.pos
+		r.newline()
+		return pos
+	case r.newlinePolicy != NewlinePolicyNone && ru == '\u000A':
+		pos := r.advance(width, size)
+		r.newline()
+		return pos
+	}
+	return r.advance(width, size)
+}
+
+// advance steps the "next position" the provided number of columns and one rune of the provided size (see
+// advanceIndex). The position before the step is returned.
+func (r *Reader) advance(width, size int) Position {
+	pos := r.step(width)
+	r.advanceIndex(size)
+	return pos
+}
+
+// advanceIndex steps the byte offset (if tracked) and the rune index (if tracked) of the "next position" one rune of
+// the provided size.
+func (r *Reader) advanceIndex(size int) {
+	if r.byteOffsets {
+		r.pos.Offset += size
+	}
+	if r.runeIndex {
+		r.pos.Index++
+	}
+}
+
+// columnWidth returns the number of columns of the provided rune (of the provided UTF-8 encoded size) according to
+// the column unit of the Reader.
+func (r *Reader) columnWidth(ru rune, size int) int {
+	switch {
+	case r.tabWidth > 0 && ru == '\u0009':
+		col := r.pos.Col - r.origin().Col
+		return r.tabWidth - col%r.tabWidth
+	case r.columnUnit == ColumnUTF16 && ru >= 0x10000:
+		return 2
+	case r.columnUnit == ColumnBytes:
+		return size
+	case r.columnUnit == ColumnGraphemes && r.grapheme.extends(ru):
+		return 0
+	case r.columnUnit == ColumnDisplayWidth:
+		if kind := width.LookupRune(ru).Kind(); kind == width.EastAsianWide || kind == width.EastAsianFullwidth {
+			return 2
+		}
+	}
+	return 1
+}
+
+// graphemeState holds the state of the grapheme cluster being read (see ColumnGraphemes).
+type graphemeState struct {
+	prev   rune // The previously read rune (zero at the start of the source)
+	riOpen bool // True if the previous rune is a regional indicator starting a flag
+}
+
+// extends returns true if the provided rune extends the grapheme cluster of the previously read rune.
+func (g graphemeState) extends(ru rune) bool {
+	switch {
+	case g.prev == 0 || g.prev == '\u0009' || g.prev == '\u000A' || g.prev == '\u000D':
+		return false
+	case isRegionalIndicator(ru):
+		return g.riOpen
+	case g.prev == '\u200D':
+		// Zero-width joiner sequence (e.g. family emojis)
+		return unicode.IsGraphic(ru)
+	case ru == '\u200D', unicode.In(ru, unicode.Mn, unicode.Me, unicode.Mc):
+		// Zero-width joiner and combining marks (including variation selectors)
+		return true
+	case ru >= 0x1F3FB && ru <= 0x1F3FF, ru >= 0xE0020 && ru <= 0xE007F:
+		// Emoji modifiers (skin tones) and tags (e.g. subdivision flags)
+		return true
+	}
+	return false
+}
+
+// next returns the grapheme state after reading the provided rune. The provided flag is true if the rune extended
+// the grapheme cluster of the previous rune.
+func (g graphemeState) next(ru rune, extended bool) graphemeState {
+	return graphemeState{prev: ru, riOpen: isRegionalIndicator(ru) && !extended}
+}
+
+// isRegionalIndicator returns true if the provided rune is a regional indicator symbol (a pair of them is a flag).
+func isRegionalIndicator(ru rune) bool {
+	return ru >= 0x1F1E6 && ru <= 0x1F1FF
+}
+
+// invalidByteError returns an error describing the invalid UTF-8 encoded byte just read by ReadRune.
+func (r *Reader) invalidByteError() error {
+	err := r.reader.UnreadRune()
+	if err != nil {
+		return errorOf(ErrInvalidUTF8, fmt.Errorf("invalid UTF-8 encoded byte"))
+	}
+	b, err := r.reader.ReadByte()
+	if err != nil {
+		return errorOf(ErrInvalidUTF8, fmt.Errorf("invalid UTF-8 encoded byte"))
+	}
+	return errorOf(ErrInvalidUTF8, fmt.Errorf("invalid UTF-8 encoded byte 0x%02X", b))
+}
+
+func (r *Reader) unreadRune() (err error) {
+	if r.upstream != nil && len(r.includes) == 0 {
+		return r.unreadUpstream()
+	}
+	err = r.unreadSourceRune()
+	r.reread = true
+	if r.recordRaw() && len(r.raw) > 0 {
+		r.raw = r.raw[:len(r.raw)-1]
+	}
+	r.srcOffset, r.grapheme, r.counts = r.unread.offset, r.unread.grapheme, r.unread.counts
+	if r.lineCacheSize > 0 && len(r.includes) == 0 && len(r.line) > 0 {
+		r.line = r.line[:len(r.line)-1]
+	}
+	if r.newlinePolicy == NewlinePolicyNone {
+		r.step(-r.unread.width)
+		r.pos.Offset, r.pos.Index = r.unread.pos.Offset, r.unread.pos.Index
+		return
+	}
+	// Restore the position state (including any bumped row)
+	r.pos, r.cr, r.crEnd = r.unread.pos, r.unread.cr, r.unread.crEnd
+	return
+}
+
+// step moves the column position the specified number of steps. If 'i' is positive then we move forward and
+// if 'i' is negative we move backwards. The previous position (before the move) is returned. Note that we don't
+// manage newline as default. The step function will therefore not move the current row in any way.
+func (r *Reader) step(i int) (pos Position) {
+	pos = r.pos
+	r.pos.Col += i
+	return
+}
+
+// newline moves the current position to the start of the next row.
+func (r *Reader) newline() {
+	r.counts.rows++
+	r.pos.Row += 1
+	r.pos.Col = r.origin().Col
+	// Index the start of a new row in a seekable source
+	if r.seeker != nil && len(r.includes) == 0 && r.pos.Row-r.lines[0].pos.Row == len(r.lines) {
+		r.lines = append(r.lines, lineStart{offset: r.srcOffset, pos: r.pos, cr: r.cr, crEnd: r.crEnd})
+	}
+}
+
+// sourceRune reads the next rune from the source. If read timeouts are used (see WithReadTimeout) the runes read
+// while buffering a Char are recorded to be read again if buffering the Char is retried after a timeout.
+func (r *Reader) sourceRune() (ru rune, size int, err error) {
+	if r.readTimeout == 0 {
+		return r.reader.ReadRune()
+	}
+	r.fromRetry = len(r.retry) > 0
+	if r.fromRetry {
+		ru, size = r.retry[0].ru, r.retry[0].size
+		r.retry = r.retry[1:]
+	} else {
+		ru, size, err = r.readFullRune()
+		if err != nil {
+			var timeout interface{ Timeout() bool }
+			r.timedOut = errors.As(err, &timeout) && timeout.Timeout()
+			return
+		}
+	}
+	r.attempt = append(r.attempt, sizedRune{ru: ru, size: size})
+	return
+}
+
+// readFullRune reads a rune from a source with read timeouts. A read timing out in the middle of a rune would make
+// the incomplete bytes of the rune be decoded as invalid bytes. The bytes of the rune are therefore peeked before the
+// rune is read. If the peek fails (e.g. by a timeout) the error is returned and the incomplete bytes are left in the
+// source to be read again when the read is retried.
+func (r *Reader) readFullRune() (rune, int, error) {
+	if br, ok := r.reader.(*bufio.Reader); ok {
+		p, err := br.Peek(1)
+		for len(p) > 0 && !utf8.FullRune(p) && err == nil {
+			p, err = br.Peek(len(p) + 1)
+		}
+		if err != nil && !errors.Is(err, io.EOF) {
+			return 0, 0, err
+		}
+	}
+	return r.reader.ReadRune()
+}
+
+// unreadSourceRune unreads the last rune read from the source (see sourceRune).
+func (r *Reader) unreadSourceRune() error {
+	if r.readTimeout == 0 || len(r.attempt) == 0 {
+		return r.reader.UnreadRune()
+	}
+	last := r.attempt[len(r.attempt)-1]
+	r.attempt = r.attempt[:len(r.attempt)-1]
+	if r.fromRetry {
+		r.retry = append([]sizedRune{last}, r.retry...)
+		return nil
+	}
+	return r.reader.UnreadRune()
+}
+
+// retryable resets the read state to the state before buffering the current Char after a timed out read from the
+// source. The runes read while buffering the Char are read again when buffering is retried. The provided error is
+// returned wrapped in a TimeoutError.
+func (r *Reader) retryable(err error) error {
+	r.retry = append(slices.Clone(r.attempt), r.retry...)
+	r.attempt = r.attempt[:0]
+	r.pos, r.cr, r.crEnd, r.srcOffset = r.attemptStart.pos, r.attemptStart.cr, r.attemptStart.crEnd,
+		r.attemptStart.offset
+	r.counts = r.attemptStart.counts
+	r.timedOut = false
+	return &TimeoutError{Err: err}
+}
+
+// cacheRune adds the provided rune read from the provided row to the line cache (see Builder.WithLineCache). When
+// a rune from a new row is read the current line is cached.
+func (r *Reader) cacheRune(ru rune, row int) {
+	if row != r.lineRow {
+		r.cacheLine()
+		r.lineRow = row
+	}
+	r.line = append(r.line, ru)
+}
+
+// lineText returns the text of the current line without any terminating newline (CR and LF).
+func (r *Reader) lineText() string {
+	return strings.TrimRight(string(r.line), "\r\n")
+}
+
+// cacheLine adds the current line to the line cache replacing any line already cached for the same row. If the cache
+// is full the oldest line is removed.
+func (r *Reader) cacheLine() {
+	text := r.lineText()
+	r.line = r.line[:0]
+	for i := range r.lineCache {
+		if r.lineCache[i].row == r.lineRow {
+			r.lineCache[i].text = text
+			return
+		}
+	}
+	if len(r.lineCache) == r.lineCacheSize {
+		r.lineCache = append(r.lineCache[:0], r.lineCache[1:]...)
+	}
+	r.lineCache = append(r.lineCache, cachedLine{row: r.lineRow, text: text})
+}
+
+// readUpstream reads the next Char from the source Reader (see WithReader). The position of the read Char is
+// preserved.
+func (r *Reader) readUpstream() (ru rune, pos Position, err error) {
+	c, err := r.upstream.Next()
+	if err != nil {
+		pos = r.pos
+		r.eof = errors.Is(err, io.EOF)
+		return
+	}
+	r.upstream.Consume()
+	r.unread = unreadState{pos: r.pos, counts: r.counts}
+	r.pos = r.upstream.Pos()
+	r.counts.runes++
+	r.counts.bytes += utf8.RuneLen(c.Rune)
+	if r.pos.Row != r.unread.pos.Row {
+		r.counts.rows++
+	}
+	if r.recordRaw() {
+		r.raw = append(r.raw, Char{Rune: c.Rune, Pos: c.Pos})
+	}
+	return c.Rune, c.Pos, nil
+}
+
+// unreadUpstream unreads the last Char read from the source Reader (see WithReader).
+func (r *Reader) unreadUpstream() error {
+	err := r.upstream.Unconsume()
+	if err != nil {
+		return err
+	}
+	if r.recordRaw() && len(r.raw) > 0 {
+		r.raw = r.raw[:len(r.raw)-1]
+	}
+	r.pos, r.counts = r.unread.pos, r.unread.counts
+	return nil
+}
+
+// advanceOffset advances the byte offset in the source with the provided number of read bytes. Bytes read from an
+// included source are not counted.
+func (r *Reader) advanceOffset(size int) {
+	if len(r.includes) == 0 {
+		r.srcOffset += int64(size)
+		if r.progress != nil && r.srcOffset-r.srcStart-r.progressLast >= r.progressEvery {
+			r.reportProgress()
+		}
+	}
+}
+
+// reportProgress reports the current progress to the progress callback (see Builder.WithProgress).
+func (r *Reader) reportProgress() {
+	r.progressLast = r.srcOffset - r.srcStart
+	r.progress(r.Progress())
+}
+
+// byteOrderMarks holds the byte order marks detected by a bomReader. Note that the UTF-32LE byte order mark must be
+// checked before the UTF-16LE byte order mark (being a prefix of the former).
+var byteOrderMarks = []struct {
+	bom      []byte
+	encoding Encoding
+}{
+	{bom: []byte{0xEF, 0xBB, 0xBF}, encoding: UTF8},
+	{bom: []byte{0xFF, 0xFE, 0x00, 0x00}, encoding: UTF32LE},
+	{bom: []byte{0x00, 0x00, 0xFE, 0xFF}, encoding: UTF32BE},
+	{bom: []byte{0xFF, 0xFE}, encoding: UTF16LE},
+	{bom: []byte{0xFE, 0xFF}, encoding: UTF16BE},
+}
+
+// bomReader is an io.Reader detecting the encoding of the source from a byte order mark. The byte order mark is
+// detected (and removed) at the first read.
+type bomReader struct {
+	src *bufio.Reader
+	r   io.Reader // The decoding reader (nil until the encoding has been detected)
+}
+
+func (b *bomReader) Read(p []byte) (int, error) {
+	if b.r == nil {
+		b.r = b.src
+		// An error peeking is returned by the next read from the source
+		start, _ := b.src.Peek(4)
+		for _, m := range byteOrderMarks {
+			if bytes.HasPrefix(start, m.bom) {
+				_, _ = b.src.Discard(len(m.bom))
+				b.r = decodeReader(b.src, m.encoding)
+				break
+			}
+		}
+	}
+	return b.r.Read(p)
+}
+
+// sniffSize is the number of bytes inspected by a sniffReader.
+const sniffSize = 1024
+
+// charsetDeclarations holds the regular expressions identifying a charset declaration in markup. The charset name is
+// the first submatch.
+var charsetDeclarations = []*regexp.Regexp{
+	regexp.MustCompile(`(?i)<\?xml[^>]*?\sencoding\s*=\s*["']([a-z0-9._:-]+)["']`),
+	regexp.MustCompile(`(?i)<meta[^>]*?\scharset\s*=\s*["']?([a-z0-9._:-]+)`),
+	regexp.MustCompile(`(?i)<meta[^>]*?\scontent\s*=\s*["'][^"']*?charset\s*=\s*([a-z0-9._:-]+)`),
+}
+
+// sniffReader is an io.Reader sniffing the charset declared in a markup source. The charset is sniffed at the first
+// read.
+type sniffReader struct {
+	src *bufio.Reader
+	r   io.Reader // The decoding reader (nil until the charset has been sniffed)
+}
+
+func (s *sniffReader) Read(p []byte) (int, error) {
+	if s.r == nil {
+		s.r = s.src
+		// An error peeking is returned by the next read from the source
+		start, _ := s.src.Peek(sniffSize)
+		for _, re := range charsetDeclarations {
+			m := re.FindSubmatch(start)
+			if m == nil {
+				continue
+			}
+			if enc, err := htmlindex.Get(string(m[1])); err == nil {
+				s.r = enc.NewDecoder().Reader(s.src)
+			}
+			break
+		}
+	}
+	return s.r.Read(p)
+}
+
+// NewTextTransformer returns a golang.org/x/text transformer (transform.Transformer) applying the transformers of a
+// Reader. The provided build function is called to create a new Reader, reading from the provided source, for each
+// text to transform (e.g. Builder{}.WithSource(source).WithUnicodeEscape().Reader()). The runes returned by the
+// Reader are the transformed text. Note that the text transformer buffers the complete text to transform before
+// applying the Reader transformers.
+func NewTextTransformer(build func(source io.Reader) *Reader) transform.Transformer {
+	return &textTransformer{build: build}
+}
+
+// textTransformer is a transform.Transformer applying the transformers of a Reader.
+type textTransformer struct {
+	build func(source io.Reader) *Reader
+	src   []byte // Buffered text to transform
+	dst   []byte // Transformed text not yet written
+	done  bool   // True if the buffered text has been transformed
+}
+
+func (t *textTransformer) Transform(dst, src []byte, atEOF bool) (nDst, nSrc int, err error) {
+	if !t.done {
+		t.src = append(t.src, src...)
+		nSrc = len(src)
+		if !atEOF {
+			return
+		}
+		t.done = true
+		for c, err := range t.build(bytes.NewReader(t.src)).All() {
+			if err != nil {
+				return 0, nSrc, err
+			}
+			t.dst = utf8.AppendRune(t.dst, c.Rune)
+		}
+	}
+	nDst = copy(dst, t.dst)
+	t.dst = t.dst[nDst:]
+	if len(t.dst) > 0 {
+		err = transform.ErrShortDst
+	}
+	return
+}
+
+func (t *textTransformer) Reset() {
+	t.src, t.dst, t.done = nil, nil, false
+}
+
+// source is the source of a Reader. A source is usually a bufio.Reader wrapping the io.Reader provided to
+// Builder.WithSource but may also be a strings.Reader or a bytes.Reader reading directly from in-memory data.
+type source interface {
+	io.Reader
+	io.RuneScanner
+	io.ByteReader
+}
+
+// runeReaderSource is a source reading runes directly from an io.RuneReader. The bytes read from a
+// runeReaderSource are the UTF-8 encoding of the runes read from the io.RuneReader.
+type runeReaderSource struct {
+	src     io.RuneReader
+	last    rune
+	size    int    // Size of the last read rune (zero if there is no rune to unread)
+	unread  bool   // True if the last read rune has been unread
+	pending []byte // UTF-8 encoded bytes of a rune not yet read by ReadByte
+}
+
+func (s *runeReaderSource) ReadRune() (rune, int, error) {
+	if s.unread {
+		s.unread = false
+		return s.last, s.size, nil
+	}
+	ru, size, err := s.src.ReadRune()
+	if err != nil {
+		s.size = 0
+		return 0, 0, err
+	}
+	s.last, s.size = ru, size
+	return ru, size, nil
+}
+
+func (s *runeReaderSource) UnreadRune() error {
+	if s.size == 0 || s.unread {
+		return bufio.ErrInvalidUnreadRune
+	}
+	s.unread = true
+	return nil
+}
+
+func (s *runeReaderSource) ReadByte() (byte, error) {
+	if len(s.pending) == 0 {
+		ru, _, err := s.ReadRune()
+		if err != nil {
+			return 0, err
+		}
+		s.pending = utf8.AppendRune(s.pending, ru)
+	}
+	b := s.pending[0]
+	s.pending = s.pending[1:]
+	s.size = 0
+	return b, nil
+}
+
+func (s *runeReaderSource) Read(p []byte) (n int, err error) {
+	for n < len(p) {
+		p[n], err = s.ReadByte()
+		if err != nil {
+			break
+		}
+		n++
+	}
+	if n > 0 {
+		err = nil
+	}
+	return
+}
+
+// errorSource is an io.Reader always returning an error. It is used as source when the source can't be read (e.g.
+// an unknown charset).
+type errorSource struct {
+	err error
+}
+
+func (e errorSource) Read([]byte) (int, error) {
+	return 0, e.err
+}
+
+// utf16Reader is an io.Reader decoding a UTF-16 encoded source into UTF-8.
+type utf16Reader struct {
+	src     *bufio.Reader
+	order   binary.ByteOrder
+	decoded []byte // Decoded UTF-8 bytes not yet read
+	unit    uint16 // Code unit read but not yet decoded (if hasUnit)
+	hasUnit bool
+	err     error
+}
+
+func (u *utf16Reader) Read(p []byte) (int, error) {
+	for len(u.decoded) < len(p) && u.err == nil {
+		var r rune
+		r, u.err = u.readRune()
+		if u.err == nil {
+			u.decoded = utf8.AppendRune(u.decoded, r)
+		}
+	}
+	n := copy(p, u.decoded)
+	u.decoded = u.decoded[n:]
+	if n == 0 {
+		return 0, u.err
+	}
+	return n, nil
+}
+
+// readRune decodes the next rune from the source.
+func (u *utf16Reader) readRune() (rune, error) {
+	hi, err := u.readUnit()
+	if err != nil {
+		return 0, err
+	}
+	if !utf16.IsSurrogate(rune(hi)) {
+		return rune(hi), nil
+	}
+	lo, err := u.readUnit()
+	if errors.Is(err, io.EOF) {
+		return unicode.ReplacementChar, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	r := utf16.DecodeRune(rune(hi), rune(lo))
+	if r == unicode.ReplacementChar {
+		// Not a surrogate pair. The second code unit is decoded separately.
+		u.unit, u.hasUnit = lo, true
+	}
+	return r, nil
+}
+
+// readUnit reads the next code unit from the source. A trailing odd byte is returned as the unicode replacement
+// character.
+func (u *utf16Reader) readUnit() (uint16, error) {
+	if u.hasUnit {
+		u.hasUnit = false
+		return u.unit, nil
+	}
+	var b [2]byte
+	n, err := io.ReadFull(u.src, b[:])
+	if n == 1 {
+		return unicode.ReplacementChar, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return u.order.Uint16(b[:]), nil
+}
+
+// peekRuneReader is an io.RuneReader reading runes from a Reader using Reader.Peek. That is, reading runes from
+// a peekRuneReader will not consume anything from the Reader. The first error (except io.EOF) returned by
+// Reader.Peek is saved in the peekRuneReader.
+type peekRuneReader struct {
+	rd  *Reader
+	n   int
+	err error
+}
+
+func (p *peekRuneReader) ReadRune() (ru rune, size int, err error) {
+	c, err := p.rd.Peek(p.n)
+	if err != nil {
+		if !errors.Is(err, io.EOF) && p.err == nil {
+			p.err = err
+		}
+		return
+	}
+	p.n++
+	return c.Rune, len(string(c.Rune)), nil
+}
+
+// Transformer transforms the runes read from the source of a Reader. Transformers are added to a Reader using the
+// Builder (e.g. Builder.WithTransformer). Each rune read from the source is wrapped in a Char and passed through
+// the configured transformers in the order they were added to the Builder.
+//
+// The runes a transformer reads from the RuneSource are read directly from the source and are not passed through
+// the transformers added before it. Transformers reading ahead in the source (e.g. Builder.WithLineContinuation,
+// Builder.WithCommentStrip, Builder.WithTranslation and Builder.WithNormalization) should therefore normally be added
+// before any escape transformers. Transformers handling whole lines (Builder.WithLineDirectives, Builder.WithInclude
+// and Builder.WithSkipShebang) should normally be added before any other transformers.
+type Transformer interface {
+	// Transform perform applicable transformations to the provided rune (Char). The transformed rune (Char) is
+	// returned. If there was an error in the transformation the error is returned. The error is returned as is
+	// by Reader.Next and should therefore be a positional error (see NewPositionalError) describing
+	// where in the source the error occurred. A RuneSource is provided so that the transformer may be able to
+	// read more runes from the source.
+	Transform(src RuneSource, c Char) (Char, error)
+}
+
+// RuneSource is the source of runes provided to a Transformer. It is used by transformers that need to read more
+// than one rune from the source (e.g. escape sequences).
+type RuneSource interface {
+	// Read reads the next rune from the source. The position of the read rune is returned. If there are no more
+	// runes to read from the source io.EOF is returned. Note that newline is treated as an ordinary rune and will
+	// not bump the row (see Newline).
+	Read() (rune, Position, error)
+	// Unread unreads the last rune read by Read. Only the last read rune may be unread.
+	Unread() error
+	// Newline moves the position of the next rune to read to the start of the next row.
+	Newline()
+}
+
+// MultiTransformer transforms the runes read from the source of a Reader. In contrast to a Transformer, a
+// MultiTransformer may transform a rune (Char) into zero Chars (the rune is filtered out) or several Chars (the
+// rune is expanded). The Reader buffers all resulting Chars. MultiTransformers are added to a Reader using
+// Builder.WithMultiTransformer.
+type MultiTransformer interface {
+	// TransformMulti perform applicable transformations to the provided rune (Char). The resulting Chars are
+	// appended to the provided slice (dst) and the resulting slice is returned. If no Chars are appended the rune
+	// is filtered out. If there was an error in the transformation the error is returned. The error is returned
+	// as is by Reader.Next and should therefore be a positional error (see NewPositionalError) describing
+	// where in the source the error occurred. A RuneSource is provided so that the transformer may be able to read
+	// more runes from the source.
+	TransformMulti(src RuneSource, c Char, dst []Char) ([]Char, error)
+}
+
+// transformer is the internal representation of the transformers of a Reader. A transformer transforms a Char into
+// zero or more Chars. The resulting Chars are appended to the provided slice (dst) and the resulting slice is
+// returned.
+type transformer interface {
+	transform(src RuneSource, c Char, dst []Char) ([]Char, error)
+}
+
+// asciiTransparent is implemented by the transformers known to pass plain ASCII runes through untransformed (except
+// the runes introducing a transformation, like an escape rune). The Reader buffers such runes directly without
+// applying the transformers (see Reader.passThrough).
+type asciiTransparent interface {
+	// passes returns true if the provided ASCII rune is passed through untransformed (without reading any more runes
+	// from the source).
+	passes(ru rune) bool
+}
+
+// asciiTransparentOf returns the provided transformer as an asciiTransparent. If the transformer may transform any
+// ASCII rune nil is returned.
+func asciiTransparentOf(t transformer) asciiTransparent {
+	var inner any = t
+	if single, ok := t.(singleTransformer); ok {
+		inner = single.Transformer
+	}
+	a, _ := inner.(asciiTransparent)
+	return a
+}
+
+// namedTransformer is a transformer in the pipeline of a Reader. It may be named (see Builder.WithName) and
+// disabled (see Reader.DisableTransformer).
+type namedTransformer struct {
+	transformer
+	name     string
+	disabled bool
+	apply    transformFunc    // The function applying the transformer (see transformFuncOf)
+	ascii    asciiTransparent // Non-nil if plain ASCII runes may pass the transformer (see Reader.passThrough)
+	// region is true if the transformer is restricted to regions bounded by the open and close delimiters (see
+	// Builder.WithRegion). If so inside tracks if the Reader is currently inside such region.
+	region bool
+	open   rune
+	close  rune
+	inside bool
+}
+
+// inRegion updates the region state for the provided Char and returns true if the Char is inside a region and
+// should be transformed. Region delimiters are never transformed.
+func (t *namedTransformer) inRegion(c Char) bool {
+	if c.Escaped {
+		return t.inside
+	}
+	if !t.inside && c.Rune == t.open {
+		t.inside = true
+		return false
+	}
+	if t.inside && c.Rune == t.close {
+		t.inside = false
+		return false
+	}
+	return t.inside
+}
+
+// passes returns true if the provided rune is passed through the transformer untransformed. Only plain ASCII runes not
+// introducing a transformation (e.g. an escape rune or CR) or delimiting a region are passed through.
+func (t *namedTransformer) passes(ru rune) bool {
+	return ru < utf8.RuneSelf && t.ascii != nil && t.ascii.passes(ru) && !(t.region && (ru == t.open || ru == t.close))
+}
+
+// transformFunc is the function applying a transformer (see transformer).
+type transformFunc func(src RuneSource, c Char, dst []Char) ([]Char, error)
+
+// transformFuncOf returns the function applying the provided transformer. The function of a built-in single Char
+// transformer calls the Transform method of the concrete transformer (see direct). That is, the transformer is not
+// applied through the singleTransformer wrapper dispatching both the wrapper and the wrapped Transformer. Note that
+// the pipeline is not fused into a single function. The transformers are still applied one at a time for each read
+// rune (see Reader.bufferChar) as each transformer may be disabled, restricted to a region or recovered from.
+func transformFuncOf(t transformer) transformFunc {
+	single, ok := t.(singleTransformer)
+	if !ok {
+		return t.transform
+	}
+	switch t := single.Transformer.(type) {
+	case normalizeNewline:
+		return direct(t)
+	case unicodeEscape:
+		return direct(t)
+	case hexEscape:
+		return direct(t)
+	case doubledEscape:
+		return direct(t)
+	case yamlEscape:
+		return direct(t)
+	case charRefDecode:
+		return direct(t)
+	case spaceNormalization:
+		return direct(t)
+	case confusables:
+		return direct(t)
+	case mapFunc:
+		return direct(t)
+	}
+	return single.transform
+}
+
+// direct returns the function applying the provided single Char transformer by calling its Transform method. Note
+// that T must be the concrete type of the transformer (not an interface) for the call not to be dispatched.
+func direct[T Transformer](t T) transformFunc {
+	return func(src RuneSource, c Char, dst []Char) ([]Char, error) {
+		c, err := t.Transform(src, c)
+		return appendTransformed(dst, c, err)
+	}
+}
+
+// singleTransformer is a transformer wrapping a Transformer transforming a Char into a single Char.
+type singleTransformer struct {
+	Transformer
+}
+
+func (t singleTransformer) transform(src RuneSource, c Char, dst []Char) ([]Char, error) {
+	c, err := t.Transform(src, c)
+	return appendTransformed(dst, c, err)
+}
+
+// appendTransformed appends the provided Char transformed by a single Char transformer to the provided slice (dst)
+// unless the transformation failed. The resulting slice is returned together with the error (if any).
+func appendTransformed(dst []Char, c Char, err error) ([]Char, error) {
+	if err != nil {
+		return dst, err
+	}
+	return append(dst, c), nil
+}
+
+// multiTransformer is a transformer wrapping a MultiTransformer.
+type multiTransformer struct {
+	MultiTransformer
+}
+
+func (t multiTransformer) transform(src RuneSource, c Char, dst []Char) ([]Char, error) {
+	return t.TransformMulti(src, c, dst)
+}
+
+// readerSource is the RuneSource provided to the transformers of a Reader.
+type readerSource struct {
+	rd *Reader
+}
+
+func (s readerSource) Read() (rune, Position, error) {
+	return s.rd.readRune()
+}
+
+func (s readerSource) Unread() error {
+	return s.rd.unreadRune()
+}
+
+func (s readerSource) Newline() {
+	// If rows are tracked according to a newline policy the row has already been bumped when reading the newline.
+	if s.rd.newlinePolicy == NewlinePolicyNone {
+		s.rd.newline()
+	}
+}
+
+// normalizeNewline transform common newline sequences (and the configured additional line terminators) to a single
+// newline (\U000A). The next rune position of the provided Reader is bumped to the next row. If a newline is
+// identified the "next position" in the Reader is moved to the start of the next row. If there was an error
+// normalizing newlines the error is returned.
+type normalizeNewline struct {
+	newlines Newlines
+}
+
+func (n normalizeNewline) passes(ru rune) bool {
+	return ru != '\u000A' && ru != '\u000D' && n.newlines&newlineRunes[ru] == 0
+}
+
+func (n normalizeNewline) Transform(src RuneSource, c Char) (Char, error) {
+	if n.newlines&newlineRunes[c.Rune] != 0 {
+		c.Rune = '\u000A'
+		src.Newline()
+		return c, nil
+	}
+	switch c.Rune {
+	case '\u000A': // NL => NL
+		src.Newline()
+	case '\u000D': // CR => NL
+		c.Rune = '\u000A'
+		// Check for CR + NL => NL
+		r, pos, err := src.Read()
+		if errors.Is(err, io.EOF) {
+			src.Newline()
+			return c, nil
+		}
+		if err != nil {
+			return c, NewPositionalError(pos,
+				fmt.Errorf("error reading rune from source: %w", err))
+		}
+		// We treat CR + NL as a single rune in the source so the newline is bumped after the NL. Otherwise, we
+		// unread the rune after CR before bumping the newline.
+		if r != '\u000A' {
+			err = src.Unread()
+			if err != nil {
+				return c, NewPositionalError(pos,
+					fmt.Errorf("error unreading rune from source: %w", err))
+			}
+		}
+		src.Newline()
+	}
+	return c, nil
+}
+
+// escapable is implemented by the transformers supporting a configurable escape rune (see Builder.WithEscapeChar).
+type escapable interface {
+	// withEscape returns a copy of the transformer using the provided escape rune.
+	withEscape(escape rune) transformer
+}
+
+// escapeRune returns the escape rune to use for the provided configured escape rune. If no escape rune has been
+// configured (zero) backslash (\u005C) is used.
+func escapeRune(escape rune) rune {
+	if escape == 0 {
+		return '\u005C'
+	}
+	return escape
+}
+
+// unicodeEscape transform a unicode escape rune sequence "\uhhhh" or "\Uhhhhhhhh" to the rune represented by the
+// hexadecimal number 'hhhh' or 'hhhhhhhh'. If the escape sequence is illegal or incomplete an error is returned.
+type unicodeEscape struct {
+	escape rune
+	braces bool // True if the brace form "\u{h...}" is supported
+}
+
+func (u unicodeEscape) withEscape(escape rune) transformer {
+	u.escape = escape
+	return singleTransformer{u}
+}
+
+func (u unicodeEscape) passes(ru rune) bool {
+	return ru != escapeRune(u.escape)
+}
+
+func (u unicodeEscape) Transform(src RuneSource, c Char) (Char, error) {
+	// '\'
+	if c.Rune != escapeRune(u.escape) {
+		return c, nil
+	}
+	// 'u' or 'U'
+	r, pos, err := src.Read()
+	if errors.Is(err, io.EOF) {
+		return c, NewPositionalError(pos,
+			errorOf(ErrIncompleteEscape, fmt.Errorf("unexpected EOF reading unicode escape")))
+	}
+	if err != nil {
+		return c, NewPositionalError(pos, fmt.Errorf("error reading rune from source: %w", err))
+	}
+	if r != 'u' && r != 'U' {
+		// Not a unicode escape but may be a rune escape. Unread rune.
+		err = src.Unread()
+		if err != nil {
+			return c, NewPositionalError(pos,
+				fmt.Errorf("error unreading rune from source: %w", err))
+		}
+		return c, nil
+	}
+	if r == 'u' && u.braces {
+		var ok bool
+		ok, err = readUnicodeBraceEscape(src, &c)
+		if ok || err != nil {
+			return c, err
+		}
+	}
+	// Now we assume a unicode escape and will fail if not so.
+	// Read four (\u) or eight (\U) hex digits (1234) and create a unicode escape string ("'\u1234'")
+	digits := 4
+	if r == 'U' {
+		digits = 8
+	}
+	escape, err := readUnicodeEscape(src, c, r, digits)
+	if err != nil {
+		return c, err
+	}
+	// A high surrogate must be followed by an escaped low surrogate (UTF-16 surrogate pair) which are combined
+	// into a single rune.
+	if hi, ok := surrogate(escape, 0xD800); ok {
+		var lowEscape string
+		lowEscape, err = readLowSurrogateEscape(src, c, escapeRune(u.escape))
+		if err != nil {
+			return c, err
+		}
+		lo, ok := surrogate(lowEscape, 0xDC00)
+		if !ok {
+			return c, NewPositionalError(c.Pos,
+				errorOf(ErrInvalidEscape, fmt.Errorf("unpaired surrogate in unicode escape %s", escape)))
+		}
+		c.Rune = utf16.DecodeRune(hi, lo)
+		return c, nil
+	}
+	// Transform unicode escape string '\u1234' to the resulting rune.
+	// Is there a better and easier to use standard library function for the conversion?
+	var res string
+	res, err = strconv.Unquote(escape)
+	if err != nil {
+		return c, NewPositionalError(c.Pos,
+			errorOf(ErrInvalidEscape, fmt.Errorf("error parsing unicode escaped rune %s: %w", escape, err)))
+	}
+	// As the unquoted string contained a single unicode escape the first rune should be the unicode escaped rune.
+	c.Rune = []rune(res)[0]
+	return c, nil
+}
+
+// readUnicodeBraceEscape reads a brace form unicode escape ("{h...}" following "\u") from the source. If the next
+// rune in the source is not '{' the rune is unread and false is returned. Otherwise the provided Char (the start of
+// the unicode escape) is set to the escaped rune and true is returned.
+func readUnicodeBraceEscape(src RuneSource, c *Char) (bool, error) {
+	r, pos, err := src.Read()
+	if errors.Is(err, io.EOF) {
+		return false, NewPositionalError(c.Pos,
+			errorOf(ErrIncompleteEscape, fmt.Errorf("unexpected EOF reading unicode escape")))
+	}
+	if err != nil {
+		return false, NewPositionalError(pos, fmt.Errorf("error reading rune from source: %w", err))
+	}
+	if r != '{' {
+		err = src.Unread()
+		if err != nil {
+			return false, NewPositionalError(pos,
+				fmt.Errorf("error unreading rune from source: %w", err))
+		}
+		return false, nil
+	}
+	// Read at most six hex digits until '}'. Reading stops at the first rune not being a hex digit (or at a seventh
+	// hex digit) and the rune is unread. That is, a malformed escape never consumes the source following the escape.
+	var sb strings.Builder
+	for {
+		r, _, err = src.Read()
+		if errors.Is(err, io.EOF) {
+			return true, NewPositionalError(c.Pos,
+				errorOf(ErrIncompleteEscape, fmt.Errorf("unexpected EOF reading unicode escape")))
+		}
+		if err != nil {
+			return true, NewPositionalError(c.Pos,
+				fmt.Errorf("error reading rune from source: %w", err))
+		}
+		if r == '}' {
+			break
+		}
+		if !isDigit(r, 16) || sb.Len() == 6 {
+			if err = src.Unread(); err != nil {
+				return true, NewPositionalError(c.Pos,
+					fmt.Errorf("error unreading rune from source: %w", err))
+			}
+			return true, NewPositionalError(c.Pos,
+				errorOf(ErrInvalidEscape,
+					fmt.Errorf("error parsing unicode escape \\u{%s followed by %q: %w", sb.String(), r,
+						strconv.ErrSyntax)))
+		}
+		sb.WriteRune(r)
+	}
+	digits := sb.String()
+	if digits == "" {
+		return true, NewPositionalError(c.Pos, errorOf(ErrInvalidEscape, fmt.Errorf("empty unicode escape \\u{}")))
+	}
+	v, _ := strconv.ParseUint(digits, 16, 32)
+	if !utf8.ValidRune(rune(v)) {
+		return true, NewPositionalError(c.Pos,
+			errorOf(ErrInvalidEscape, fmt.Errorf("unicode escape \\u{%s} is not a valid rune", digits)))
+	}
+	c.Rune = rune(v)
+	return true, nil
+}
+
+// readUnicodeEscape reads the provided number of hex digits of a unicode escape from the source and returns the
+// unicode escape as a quoted rune literal ("'\u1234'"). The provided Char is the start of the unicode escape
+// ('\') and the provided rune the unicode escape type ('u' or 'U').
+func readUnicodeEscape(src RuneSource, c Char, u rune, digits int) (string, error) {
+	var sb strings.Builder
+	sb.WriteString(`'\`)
+	sb.WriteRune(u)
+	for i := 1; i <= digits; i++ {
+		r, _, err := src.Read()
+		if errors.Is(err, io.EOF) {
+			return "", NewPositionalError(c.Pos,
+				errorOf(ErrIncompleteEscape, fmt.Errorf("unexpected EOF reading unicode escape")))
+		}
+		if err != nil {
+			return "", NewPositionalError(c.Pos, fmt.Errorf("error reading rune from source: %w", err))
+		}
+		sb.WriteRune(r)
+	}
+	sb.WriteRune('\'')
+	return sb.String(), nil
+}
+
+// readLowSurrogateEscape reads the unicode escape following an escaped high surrogate. The unicode escape is
+// returned as a quoted rune literal ("'\uDC00'"). The provided Char is the start of the high surrogate escape. If
+// the next runes in the source are not a four digit unicode escape (introduced by the provided escape rune) an error is
+// returned.
+func readLowSurrogateEscape(src RuneSource, c Char, escape rune) (string, error) {
+	for _, exp := range []rune{escape, 'u'} {
+		r, _, err := src.Read()
+		if errors.Is(err, io.EOF) {
+			return "", NewPositionalError(c.Pos,
+				errorOf(ErrIncompleteEscape, fmt.Errorf("unexpected EOF reading unicode escape")))
+		}
+		if err != nil {
+			return "", NewPositionalError(c.Pos, fmt.Errorf("error reading rune from source: %w", err))
+		}
+		if r != exp {
+			return "", NewPositionalError(c.Pos,
+				errorOf(ErrInvalidEscape,
+					fmt.Errorf("high surrogate in unicode escape not followed by an escaped low surrogate")))
+		}
+	}
+	return readUnicodeEscape(src, c, 'u', 4)
+}
+
+// surrogate returns the surrogate represented by the provided unicode escape ("'\uD800'") if the escape is a four
+// digit unicode escape of a high (base 0xD800) or low (base 0xDC00) surrogate.
+func surrogate(escape string, base uint64) (rune, bool) {
+	if len(escape) != 8 || escape[2] != 'u' {
+		return 0, false
+	}
+	v, err := strconv.ParseUint(escape[3:7], 16, 16)
+	if err != nil || v < base || v >= base+0x400 {
+		return 0, false
+	}
+	return rune(v), true
+}
+
+// hexEscape transform a hex escape rune sequence "\xhh" to the rune represented by the hexadecimal number 'hh'.
+// If the escape sequence is illegal, incomplete or not allowed by the hex escape policy an error is returned.
+type hexEscape struct {
+	policy HexEscapePolicy
+	escape rune
+}
+
+func (h hexEscape) withEscape(escape rune) transformer {
+	h.escape = escape
+	return singleTransformer{h}
+}
+
+func (h hexEscape) passes(ru rune) bool {
+	return ru != escapeRune(h.escape)
+}
+
+func (h hexEscape) Transform(src RuneSource, c Char) (Char, error) {
+	// '\'
+	if c.Rune != escapeRune(h.escape) {
+		return c, nil
+	}
+	// 'x'
+	r, pos, err := src.Read()
+	if errors.Is(err, io.EOF) {
+		return c, NewPositionalError(pos, errorOf(ErrIncompleteEscape, fmt.Errorf("unexpected EOF reading hex escape")))
+	}
+	if err != nil {
+		return c, NewPositionalError(pos, fmt.Errorf("error reading rune from source: %w", err))
+	}
+	if r != 'x' {
+		// Not a hex escape but may be another escape. Unread rune.
+		err = src.Unread()
+		if err != nil {
+			return c, NewPositionalError(pos,
+				fmt.Errorf("error unreading rune from source: %w", err))
+		}
+		return c, nil
+	}
+	// Now we assume a hex escape and will fail if not so. Read two hex digits.
+	var sb strings.Builder
+	for i := 1; i <= 2; i++ {
+		r, _, err = src.Read()
+		if errors.Is(err, io.EOF) {
+			return c, NewPositionalError(c.Pos,
+				errorOf(ErrIncompleteEscape, fmt.Errorf("unexpected EOF reading hex escape")))
+		}
+		if err != nil {
+			return c, NewPositionalError(c.Pos, fmt.Errorf("error reading rune from source: %w", err))
+		}
+		sb.WriteRune(r)
+	}
+	digits := sb.String()
+	v, err := strconv.ParseUint(digits, 16, 8)
+	if err != nil {
+		return c, NewPositionalError(c.Pos,
+			errorOf(ErrInvalidEscape, fmt.Errorf("error parsing hex escape '\\x%s': %w", digits, strconv.ErrSyntax)))
+	}
+	if v >= 0x80 && h.policy == HexEscapeASCII {
+		return c, NewPositionalError(c.Pos,
+			errorOf(ErrInvalidEscape, fmt.Errorf("hex escape '\\x%s' is out of ASCII range", digits)))
+	}
+	c.Rune = rune(v)
+	return c, nil
+}
+
+// doubledEscape transforms a pair of the same rune (for any of the configured runes) into a single escaped rune.
+type doubledEscape struct {
+	runes []rune
+}
+
+func (d doubledEscape) passes(ru rune) bool {
+	return !slices.Contains(d.runes, ru)
+}
+
+func (d doubledEscape) Transform(src RuneSource, c Char) (Char, error) {
+	if !slices.Contains(d.runes, c.Rune) {
+		return c, nil
+	}
+	r, pos, err := src.Read()
+	if errors.Is(err, io.EOF) {
+		return c, nil
+	}
+	if err != nil {
+		return c, NewPositionalError(pos, fmt.Errorf("error reading rune from source: %w", err))
+	}
+	if r != c.Rune {
+		// Not a doubled escape. Unread rune.
+		err = src.Unread()
+		if err != nil {
+			return c, NewPositionalError(pos,
+				fmt.Errorf("error unreading rune from source: %w", err))
+		}
+		return c, nil
+	}
+	c.Escaped = true
+	return c, nil
+}
+
+// yamlRuneEscapes holds the YAML rune escapes (<from rune> => <to rune>).
+var yamlRuneEscapes = map[rune]rune{
+	'0':      '\u0000',
+	'a':      '\u0007',
+	'b':      '\u0008',
+	't':      '\u0009',
+	'\u0009': '\u0009',
+	'n':      '\u000A',
+	'v':      '\u000B',
+	'f':      '\u000C',
+	'r':      '\u000D',
+	'e':      '\u001B',
+	' ':      '\u0020',
+	'"':      '\u0022',
+	'/':      '\u002F',
+	'\\':     '\u005C',
+	'N':      '\u0085',
+	'_':      '\u00A0',
+	'L':      '\u2028',
+	'P':      '\u2029',
+}
+
+// yamlHexEscapes holds the number of hex digits for the YAML hex escapes.
+var yamlHexEscapes = map[rune]int{
+	'x': 2,
+	'u': 4,
+	'U': 8,
+}
+
+// yamlEscape transforms YAML double-quoted scalar escape sequences (see yamlRuneEscapes and yamlHexEscapes).
+type yamlEscape struct {
+	escape rune
+}
+
+func (y yamlEscape) withEscape(escape rune) transformer {
+	y.escape = escape
+	return singleTransformer{y}
+}
+
+func (y yamlEscape) passes(ru rune) bool {
+	return ru != escapeRune(y.escape)
+}
+
+func (y yamlEscape) Transform(src RuneSource, c Char) (Char, error) {
+	// '\'
+	if c.Rune != escapeRune(y.escape) {
+		return c, nil
+	}
+	r, _, err := src.Read()
+	if errors.Is(err, io.EOF) {
+		return c, NewPositionalError(c.Pos,
+			errorOf(ErrIncompleteEscape, fmt.Errorf("unexpected EOF reading YAML escape")))
+	}
+	if err != nil {
+		return c, NewPositionalError(c.Pos, fmt.Errorf("error reading rune from source: %w", err))
+	}
+	if to, ok := yamlRuneEscapes[r]; ok {
+		c.Rune = to
+		c.Escaped = true
+		return c, nil
+	}
+	n, ok := yamlHexEscapes[r]
+	if !ok {
+		return c, NewPositionalError(c.Pos,
+			errorOf(ErrInvalidEscape, fmt.Errorf("unknown escape sequence %c%c", c.Rune, r)))
+	}
+	// Read the hex digits
+	var sb strings.Builder
+	for i := 1; i <= n; i++ {
+		d, _, err := src.Read()
+		if errors.Is(err, io.EOF) {
+			return c, NewPositionalError(c.Pos,
+				errorOf(ErrIncompleteEscape, fmt.Errorf("unexpected EOF reading YAML escape")))
+		}
+		if err != nil {
+			return c, NewPositionalError(c.Pos,
+				fmt.Errorf("error reading rune from source: %w", err))
+		}
+		sb.WriteRune(d)
+	}
+	digits := sb.String()
+	v, err := strconv.ParseUint(digits, 16, 32)
+	if err != nil || !utf8.ValidRune(rune(v)) {
+		return c, NewPositionalError(c.Pos,
+			errorOf(ErrInvalidEscape,
+				fmt.Errorf("error parsing YAML escape '%c%c%s': %w", c.Rune, r, digits, strconv.ErrSyntax)))
+	}
+	c.Rune = rune(v)
+	return c, nil
+}
+
+// maxEntityNameLength is the maximum length of an entity name.
+const maxEntityNameLength = 32
+
+// entityDecode transform a named entity "&name;" to the rune(s) represented by the entity. All the resulting runes
+// get the position of the '&'. If the entity is unknown or unterminated an error is returned.
+type entityDecode struct{}
+
+func (e entityDecode) passes(ru rune) bool {
+	return ru != '&'
+}
+
+func (e entityDecode) transform(src RuneSource, c Char, dst []Char) ([]Char, error) {
+	// '&'
+	if c.Rune != '&' {
+		return append(dst, c), nil
+	}
+	// First rune of entity name must be a letter
+	r, pos, err := src.Read()
+	if errors.Is(err, io.EOF) {
+		return append(dst, c), nil
+	}
+	if err != nil {
+		return dst, NewPositionalError(pos, fmt.Errorf("error reading rune from source: %w", err))
+	}
+	if !isASCIILetter(r) {
+		// Not a named entity. Unread rune.
+		err = src.Unread()
+		if err != nil {
+			return dst, NewPositionalError(pos,
+				fmt.Errorf("error unreading rune from source: %w", err))
+		}
+		return append(dst, c), nil
+	}
+	// Now we assume a named entity and will fail if not so. Read entity name until ';'.
+	var sb strings.Builder
+	sb.WriteRune('&')
+	for r != ';' {
+		if !isASCIILetter(r) && !('0' <= r && r <= '9') {
+			return dst, NewPositionalError(c.Pos,
+				errorOf(ErrInvalidEscape, fmt.Errorf("illegal rune %q in entity %s", r, sb.String())))
+		}
+		if sb.Len() > maxEntityNameLength {
+			return dst, NewPositionalError(c.Pos,
+				errorOf(ErrIncompleteEscape, fmt.Errorf("unterminated entity %s", sb.String())))
+		}
+		sb.WriteRune(r)
+		r, _, err = src.Read()
+		if errors.Is(err, io.EOF) {
+			return dst, NewPositionalError(c.Pos,
+				errorOf(ErrIncompleteEscape, fmt.Errorf("unexpected EOF reading entity")))
+		}
+		if err != nil {
+			return dst, NewPositionalError(c.Pos,
+				fmt.Errorf("error reading rune from source: %w", err))
+		}
+	}
+	sb.WriteRune(';')
+	entity := sb.String()
+	// Note that html.UnescapeString also decodes entities that are a prefix of the entity name ("&ampx;" => "&x;").
+	// As an entity is decoded to at most two runes such a prefix match will always result in more than two runes.
+	res := html.UnescapeString(entity)
+	if res == entity || utf8.RuneCountInString(res) > 2 {
+		return dst, NewPositionalError(c.Pos, errorOf(ErrInvalidEscape, fmt.Errorf("unknown entity %s", entity)))
+	}
+	for _, r := range res {
+		c.Rune = r
+		dst = append(dst, c)
+	}
+	return dst, nil
+}
+
+// isASCIILetter returns true if the provided rune is an ASCII letter.
+func isASCIILetter(r rune) bool {
+	return 'a' <= r && r <= 'z' || 'A' <= r && r <= 'Z'
+}
+
+// maxCharRefDigits is the maximum number of digits in a numeric character reference.
+const maxCharRefDigits = 8
+
+// charRefDecode transform a numeric character reference "&#nnnn;" or "&#xhhhh;" to the rune represented by the
+// decimal number 'nnnn' or hexadecimal number 'hhhh'. If the reference is malformed or references an invalid code
+// point an error is returned.
+type charRefDecode struct{}
+
+func (d charRefDecode) passes(ru rune) bool {
+	return ru != '&'
+}
+
+func (d charRefDecode) Transform(src RuneSource, c Char) (Char, error) {
+	// '&'
+	if c.Rune != '&' {
+		return c, nil
+	}
+	// '#'
+	r, pos, err := src.Read()
+	if errors.Is(err, io.EOF) {
+		return c, nil
+	}
+	if err != nil {
+		return c, NewPositionalError(pos, fmt.Errorf("error reading rune from source: %w", err))
+	}
+	if r != '#' {
+		// Not a numeric character reference. Unread rune.
+		err = src.Unread()
+		if err != nil {
+			return c, NewPositionalError(pos,
+				fmt.Errorf("error unreading rune from source: %w", err))
+		}
+		return c, nil
+	}
+	// Now we assume a numeric character reference and will fail if not so. Read digits until ';'.
+	var sb strings.Builder
+	sb.WriteString("&#")
+	base := 10
+	for {
+		r, _, err = src.Read()
+		if errors.Is(err, io.EOF) {
+			return c, NewPositionalError(c.Pos,
+				errorOf(ErrIncompleteEscape, fmt.Errorf("unexpected EOF reading character reference")))
+		}
+		if err != nil {
+			return c, NewPositionalError(c.Pos,
+				fmt.Errorf("error reading rune from source: %w", err))
+		}
+		if r == ';' {
+			break
+		}
+		if (r == 'x' || r == 'X') && sb.Len() == 2 {
+			base = 16
+		} else if !isDigit(r, base) || sb.Len() > maxCharRefDigits+2 {
+			return c, NewPositionalError(c.Pos,
+				errorOf(ErrInvalidEscape, fmt.Errorf("malformed character reference %s", sb.String()+string(r))))
+		}
+		sb.WriteRune(r)
+	}
+	sb.WriteRune(';')
+	ref := sb.String()
+	digits := strings.TrimLeft(ref[2:len(ref)-1], "xX")
+	v, err := strconv.ParseUint(digits, base, 32)
+	if err != nil {
+		return c, NewPositionalError(c.Pos,
+			errorOf(ErrInvalidEscape, fmt.Errorf("malformed character reference %s", ref)))
+	}
+	if v > unicode.MaxRune || 0xD800 <= v && v <= 0xDFFF {
+		return c, NewPositionalError(c.Pos,
+			errorOf(ErrInvalidEscape, fmt.Errorf("character reference %s is not a valid code point", ref)))
+	}
+	c.Rune = rune(v)
+	return c, nil
+}
+
+// isDigit returns true if the provided rune is a digit in the provided base (10 or 16).
+func isDigit(r rune, base int) bool {
+	if '0' <= r && r <= '9' {
+		return true
+	}
+	return base == 16 && ('a' <= r && r <= 'f' || 'A' <= r && r <= 'F')
+}
+
+// lineContinuation removes a line continuation (a backslash followed by a newline) from the source. The next rune
+// position is moved to the start of the next row.
+type lineContinuation struct {
+	escape rune
+}
+
+func (l lineContinuation) withEscape(escape rune) transformer {
+	l.escape = escape
+	return l
+}
+
+func (l lineContinuation) passes(ru rune) bool {
+	return ru != escapeRune(l.escape)
+}
+
+func (l lineContinuation) transform(src RuneSource, c Char, dst []Char) ([]Char, error) {
+	// '\'
+	if c.Rune != escapeRune(l.escape) {
+		return append(dst, c), nil
+	}
+	// Newline
+	r, pos, err := src.Read()
+	if errors.Is(err, io.EOF) {
+		return append(dst, c), nil
+	}
+	if err != nil {
+		return dst, NewPositionalError(pos, fmt.Errorf("error reading rune from source: %w", err))
+	}
+	switch r {
+	case '\u000A':
+	case '\u000D':
+		// Check for CR + NL
+		r, pos, err = src.Read()
+		if err != nil && !errors.Is(err, io.EOF) {
+			return dst, NewPositionalError(pos,
+				fmt.Errorf("error reading rune from source: %w", err))
+		}
+		if err == nil && r != '\u000A' {
+			err = src.Unread()
+			if err != nil {
+				return dst, NewPositionalError(pos,
+					fmt.Errorf("error unreading rune from source: %w", err))
+			}
+		}
+	default:
+		// Not a line continuation. Unread rune.
+		err = src.Unread()
+		if err != nil {
+			return dst, NewPositionalError(pos,
+				fmt.Errorf("error unreading rune from source: %w", err))
+		}
+		return append(dst, c), nil
+	}
+	// Remove the line continuation and bump the next position to the next row.
+	src.Newline()
+	return dst, nil
+}
+
+// stripANSI removes ANSI CSI and OSC terminal escape sequences.
+type stripANSI struct{}
+
+func (a stripANSI) passes(ru rune) bool {
+	return ru != '\u001B'
+}
+
+func (a stripANSI) transform(src RuneSource, c Char, dst []Char) ([]Char, error) {
+	kind := c.Rune
+	if kind == '\u001B' {
+		// ESC followed by '[' (CSI) or ']' (OSC)
+		r, pos, err := src.Read()
+		if errors.Is(err, io.EOF) {
+			return append(dst, c), nil
+		}
+		if err != nil {
+			return dst, NewPositionalError(pos,
+				fmt.Errorf("error reading rune from source: %w", err))
+		}
+		switch r {
+		case '[':
+			kind = '\u009B'
+		case ']':
+			kind = '\u009D'
+		default:
+			err = src.Unread()
+			if err != nil {
+				return dst, NewPositionalError(pos,
+					fmt.Errorf("error unreading rune from source: %w", err))
+			}
+			return append(dst, c), nil
+		}
+	}
+	switch kind {
+	case '\u009B':
+		return dst, skipCSI(src)
+	case '\u009D':
+		return dst, skipOSC(src)
+	}
+	return append(dst, c), nil
+}
+
+// skipCSI skips the parameter bytes, intermediate bytes and the final byte of a CSI sequence. A rune not allowed in
+// a CSI sequence ends the sequence and is unread.
+func skipCSI(src RuneSource) error {
+	for {
+		r, pos, err := src.Read()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return NewPositionalError(pos, fmt.Errorf("error reading rune from source: %w", err))
+		}
+		switch {
+		case r >= '\u0020' && r <= '\u003F':
+			// Parameter or intermediate byte
+		case r >= '\u0040' && r <= '\u007E':
+			// Final byte
+			return nil
+		default:
+			err = src.Unread()
+			if err != nil {
+				return NewPositionalError(pos,
+					fmt.Errorf("error unreading rune from source: %w", err))
+			}
+			return nil
+		}
+	}
+}
+
+// skipOSC skips an OSC sequence up to and including the terminating BEL, ESC '\' or ST (\u009C).
+func skipOSC(src RuneSource) error {
+	esc := false
+	for {
+		r, pos, err := src.Read()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return NewPositionalError(pos, fmt.Errorf("error reading rune from source: %w", err))
+		}
+		switch {
+		case esc && r == '\\':
+			return nil
+		case esc:
+			// ESC not followed by '\' terminates the OSC sequence and starts something else
+			err = src.Unread()
+			if err != nil {
+				return NewPositionalError(pos,
+					fmt.Errorf("error unreading rune from source: %w", err))
+			}
+			return nil
+		case r == '\u0007' || r == '\u009C':
+			return nil
+		}
+		esc = r == '\u001B'
+	}
+}
+
+// include handles include directives (see Builder.WithInclude).
+type include struct {
+	directive []rune
+	resolve   IncludeResolver
+	midLine   bool // True if the previous Char was not a newline
+}
+
+func (inc *include) transform(src RuneSource, c Char, dst []Char) ([]Char, error) {
+	lineStart := !inc.midLine || c.Pos.Col == originCol(src)
+	inc.midLine = c.Rune != '\u000A' && c.Rune != '\u000D'
+	if !lineStart || len(inc.directive) == 0 || c.Rune != inc.directive[0] {
+		return append(dst, c), nil
+	}
+	// If not an include directive the read Chars are passed through.
+	pending, ok, err := readDirective(src, c, inc.directive)
+	if err != nil || !ok {
+		return append(dst, pending...), err
+	}
+	// Read the rest of the line (including the newline) containing the quoted name
+	line, err := readLine(src)
+	if err != nil {
+		return dst, err
+	}
+	name := strings.TrimSpace(line)
+	if len(name) < 2 || name[0] != '"' || name[len(name)-1] != '"' || strings.Count(name, `"`) != 2 {
+		return dst, NewPositionalError(c.Pos, errorOf(ErrMalformedDirective, fmt.Errorf("malformed include directive")))
+	}
+	name = name[1 : len(name)-1]
+	included, err := inc.resolve(name)
+	if err != nil {
+		err = errorOf(ErrIncludeFailed, fmt.Errorf("error including %q: %w", name, err))
+		return dst, NewPositionalError(c.Pos, err)
+	}
+	err = src.(readerSource).rd.pushInclude(name, included)
+	if err != nil {
+		return dst, NewPositionalError(c.Pos, err)
+	}
+	inc.midLine = false
+	return dst, nil
+}
+
+// readDirective reads the rest of the provided directive, where the provided Char is the first rune of the
+// directive, followed by a space or tab. If the directive is read true is returned. Otherwise, the read Chars
+// (including the provided Char) are returned and the rune not matching the directive is unread. If there was an
+// error reading from the source the error is returned.
+func readDirective(src RuneSource, c Char, directive []rune) ([]Char, bool, error) {
+	pending := []Char{c}
+	for len(pending) <= len(directive) {
+		r, pos, err := src.Read()
+		if errors.Is(err, io.EOF) {
+			return pending, false, nil
+		}
+		if err != nil {
+			return nil, false, NewPositionalError(pos,
+				fmt.Errorf("error reading rune from source: %w", err))
+		}
+		if len(pending) < len(directive) && r != directive[len(pending)] ||
+			len(pending) == len(directive) && r != '\u0020' && r != '\u0009' {
+			err = src.Unread()
+			if err != nil {
+				return nil, false, NewPositionalError(pos,
+					fmt.Errorf("error unreading rune from source: %w", err))
+			}
+			return pending, false, nil
+		}
+		pending = append(pending, Char{Rune: r, Pos: pos})
+	}
+	return pending, true, nil
+}
+
+// originCol returns the first column of a row in the Reader that the provided RuneSource reads from (see
+// Builder.WithZeroBased).
+func originCol(src RuneSource) int {
+	if s, ok := src.(readerSource); ok {
+		return s.rd.origin().Col
+	}
+	return startPosition.Col
+}
+
+// lineDirective handles line directives (see Builder.WithLineDirectives).
+type lineDirective struct {
+	midLine bool // True if the previous Char was not a newline
+}
+
+func (ld *lineDirective) transform(src RuneSource, c Char, dst []Char) ([]Char, error) {
+	lineStart := !ld.midLine || c.Pos.Col == originCol(src)
+	ld.midLine = c.Rune != '\u000A' && c.Rune != '\u000D'
+	if !lineStart || c.Rune != '/' && c.Rune != '#' {
+		return append(dst, c), nil
+	}
+	directive := []rune("//line")
+	if c.Rune == '#' {
+		directive = []rune("#line")
+	}
+	// If not a line directive the read Chars are passed through.
+	pending, ok, err := readDirective(src, c, directive)
+	if err != nil || !ok {
+		return append(dst, pending...), err
+	}
+	line, err := readLine(src)
+	if err != nil {
+		return dst, err
+	}
+	var pos Position
+	if c.Rune == '#' {
+		pos, ok = parseCLineDirective(strings.TrimSpace(line))
+	} else {
+		pos, ok = parseGoLineDirective(strings.TrimSpace(line))
+	}
+	if !ok {
+		return dst, NewPositionalError(c.Pos, errorOf(ErrMalformedDirective, fmt.Errorf("malformed line directive")))
+	}
+	// Override the position of the next line
+	rd := src.(readerSource).rd
+	rd.pos.Row = pos.Row
+	rd.pos.Col = rd.origin().Col
+	if pos.Col > 0 {
+		rd.pos.Col = pos.Col
+	}
+	if pos.File != "" {
+		rd.pos.File, rd.file = pos.File, pos.File
+	}
+	ld.midLine = false
+	return dst, nil
+}
+
+// parseGoLineDirective parses the text of a Go line directive ("file:row:col" or "file:row"). If the text is not a
+// valid line directive false is returned.
+func parseGoLineDirective(text string) (pos Position, ok bool) {
+	i := strings.LastIndexByte(text, ':')
+	if i < 0 {
+		return
+	}
+	n, err := strconv.Atoi(text[i+1:])
+	if err != nil || n < 1 {
+		return
+	}
+	// Check for a column
+	if j := strings.LastIndexByte(text[:i], ':'); j >= 0 {
+		if row, err := strconv.Atoi(text[j+1 : i]); err == nil && row > 0 {
+			return Position{Row: row, Col: n, File: text[:j]}, true
+		}
+	}
+	return Position{Row: n, File: text[:i]}, true
+}
+
+// parseCLineDirective parses the text of a C line directive (row optionally followed by a quoted file name). If the
+// text is not a valid line directive false is returned.
+func parseCLineDirective(text string) (pos Position, ok bool) {
+	digits, name, _ := strings.Cut(text, " ")
+	row, err := strconv.Atoi(digits)
+	if err != nil || row < 1 {
+		return
+	}
+	pos.Row = row
+	if name = strings.TrimSpace(name); name != "" {
+		pos.File, err = strconv.Unquote(name)
+		if err != nil || name[0] != '"' {
+			return
+		}
 	}
-	return reader
+	return pos, true
 }
 
-// The start position of the Reader source. Note that the first row is 1 and first column is 1.
-var startPosition = Position{
-	Row: 1,
-	Col: 1,
+// readLine reads the rest of the current line from the source including the terminating newline (LF, CR or CR +
+// LF). If a newline is read the next position is moved to the start of the next row. The read line (without
+// newline) is returned.
+func readLine(src RuneSource) (string, error) {
+	var sb strings.Builder
+	for {
+		r, pos, err := src.Read()
+		if errors.Is(err, io.EOF) {
+			return sb.String(), nil
+		}
+		if err != nil {
+			return "", NewPositionalError(pos,
+				fmt.Errorf("error reading rune from source: %w", err))
+		}
+		switch r {
+		case '\u000A':
+		case '\u000D':
+			// Check for CR + NL
+			r, pos, err = src.Read()
+			if err != nil && !errors.Is(err, io.EOF) {
+				return "", NewPositionalError(pos,
+					fmt.Errorf("error reading rune from source: %w", err))
+			}
+			if err == nil && r != '\u000A' {
+				err = src.Unread()
+				if err != nil {
+					return "", NewPositionalError(pos,
+						fmt.Errorf("error unreading rune from source: %w", err))
+				}
+			}
+		default:
+			sb.WriteRune(r)
+			continue
+		}
+		src.Newline()
+		return sb.String(), nil
+	}
 }
 
-// Reader reads runes from an io.Reader specified when creating the Reader. The io.Reader is wrapped in a
-// bufio.Reader for better performance and support for reading runes. The read runes are transformed using the
-// configured transformers (specified using a reader Builder).
-//
-// The Reader treats the source as a two-dimensional rune document containing rows and columns. The Reader returns
-// the starting position of the read rune. The Reader will bump to a new line when it reads a newline rune (\u000A).
-// The Reader may also manage some other common newline sequences using the normalize newline transformer
-// (configured with Builder.WithNormalizeNewline). Note that a transformer may convert a sequence of runes into a
-// single rune (e.g. parsing escape sequences) read by method Read. The position of each rune will therefore not
-// necessarily be consecutive positions.
-//
-// The Reader supports two models for lookahead.
-//
-// Reader supports one rune lookahead using the common next/consume pattern. When calling Reader.Next the
-// next unread element is returned. Consecutive calls to Reader.Next will return the same element. The current
-// next element may be consumed by calling Reader.Consume. The next call to Reader.Next will return the element
-// after the consumed element.
-//
-// Reader also supports multiple element lookahead using rollbacks to a saved state. Reader.State creates a
-// state. A call to Reader.Rollback will rollback to the provided state. After a rollback the next element
-// returned by Reader.Next will be the "next element" when the state was created.
-//
-// To mitigate the Reader internal buffer to grow infinitely a Reader may be committed to remove previously read
-// elements by calling Reader.Commit. After a commit all runes consumed before the commit will be removed
-// (technically consumed runes in the internal buffer row where the read pointer is located will still be
-// available in the Reader).
-type Reader struct {
-	reader       *bufio.Reader
-	pos          Position // Position of "next rune"
-	buffer       *gobuffer.Buffer[Char]
-	transformers []transformer
+// shebang removes a leading shebang line ("#!" up to and including the next newline).
+type shebang struct {
+	done bool
 }
 
-// Next returns the next Char from the Reader. The source Position of the rune is returned. If there are no
-// more runes to be read from the configured source an io.EOF error is returned.
-//
-// If there was an error reading a rune from the source the error is returned. Note that errors (including io.EOF)
-// are unrecoverable. If an error is returned by Read the Reader will be put in an error state. All subsequence
-// calls to Reader.Next will return a ErrorStateError.
-func (r *Reader) Next() (c Char, err error) {
-	// If no buffered rune read a new transformed rune from the source and save in the buffer
-	if r.buffer.Buffered() == 0 {
-		err = r.bufferChar()
+func (s *shebang) transform(src RuneSource, c Char, dst []Char) ([]Char, error) {
+	// Only the first rune in the source may start a shebang line
+	if s.done {
+		return append(dst, c), nil
+	}
+	s.done = true
+	// '#'
+	if c.Rune != '#' {
+		return append(dst, c), nil
+	}
+	// '!'
+	r, pos, err := src.Read()
+	if errors.Is(err, io.EOF) {
+		return append(dst, c), nil
+	}
+	if err != nil {
+		return dst, NewPositionalError(pos, fmt.Errorf("error reading rune from source: %w", err))
+	}
+	if r != '!' {
+		err = src.Unread()
 		if err != nil {
-			return
+			return dst, NewPositionalError(pos,
+				fmt.Errorf("error unreading rune from source: %w", err))
 		}
+		return append(dst, c), nil
 	}
-	// Read next rune (Char) in buffer.
-	var ok bool
-	c, ok = r.buffer.Next()
-	if !ok {
-		// Should really not happen as we have written a char to the buffer above if empty buffer...
-		err = fmt.Errorf("unexpected empty buffer")
+	// Skip the rest of the line including the newline
+	for {
+		r, pos, err = src.Read()
+		if errors.Is(err, io.EOF) {
+			return dst, nil
+		}
+		if err != nil {
+			return dst, NewPositionalError(pos,
+				fmt.Errorf("error reading rune from source: %w", err))
+		}
+		if r == '\u000A' {
+			break
+		}
+		if r == '\u000D' {
+			// Check for CR + NL
+			r, pos, err = src.Read()
+			if err != nil && !errors.Is(err, io.EOF) {
+				return dst, NewPositionalError(pos,
+					fmt.Errorf("error reading rune from source: %w", err))
+			}
+			if err == nil && r != '\u000A' {
+				err = src.Unread()
+				if err != nil {
+					return dst, NewPositionalError(pos,
+						fmt.Errorf("error unreading rune from source: %w", err))
+				}
+			}
+			break
+		}
 	}
-	return
+	src.Newline()
+	return dst, nil
 }
 
-// Pos returns the position of the "next char". That is, the char returned by method Next().
-func (r *Reader) Pos() Position {
-	return r.pos
+// translation translates rune sequences (from) to replacement sequences (to). The longest matching sequence is
+// translated.
+type translation struct {
+	from [][]rune
+	to   []string
 }
 
-// Consume will consume the next rune (returned by Reader.Next) from the Reader. The next rune (returned by
-// Reader.Next) will be the rune after the previous next rune.
-func (r *Reader) Consume() {
-	r.buffer.Consume()
+func (t translation) transform(src RuneSource, c Char, dst []Char) ([]Char, error) {
+	// Chars read from the source that have not been translated or passed through yet.
+	pending := []Char{c}
+	for len(pending) > 0 {
+		n, to, err := t.match(src, &pending)
+		if err != nil {
+			return dst, err
+		}
+		if n == 0 {
+			dst = append(dst, pending[0])
+			pending = pending[1:]
+			continue
+		}
+		for _, r := range to {
+			dst = append(dst, Char{Rune: r, Pos: pending[0].Pos})
+		}
+		pending = pending[n:]
+	}
+	return dst, nil
 }
 
-// State returns the current read state for the Reader. The state may be used in a call to Rollback() to
-// "reset" the Reader to the current state.
-func (r *Reader) State() State {
-	return State{bufState: r.buffer.State()}
+// match finds the longest sequence matching the start of the pending Chars. If needed more runes are read from the
+// source and added to the pending Chars. A read rune that can't be part of any sequence is unread. The number of
+// matched Chars and the replacement sequence are returned. If no sequence matches zero is returned.
+func (t translation) match(src RuneSource, pending *[]Char) (n int, to string, err error) {
+	for i := 1; ; i++ {
+		prefix := false
+		for j, from := range t.from {
+			if runesEqual((*pending)[:i], from) && i > n {
+				n, to = i, t.to[j]
+			}
+			prefix = prefix || len(from) > i && runesPrefix((*pending)[:i], from)
+		}
+		if !prefix {
+			return
+		}
+		if i < len(*pending) {
+			continue
+		}
+		// Read the next rune from the source
+		r, pos, err := src.Read()
+		if errors.Is(err, io.EOF) {
+			return n, to, nil
+		}
+		if err != nil {
+			return n, to, NewPositionalError(pos,
+				fmt.Errorf("error reading rune from source: %w", err))
+		}
+		*pending = append(*pending, Char{Rune: r, Pos: pos})
+		if !t.prefix((*pending)[:i+1]) {
+			*pending = (*pending)[:i]
+			err = src.Unread()
+			if err != nil {
+				return n, to, NewPositionalError(pos,
+					fmt.Errorf("error unreading rune from source: %w", err))
+			}
+			return n, to, nil
+		}
+	}
 }
 
-// Rollback resets the Reader to the provided state. After a rollback the next call to method Read will return
-// the rune that was the "next rune" when the provided State was created. That is, all runes read since the state
-// was created are unread. Note that Rollback() using a state collected before a call to Commit() is not supported
-// and may return an error if the rollback state is not valid anymore. Rollback to a zero state (not created by the
-// Reader.State method) will return an error.
-func (r *Reader) Rollback(state State) error {
-	return r.buffer.Rollback(state.bufState)
+// prefix returns true if the runes of the provided Chars are a prefix of any sequence.
+func (t translation) prefix(cs []Char) bool {
+	for _, from := range t.from {
+		if runesPrefix(cs, from) {
+			return true
+		}
+	}
+	return false
 }
 
-// Commit removes read runes from the internal buffer. It may be used to prevent the Reader from growing indefinitely.
-func (r *Reader) Commit() {
-	r.buffer.Commit()
+// commentStrip removes line comments and block comments from the source. If replace is true each comment is replaced
+// with a single space. If a block comment is not terminated an error is returned.
+type commentStrip struct {
+	lineStart  []rune
+	blockStart []rune
+	blockEnd   []rune
+	replace    bool
 }
 
-func (r *Reader) bufferChar() error {
-	// Read next rune from source
-	ru, pos, err := r.readRune()
-	if err != nil {
+func newCommentStrip(lineStart, blockStart, blockEnd string, replace bool) commentStrip {
+	s := commentStrip{
+		lineStart: []rune(lineStart),
+		replace:   replace,
+	}
+	if blockStart != "" && blockEnd != "" {
+		s.blockStart = []rune(blockStart)
+		s.blockEnd = []rune(blockEnd)
+	}
+	return s
+}
+
+func (s commentStrip) transform(src RuneSource, c Char, dst []Char) ([]Char, error) {
+	// Read runes as long as the read runes may be the start of a comment.
+	cs := []Char{c}
+	for {
+		if len(s.blockStart) > 0 && runesEqual(cs, s.blockStart) {
+			return s.skipBlockComment(src, c, dst)
+		}
+		if len(s.lineStart) > 0 && runesEqual(cs, s.lineStart) && !runesPrefix(cs, s.blockStart) {
+			return s.skipLineComment(src, c, dst)
+		}
+		if !runesPrefix(cs, s.lineStart) && !runesPrefix(cs, s.blockStart) {
+			// The last read rune doesn't match a comment start. Unread the rune (if not the provided rune).
+			if len(cs) > 1 {
+				pos := cs[len(cs)-1].Pos
+				err := src.Unread()
+				if err != nil {
+					return dst, NewPositionalError(pos,
+						fmt.Errorf("error unreading rune from source: %w", err))
+				}
+				cs = cs[:len(cs)-1]
+			}
+			return s.noComment(src, c, cs, dst)
+		}
+		r, pos, err := src.Read()
 		if errors.Is(err, io.EOF) {
-			// We want an unwrapped io.EOF
-			return err
+			return s.noComment(src, c, cs, dst)
+		}
+		if err != nil {
+			return dst, NewPositionalError(pos,
+				fmt.Errorf("error reading rune from source: %w", err))
 		}
-		return goerrors.NewPositionalError(pos.Row, pos.Col, fmt.Errorf("error reading rune from source: %w", err))
+		cs = append(cs, Char{Rune: r, Pos: pos})
 	}
-	// Apply transformers to read rune (wrapped in a Char).
-	c := Char{
-		Rune: ru,
-		Pos:  pos,
+}
+
+// noComment manages read runes that didn't match a complete comment start. If the read runes start with a line
+// comment start (the line comment start is a prefix of the block comment start) the line comment is skipped.
+// Otherwise, the read runes are returned.
+func (s commentStrip) noComment(src RuneSource, c Char, cs []Char, dst []Char) ([]Char, error) {
+	if len(s.lineStart) > 0 && len(cs) >= len(s.lineStart) && runesEqual(cs[:len(s.lineStart)], s.lineStart) {
+		return s.skipLineComment(src, c, dst)
 	}
-	for _, t := range r.transformers {
-		c, err = t.Transform(r, c)
+	return append(dst, cs...), nil
+}
+
+// skipLineComment skips runes until (but not including) the next newline.
+func (s commentStrip) skipLineComment(src RuneSource, c Char, dst []Char) ([]Char, error) {
+	for {
+		r, pos, err := src.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
 		if err != nil {
-			return err
+			return dst, NewPositionalError(pos,
+				fmt.Errorf("error reading rune from source: %w", err))
+		}
+		if r == '\u000A' || r == '\u000D' {
+			err = src.Unread()
+			if err != nil {
+				return dst, NewPositionalError(pos,
+					fmt.Errorf("error unreading rune from source: %w", err))
+			}
+			break
 		}
 	}
-	// Buffer transformed rune (Char)
-	r.buffer.Write(c)
-	return nil
+	return s.removed(c, dst), nil
 }
 
-func (r *Reader) readRune() (ru rune, pos Position, err error) {
-	// Read the next rune from source and step "next position". Note that we as default treat newline
-	// as an ordinary rune and will not bump the row. If such behaviour is wanted the NormalizeNewline
-	// transformer should be used.
-	ru, _, err = r.reader.ReadRune()
-	if err != nil {
-		pos = r.pos
-		return
+// skipBlockComment skips runes until (and including) the end of the block comment. Newlines in the block comment
+// bump the next position to the next row.
+func (s commentStrip) skipBlockComment(src RuneSource, c Char, dst []Char) ([]Char, error) {
+	// Keep the last read runes to be able to match the block comment end.
+	last := make([]rune, 0, len(s.blockEnd))
+	cr := false
+	for {
+		r, pos, err := src.Read()
+		if errors.Is(err, io.EOF) {
+			return dst, NewPositionalError(c.Pos,
+				errorOf(ErrUnterminatedComment, fmt.Errorf("unterminated block comment")))
+		}
+		if err != nil {
+			return dst, NewPositionalError(pos,
+				fmt.Errorf("error reading rune from source: %w", err))
+		}
+		// CR + NL is treated as a single newline
+		if r == '\u000D' || (r == '\u000A' && !cr) {
+			src.Newline()
+		}
+		cr = r == '\u000D'
+		if len(last) == len(s.blockEnd) {
+			last = append(last[:0], last[1:]...)
+		}
+		last = append(last, r)
+		if slices.Equal(last, s.blockEnd) {
+			return s.removed(c, dst), nil
+		}
 	}
-	pos = r.step(1)
-	return
 }
 
-func (r *Reader) unreadRune() (err error) {
-	err = r.reader.UnreadRune()
-	r.step(-1)
-	return
+// removed returns the result of removing a comment starting with the provided Char.
+func (s commentStrip) removed(c Char, dst []Char) []Char {
+	if s.replace {
+		c.Rune = '\u0020'
+		c.Escaped = false
+		dst = append(dst, c)
+	}
+	return dst
 }
 
-// step moves the column position the specified number of steps. If 'i' is positive then we move forward and
-// if 'i' is negative we move backwards. The previous position (before the move) is returned. Note that we don't
-// manage newline as default. The step function will therefore not move the current row in any way.
-func (r *Reader) step(i int) (pos Position) {
-	pos = r.pos
-	r.pos.Col += i
-	return
+// runesEqual returns true if the runes of the provided Chars are equal to the provided runes.
+func runesEqual(cs []Char, runes []rune) bool {
+	return len(cs) == len(runes) && runesPrefix(cs, runes)
 }
 
-// newline moves the current position to the start of the next row.
-func (r *Reader) newline() {
-	r.pos.Row += 1
-	r.pos.Col = startPosition.Col
+// runesPrefix returns true if the runes of the provided Chars are a prefix of the provided runes.
+func runesPrefix(cs []Char, runes []rune) bool {
+	if len(cs) > len(runes) {
+		return false
+	}
+	for i, c := range cs {
+		if c.Rune != runes[i] {
+			return false
+		}
+	}
+	return true
 }
 
-type transformer interface {
-	// Transform perform applicable transformations to the provided rune (Char). The transformed rune (Char) is
-	// returned. If there was an error in the transformation the error is returned.  The current Reader is
-	// provided so that the transformer may be able to read more runes from the source.
-	Transform(rd *Reader, c Char) (Char, error)
+// collapseWhitespace collapses runs of spaces and tabs into a single space. If trim is true leading and trailing
+// runs of spaces and tabs in a line are removed.
+type collapseWhitespace struct {
+	trim      bool
+	lineStart bool // True if the previous transformed rune was a newline (or no rune has been transformed)
 }
 
-// normalizeNewline transform common newline sequences to a single newline (\U000A). The next rune position
-// of the provided Reader is bumped to the next row. If a newline is identified the "next position" in the Reader
-// is moved to the start of the next row. If there was an error normalizing newlines the error is returned.
-type normalizeNewline struct{}
-
-func (n normalizeNewline) Transform(rd *Reader, c Char) (Char, error) {
-	switch c.Rune {
-	case '\u000A': // NL => NL
-		rd.newline()
-	case '\u000D': // CR => NL
-		c.Rune = '\u000A'
-		rd.newline()
-		// Check for CR + NL => NL
-		r, pos, err := rd.readRune()
+func (w *collapseWhitespace) transform(src RuneSource, c Char, dst []Char) ([]Char, error) {
+	if c.Rune != '\u0020' && c.Rune != '\u0009' {
+		w.lineStart = c.Rune == '\u000A' || c.Rune == '\u000D'
+		return append(dst, c), nil
+	}
+	// Skip the rest of the run of spaces and tabs. Check what follows the run to identify a trailing run.
+	trailing := false
+	for {
+		r, pos, err := src.Read()
 		if errors.Is(err, io.EOF) {
-			return c, nil
+			trailing = true
+			break
 		}
 		if err != nil {
-			return c, goerrors.NewPositionalError(pos.Row, pos.Col,
+			return dst, NewPositionalError(pos,
 				fmt.Errorf("error reading rune from source: %w", err))
 		}
-		if r == '\u000A' {
-			// We treat CR + NL as a single rune in the source so we step back one position.
-			rd.step(-1)
-		} else {
-			err = rd.unreadRune()
+		if r != '\u0020' && r != '\u0009' {
+			err = src.Unread()
 			if err != nil {
-				return c, goerrors.NewPositionalError(pos.Row, pos.Col,
+				return dst, NewPositionalError(pos,
 					fmt.Errorf("error unreading rune from source: %w", err))
 			}
+			trailing = r == '\u000A' || r == '\u000D'
+			break
 		}
 	}
-	return c, nil
+	if w.trim && (w.lineStart || trailing) {
+		return dst, nil
+	}
+	w.lineStart = false
+	c.Rune = '\u0020'
+	return append(dst, c), nil
 }
 
-// unicodeEscape transform a unicode escape rune sequence "\uhhhh" to the rune represented by the hexadecimal
-// number 'hhhh'. If the escape sequence is illegal or incomplete an error is returned.
-type unicodeEscape struct{}
+// controlChar manages control characters that are not allowed. The control character is either removed, replaced
+// with the unicode replacement character or an error is returned.
+type controlChar struct {
+	allow  []rune
+	action ControlCharAction
+}
 
-func (u unicodeEscape) Transform(rd *Reader, c Char) (Char, error) {
-	// '\'
-	if c.Rune != '\u005C' {
-		return c, nil
+func (cc controlChar) transform(_ RuneSource, c Char, dst []Char) ([]Char, error) {
+	if !unicode.IsControl(c.Rune) || slices.Contains(cc.allow, c.Rune) {
+		return append(dst, c), nil
 	}
-	// 'u'
-	r, pos, err := rd.readRune()
-	if errors.Is(err, io.EOF) {
-		return c, goerrors.NewPositionalError(pos.Row, pos.Col, fmt.Errorf("unexpected EOF reading unicode escape"))
+	switch cc.action {
+	case ControlCharStrip:
+		return dst, nil
+	case ControlCharReplace:
+		c.Rune = unicode.ReplacementChar
+		return append(dst, c), nil
+	default:
+		return dst, NewPositionalError(c.Pos,
+			errorOf(ErrIllegalCharacter, fmt.Errorf("illegal control character %U", c.Rune)))
 	}
-	if err != nil {
-		return c, goerrors.NewPositionalError(pos.Row, pos.Col, fmt.Errorf("error reading rune from source: %w", err))
+}
+
+// bidi manages bidirectional control characters and zero-width characters. The character is either removed or an
+// error is returned.
+type bidi struct {
+	policy BidiPolicy
+}
+
+func (b bidi) transform(_ RuneSource, c Char, dst []Char) ([]Char, error) {
+	var kind string
+	switch {
+	case c.Rune == '\u061C' || c.Rune == '\u200E' || c.Rune == '\u200F' ||
+		c.Rune >= '\u202A' && c.Rune <= '\u202E' || c.Rune >= '\u2066' && c.Rune <= '\u2069':
+		kind = "bidirectional control"
+	case c.Rune >= '\u200B' && c.Rune <= '\u200D' || c.Rune == '\u2060' || c.Rune == '\uFEFF':
+		kind = "zero-width"
+	default:
+		return append(dst, c), nil
 	}
-	if r != 'u' {
-		// Not a unicode escape but may be a rune escape. Unread rune.
-		err = rd.unreadRune()
-		if err != nil {
-			return c, goerrors.NewPositionalError(pos.Row, pos.Col,
-				fmt.Errorf("error unreading rune from source: %w", err))
-		}
+	if b.policy == BidiStrip {
+		return dst, nil
+	}
+	return dst, NewPositionalError(c.Pos,
+		errorOf(ErrIllegalCharacter, fmt.Errorf("illegal %s character %U", kind, c.Rune)))
+}
+
+// typographicASCII maps typographic characters to their ASCII equivalents.
+var typographicASCII = map[rune]string{
+	'\u2018': "'",
+	'\u2019': "'",
+	'\u201A': "'",
+	'\u201B': "'",
+	'\u201C': "\"",
+	'\u201D': "\"",
+	'\u201E': "\"",
+	'\u201F': "\"",
+	'\u2013': "-",
+	'\u2014': "-",
+	'\u2026': "...",
+}
+
+// typographic maps typographic characters to their ASCII equivalents (see typographicASCII).
+type typographic struct{}
+
+func (t typographic) transform(_ RuneSource, c Char, dst []Char) ([]Char, error) {
+	ascii, ok := typographicASCII[c.Rune]
+	if !ok {
+		return append(dst, c), nil
+	}
+	for _, r := range ascii {
+		c.Rune = r
+		dst = append(dst, c)
+	}
+	return dst, nil
+}
+
+// spaceNormalization maps unicode space separators to a regular space.
+type spaceNormalization struct {
+	warn func(c Char)
+}
+
+func (n spaceNormalization) Transform(_ RuneSource, c Char) (Char, error) {
+	if c.Rune == '\u0020' || !unicode.Is(unicode.Zs, c.Rune) {
 		return c, nil
 	}
-	// Now we assume a unicode escape and will fail if not so.
-	// Read four hex digits (1234) and create a unicode escape string ("'\u1234'")
-	var sb strings.Builder
-	sb.WriteString(`'\u`)
-	for i := 1; i <= 4; i++ {
-		r, pos, err = rd.readRune()
+	if n.warn != nil {
+		n.warn(c)
+	}
+	c.Rune = '\u0020'
+	return c, nil
+}
+
+// confusables maps confusable runes according to a table.
+type confusables struct {
+	table  map[rune]rune
+	report func(c Char, to rune)
+}
+
+func (cf confusables) Transform(_ RuneSource, c Char) (Char, error) {
+	to, ok := cf.table[c.Rune]
+	if !ok {
+		return c, nil
+	}
+	if cf.report != nil {
+		cf.report(c, to)
+	}
+	c.Rune = to
+	return c, nil
+}
+
+// mapFunc maps each rune using the provided function.
+type mapFunc struct {
+	f func(rune) rune
+}
+
+func (m mapFunc) Transform(_ RuneSource, c Char) (Char, error) {
+	c.Rune = m.f(c.Rune)
+	return c, nil
+}
+
+// normalization normalizes a sequence of runes to a unicode normalization form. The sequence starts with the
+// provided rune (Char) and continues until the next rune starting a new normalization segment (a rune that has a
+// boundary before it). All normalized runes get the position of the provided Char.
+type normalization struct {
+	form norm.Form
+}
+
+func (n normalization) transform(src RuneSource, c Char, dst []Char) ([]Char, error) {
+	// Collect the runes of the normalization segment
+	segment := utf8.AppendRune(nil, c.Rune)
+	for {
+		r, pos, err := src.Read()
 		if errors.Is(err, io.EOF) {
-			return c, goerrors.NewPositionalError(c.Pos.Row, c.Pos.Col, fmt.Errorf("unexpected EOF reading unicode escape"))
+			break
 		}
 		if err != nil {
-			return c, goerrors.NewPositionalError(c.Pos.Row, c.Pos.Col, fmt.Errorf("error reading rune from source: %w", err))
+			return dst, NewPositionalError(pos,
+				fmt.Errorf("error reading rune from source: %w", err))
 		}
-		sb.WriteRune(r)
+		if n.form.PropertiesString(string(r)).BoundaryBefore() {
+			// Start of next segment
+			err = src.Unread()
+			if err != nil {
+				return dst, NewPositionalError(pos,
+					fmt.Errorf("error unreading rune from source: %w", err))
+			}
+			break
+		}
+		segment = utf8.AppendRune(segment, r)
 	}
-	sb.WriteRune('\'')
-	// Transform unicode escape string '\u1234' to the resulting rune.
-	// Is there a better and easier to use standard library function for the conversion?
-	src := sb.String()
-	var res string
-	res, err = strconv.Unquote(src)
-	if err != nil {
-		return c, goerrors.NewPositionalError(c.Pos.Row, c.Pos.Col,
-			fmt.Errorf("error parsing unicode escaped rune %s: %w", src, err))
+	// Normalize the segment
+	for _, r := range string(n.form.Bytes(segment)) {
+		c.Rune = r
+		dst = append(dst, c)
 	}
-	// As the unquoted string contained a single unicode escape the first rune should be the unicode escaped rune.
-	c.Rune = []rune(res)[0]
-	return c, nil
+	return dst, nil
 }
 
 // runeEscape transforms a configured rune escape sequences "\<from rune>" => <to rune>. If there is no configured
-// transformation for <from rune> then <from rune> itself is returned. The resulting rune is marked as escaped
-// Char.Escaped = true. If there was an error transforming the rune escape the error is returned.
+// transformation for <from rune> then <from rune> itself is returned (or an error if strict). The resulting rune is
+// marked as escaped Char.Escaped = true. If there was an error transforming the rune escape the error is returned.
 type runeEscape struct {
-	escapes map[rune]rune
+	escapes    map[rune]rune
+	expansions map[rune]string
+	strict     bool
+	escape     rune
+}
+
+func (e runeEscape) withEscape(escape rune) transformer {
+	e.escape = escape
+	return e
+}
+
+func (e runeEscape) passes(ru rune) bool {
+	return ru != escapeRune(e.escape)
 }
 
-func (e runeEscape) Transform(rd *Reader, c Char) (Char, error) {
+func (e runeEscape) transform(src RuneSource, c Char, dst []Char) ([]Char, error) {
 	// '\'
-	if c.Rune != '\u005C' {
-		return c, nil
+	if c.Rune != escapeRune(e.escape) {
+		return append(dst, c), nil
 	}
 	// <from rune>
-	from, _, err := rd.readRune()
+	from, _, err := src.Read()
 	// If EOF we got an illegal incomplete rune escape
 	if errors.Is(err, io.EOF) {
-		return c, goerrors.NewPositionalError(c.Pos.Row, c.Pos.Col, fmt.Errorf("unexpected EOF reading rune escape"))
+		return dst, NewPositionalError(c.Pos,
+			errorOf(ErrIncompleteEscape, fmt.Errorf("unexpected EOF reading rune escape")))
 	}
 	if err != nil {
-		return c, goerrors.NewPositionalError(c.Pos.Row, c.Pos.Col, fmt.Errorf("error reading rune from source: %w", err))
+		return dst, NewPositionalError(c.Pos, fmt.Errorf("error reading rune from source: %w", err))
 	}
-	// Check if there is a specified transform <from rune> => <to rune>. Otherwise use <from rune> as <to rune>.
-	// Mark <to rune> as escaped.
-	to, ok := e.escapes[from]
-	if ok {
+	// Check if there is a specified transform <from rune> => <to rune> (or <to string>). Otherwise use <from rune>
+	// as <to rune>. Mark <to rune> as escaped.
+	c.Escaped = true
+	if to, ok := e.escapes[from]; ok {
 		c.Rune = to
-	} else {
-		c.Rune = from
+		return append(dst, c), nil
 	}
-	c.Escaped = true
-	return c, nil
+	if to, ok := e.expansions[from]; ok {
+		for _, r := range to {
+			c.Rune = r
+			dst = append(dst, c)
+		}
+		return dst, nil
+	}
+	if e.strict {
+		return dst, NewPositionalError(c.Pos,
+			errorOf(ErrInvalidEscape, fmt.Errorf("unknown escape sequence %c%c", c.Rune, from)))
+	}
+	c.Rune = from
+	return append(dst, c), nil
 }
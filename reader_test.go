@@ -1,13 +1,24 @@
 package goreader
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
-	"github.com/habak67/gobuffer"
 	"github.com/habak67/goerrors"
+	"golang.org/x/text/runes"
+	"golang.org/x/text/transform"
+	"golang.org/x/text/unicode/norm"
 	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
 	"strings"
 	"testing"
+	"testing/iotest"
+	"time"
+	"unicode"
 )
 
 func TestCharReaderRollback_ZeroState(t *testing.T) {
@@ -17,7 +28,7 @@ func TestCharReaderRollback_ZeroState(t *testing.T) {
 		t.Errorf("expected next to be 'a' (got %c)", c.Rune)
 	}
 	err := reader.Rollback(State{})
-	if err == nil || err.Error() != gobuffer.ZeroStateError.Error() {
+	if err == nil || err.Error() != errZeroState.Error() || !errors.Is(err, ErrRollbackInvalid) {
 		t.Errorf("expcted error rollback using zero state")
 	}
 }
@@ -35,265 +46,3615 @@ func TestCharReaderRollback_IllegalState(t *testing.T) {
 	}
 	reader.Commit()
 	err := reader.Rollback(state)
-	if err == nil || err.Error() != gobuffer.IllegalStateError.Error() {
+	if err == nil || err.Error() != errIllegalState.Error() || !errors.Is(err, ErrRollbackInvalid) {
 		t.Errorf("expected error rollback to illegal state (got %v)", err)
 	}
 }
 
+func TestCharReaderRollback_LiveState(t *testing.T) {
+	reader := Builder{}.WithSource(strings.NewReader("12345678901234567890")).WithSize(10, 5).WithLiveStates().Reader()
+	state1 := reader.State()
+	for i := 0; i < 15; i++ {
+		_, err := reader.Next()
+		if err != nil {
+			t.Errorf("unexpected error from next: %v", err)
+			return
+		}
+		reader.Consume()
+	}
+	state2 := reader.State()
+	reader.Commit()
+	err := reader.Rollback(state1)
+	if err != nil {
+		t.Errorf("unexpected error rollback to live state: %v", err)
+	}
+	c, _ := reader.Next()
+	if c != newChar('1', 1, 1) {
+		t.Errorf("unexpected char after rollback to live state: %v", c)
+	}
+	state1.Release()
+	reader.Commit()
+	err = reader.Rollback(state2)
+	if err != nil {
+		t.Errorf("unexpected error rollback to live state: %v", err)
+	}
+	c, _ = reader.Next()
+	if c != newChar('6', 1, 16) {
+		t.Errorf("unexpected char after rollback to live state: %v", c)
+	}
+	state2.Release()
+	reader.Commit()
+	err = reader.Rollback(state1)
+	if err == nil || err.Error() != errIllegalState.Error() || !errors.Is(err, ErrRollbackInvalid) {
+		t.Errorf("expected error rollback to illegal state (got %v)", err)
+	}
+}
+
+func TestReaderLiveStates_Release(t *testing.T) {
+	reader := Builder{}.WithSource(strings.NewReader("12345678901234567890")).WithSize(10, 5).WithLiveStates().Reader()
+	state1, state2 := reader.State(), reader.State()
+	for i := 0; i < 15; i++ {
+		if _, err := reader.Next(); err != nil {
+			t.Fatalf("unexpected error from next: %v", err)
+		}
+		reader.Consume()
+	}
+	// Releasing one of two States created at the same position keeps the runes of the other State
+	state1.Release()
+	state1.Release()
+	reader.Commit()
+	if err := reader.Rollback(state2); err != nil {
+		t.Errorf("unexpected error rollback to live state: %v", err)
+	}
+	state2.Release()
+	for i := 0; i < 15; i++ {
+		reader.Consume()
+	}
+	reader.Commit()
+	if err := reader.Rollback(state2); !errors.Is(err, ErrRollbackInvalid) {
+		t.Errorf("expected error rollback to released state (got %v)", err)
+	}
+}
+
+func TestReaderCommit_States(t *testing.T) {
+	tests := []struct {
+		name    string
+		live    bool
+		release bool
+	}{
+		{name: "untracked"},
+		{name: "untracked released", release: true},
+		{name: "live released", live: true, release: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			builder := Builder{}.WithString(strings.Repeat("a", 20000))
+			if test.live {
+				builder = builder.WithLiveStates()
+			}
+			reader := builder.Reader()
+			readStateCommit(reader, test.release)
+			if got := cap(reader.buffer.chars); got > 1000 {
+				t.Errorf("unexpected buffer growth to capacity %d", got)
+			}
+		})
+	}
+}
+
+func BenchmarkReader_StateCommit(b *testing.B) {
+	source := strings.Repeat("a", 20000)
+	for _, live := range []bool{false, true} {
+		b.Run(fmt.Sprintf("live=%t", live), func(b *testing.B) {
+			for range b.N {
+				builder := Builder{}.WithString(source)
+				if live {
+					builder = builder.WithLiveStates()
+				}
+				reader := builder.Reader()
+				// Only released live States may be removed by a commit
+				readStateCommit(reader, live)
+				if got := cap(reader.buffer.chars); got > 1000 {
+					b.Fatalf("unexpected buffer growth to capacity %d", got)
+				}
+			}
+		})
+	}
+}
+
+// readStateCommit reads the Reader to the end creating a State and committing the Reader for each Char. If release
+// is true each State is released before the commit.
+func readStateCommit(reader *Reader, release bool) {
+	for {
+		state := reader.State()
+		if _, err := reader.Next(); err != nil {
+			return
+		}
+		reader.Consume()
+		if release {
+			state.Release()
+		}
+		reader.Commit()
+	}
+}
+
 func TestBuilder_NoSourcePanic(t *testing.T) {
 	defer func() { recover() }()
 	_ = Builder{}.WithSize(10, 5).Reader()
 	t.Errorf("Builder.Reader should have raised a panic.")
 }
 
-func TestReader(t *testing.T) {
+func TestBuilderTransformers(t *testing.T) {
+	builder := Builder{}.WithSource(strings.NewReader("")).
+		WithNormalizeNewline().
+		WithRuneEscape(nil).
+		WithTransformer(dashTransformer{}).WithName("dash").
+		WithUnicodeEscape().InsertBefore("RuneEscape").
+		WithHexEscape(HexEscapeLatin1).InsertAfter("NormalizeNewline").
+		Remove("dash")
+	exp := []string{"NormalizeNewline", "HexEscape", "UnicodeEscape", "RuneEscape"}
+	if got := builder.Transformers(); !slices.Equal(got, exp) {
+		t.Errorf("unexpected transformers:\nexp=%v\ngot=%v", exp, got)
+	}
+}
+
+func TestBuilder_UnknownTransformerPanic(t *testing.T) {
+	defer func() { recover() }()
+	_ = Builder{}.WithSource(strings.NewReader("")).WithUnicodeEscape().InsertBefore("RuneEscape")
+	t.Errorf("Builder.InsertBefore should have raised a panic.")
+}
+
+func TestReaderSpaceNormalization_Warn(t *testing.T) {
+	var warned []Char
+	reader := Builder{}.WithSource(strings.NewReader("a\u2007 \u00A0")).
+		WithSpaceNormalization(func(c Char) { warned = append(warned, c) }).Reader()
+	for _, err := range reader.All() {
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+	exp := []Char{newChar('\u2007', 1, 2), newChar('\u00A0', 1, 4)}
+	if !slices.Equal(warned, exp) {
+		t.Errorf("unexpected warned chars:\nexp=%v\ngot=%v", exp, warned)
+	}
+}
+
+func TestReaderConfusables(t *testing.T) {
+	var reported []Char
+	reader := Builder{}.WithSource(strings.NewReader("p\u0430y\u03A1")).
+		WithConfusables(nil, func(c Char, to rune) { reported = append(reported, c) }).Reader()
+	var got []Char
+	for c, err := range reader.All() {
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		got = append(got, c)
+	}
+	exp := []Char{newChar('p', 1, 1), newChar('a', 1, 2), newChar('y', 1, 3), newChar('P', 1, 4)}
+	if !slices.Equal(got, exp) {
+		t.Errorf("unexpected chars:\nexp=%v\ngot=%v", exp, got)
+	}
+	exp = []Char{newChar('\u0430', 1, 2), newChar('\u03A1', 1, 4)}
+	if !slices.Equal(reported, exp) {
+		t.Errorf("unexpected reported chars:\nexp=%v\ngot=%v", exp, reported)
+	}
+	// UTS #39 maps the Cyrillic small letter ve to U+0299 (small capital B), not to 'B'
+	if to, ok := LatinConfusables['\u0432']; ok {
+		t.Errorf("unexpected confusable mapping of U+0432 to %q", to)
+	}
+}
+
+func TestBuilder_EscapeCharPanic(t *testing.T) {
+	defer func() { recover() }()
+	_ = Builder{}.WithSource(strings.NewReader("")).WithNormalizeNewline().WithEscapeChar('`')
+	t.Errorf("Builder.WithEscapeChar should have raised a panic.")
+}
+
+func TestReaderEncoding(t *testing.T) {
+	tests := []struct {
+		name     string
+		encoding Encoding
+		source   []byte
+	}{
+		{
+			name:     "UTF-16LE",
+			encoding: UTF16LE,
+			source:   []byte{'a', 0, 0x3D, 0xD8, 0x00, 0xDE, 0x00, 0xDC, 'b', 0, 'c'},
+		},
+		{
+			name:     "UTF-16BE",
+			encoding: UTF16BE,
+			source:   []byte{0, 'a', 0xD8, 0x3D, 0xDE, 0x00, 0xDC, 0x00, 0, 'b', 'c'},
+		},
+		{
+			name:     "UTF-32LE",
+			encoding: UTF32LE,
+			source:   []byte{'a', 0, 0, 0, 0x00, 0xF6, 0x01, 0, 0x00, 0xDC, 0, 0, 'b', 0, 0, 0, 'c'},
+		},
+		{
+			name:     "UTF-32BE",
+			encoding: UTF32BE,
+			source:   []byte{0, 0, 0, 'a', 0, 0x01, 0xF6, 0x00, 0, 0, 0xDC, 0x00, 0, 0, 0, 'b', 'c'},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			reader := Builder{}.WithSource(bytes.NewReader(test.source)).WithEncoding(test.encoding).Reader()
+			var got []Char
+			for c, err := range reader.All() {
+				if err != nil {
+					t.Fatalf("unexpected error: %s", err)
+				}
+				got = append(got, c)
+			}
+			exp := []Char{newChar('a', 1, 1), newChar('😀', 1, 2), newChar('\uFFFD', 1, 3), newChar('b', 1, 4),
+				newChar('\uFFFD', 1, 5)}
+			if !slices.Equal(got, exp) {
+				t.Errorf("unexpected chars:\nexp=%v\ngot=%v", exp, got)
+			}
+		})
+	}
+}
+
+func TestReaderDetectEncoding(t *testing.T) {
+	tests := []struct {
+		name   string
+		source []byte
+	}{
+		{name: "no BOM", source: []byte("a€")},
+		{name: "UTF-8", source: []byte("\xEF\xBB\xBFa€")},
+		{name: "UTF-16LE", source: []byte{0xFF, 0xFE, 'a', 0, 0xAC, 0x20}},
+		{name: "UTF-16BE", source: []byte{0xFE, 0xFF, 0, 'a', 0x20, 0xAC}},
+		{name: "UTF-32LE", source: []byte{0xFF, 0xFE, 0, 0, 'a', 0, 0, 0, 0xAC, 0x20, 0, 0}},
+		{name: "UTF-32BE", source: []byte{0, 0, 0xFE, 0xFF, 0, 0, 0, 'a', 0, 0, 0x20, 0xAC}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			reader := Builder{}.WithSource(bytes.NewReader(test.source)).WithDetectEncoding().Reader()
+			var got []Char
+			for c, err := range reader.All() {
+				if err != nil {
+					t.Fatalf("unexpected error: %s", err)
+				}
+				got = append(got, c)
+			}
+			exp := []Char{newChar('a', 1, 1), newChar('€', 1, 2)}
+			if !slices.Equal(got, exp) {
+				t.Errorf("unexpected chars:\nexp=%v\ngot=%v", exp, got)
+			}
+		})
+	}
+}
+
+func TestReaderSniffCharset(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+		exp    string
+	}{
+		{name: "none", source: "<p>\u00E9</p>", exp: "<p>\u00E9</p>"},
+		{name: "xml", source: "<?xml version=\"1.0\" encoding=\"ISO-8859-1\"?>\xE9",
+			exp: "<?xml version=\"1.0\" encoding=\"ISO-8859-1\"?>\u00E9"},
+		{name: "meta charset", source: "<meta charset=windows-1252>\x80", exp: "<meta charset=windows-1252>\u20AC"},
+		{name: "meta content", source: `<meta http-equiv="Content-Type" content="text/html; charset=latin1">` + "\xE9",
+			exp: `<meta http-equiv="Content-Type" content="text/html; charset=latin1">` + "\u00E9"},
+		{name: "unknown", source: "<meta charset=unknown>\u00E9", exp: "<meta charset=unknown>\u00E9"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			reader := Builder{}.WithSource(strings.NewReader(test.source)).WithSniffCharset().Reader()
+			var sb strings.Builder
+			for c, err := range reader.All() {
+				if err != nil {
+					t.Fatalf("unexpected error: %s", err)
+				}
+				sb.WriteRune(c.Rune)
+			}
+			if got := sb.String(); got != test.exp {
+				t.Errorf("unexpected text:\nexp=%q\ngot=%q", test.exp, got)
+			}
+		})
+	}
+}
+
+func TestReaderTextTransformer(t *testing.T) {
+	reader := Builder{}.WithSource(strings.NewReader("a\u00E9")).
+		WithTextTransformer(runes.Map(unicode.ToUpper)).WithUnicodeEscape().Reader()
+	var got []Char
+	for c, err := range reader.All() {
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		got = append(got, c)
+	}
+	exp := []Char{newChar('A', 1, 1), newChar('É', 1, 2)}
+	if !slices.Equal(got, exp) {
+		t.Errorf("unexpected chars:\nexp=%v\ngot=%v", exp, got)
+	}
+}
+
+func TestNewTextTransformer(t *testing.T) {
+	tt := NewTextTransformer(func(source io.Reader) *Reader {
+		return Builder{}.WithSource(source).WithUnicodeEscape().Reader()
+	})
+	got, _, err := transform.String(tt, `a\u00E9\u0042`)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if exp := "aéB"; got != exp {
+		t.Errorf("unexpected text:\nexp=%q\ngot=%q", exp, got)
+	}
+	_, _, err = transform.String(tt, `a\u00`)
+	if exp := genError(1, 2, fmt.Errorf("unexpected EOF reading unicode escape")); !sameError(err, exp) {
+		t.Errorf("unexpected error:\nexp=%v\ngot=%v", exp, err)
+	}
+}
+
+func TestReaderTee(t *testing.T) {
+	tests := []struct {
+		name string
+		raw  bool
+		exp  string
+	}{
+		{name: "runes", raw: false, exp: "aBaBc"},
+		{name: "raw", raw: true, exp: `a\u0042a\u0042c`},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var sb strings.Builder
+			reader := Builder{}.WithSource(strings.NewReader(`a\u0042c`)).WithUnicodeEscape().
+				WithTee(&sb, test.raw).Reader()
+			state := reader.State()
+			reader.Skip(2)
+			if err := reader.Rollback(state); err != nil {
+				t.Fatalf("unexpected rollback error: %s", err)
+			}
+			for _, err := range reader.All() {
+				if err != nil {
+					t.Fatalf("unexpected error: %s", err)
+				}
+			}
+			if got := sb.String(); got != test.exp {
+				t.Errorf("unexpected tee:\nexp=%q\ngot=%q", test.exp, got)
+			}
+			if err := reader.TeeError(); err != nil {
+				t.Errorf("unexpected tee error: %s", err)
+			}
+		})
+	}
+}
+
+func TestReaderTee_Expansion(t *testing.T) {
+	var sb strings.Builder
+	reader := Builder{}.WithString("a\\eb\u2026c").WithRuneEscapeExpand(map[rune]string{'e': "ee"}).
+		WithTypographicNormalization().WithTee(&sb, true).Reader()
+	var got string
+	for c, err := range reader.All() {
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		got += string(c.Rune)
+	}
+	if exp := "aeeb...c"; got != exp {
+		t.Errorf("unexpected runes:\nexp=%q\ngot=%q", exp, got)
+	}
+	if exp := "a\\eb\u2026c"; sb.String() != exp {
+		t.Errorf("unexpected tee:\nexp=%q\ngot=%q", exp, sb.String())
+	}
+}
+
+func TestReaderFromStringAndBytes(t *testing.T) {
 	tests := []struct {
 		name   string
 		reader *Reader
-		ops    []any
 	}{
+		{name: "string", reader: NewFromString("a\xFF€")},
+		{name: "bytes", reader: NewFromBytes([]byte("a\xFF€"))},
+		{name: "string builder", reader: Builder{}.WithString("a\xFF€").WithInvalidUTF8Policy(InvalidUTF8Skip).Reader()},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var sb strings.Builder
+			for c, err := range test.reader.All() {
+				if err != nil {
+					t.Fatalf("unexpected error: %s", err)
+				}
+				sb.WriteRune(c.Rune)
+			}
+			exp := "a\uFFFD€"
+			if test.name == "string builder" {
+				exp = "a€"
+			}
+			if got := sb.String(); got != exp {
+				t.Errorf("unexpected text:\nexp=%q\ngot=%q", exp, got)
+			}
+		})
+	}
+	reader := Builder{}.WithString("a\xFF").WithInvalidUTF8Policy(InvalidUTF8Error).Reader()
+	_, _ = reader.Next()
+	reader.Consume()
+	_, err := reader.Next()
+	exp := genError(1, 2, fmt.Errorf("error reading rune from source: invalid UTF-8 encoded byte 0xFF"))
+	if !sameError(err, exp) {
+		t.Errorf("unexpected error:\nexp=%v\ngot=%v", exp, err)
+	}
+}
+
+func TestReaderFromFile(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "main.cfg")
+	if err := os.WriteFile(name, []byte("a\n\\u00"), 0o600); err != nil {
+		t.Fatalf("unexpected error writing file: %s", err)
+	}
+	reader, err := NewFromFile(name)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	c, _ := reader.Expect('a')
+	if exp := (Char{Rune: 'a', Pos: Position{Row: 1, Col: 1, File: name}}); c != exp {
+		t.Errorf("unexpected char:\nexp=%v\ngot=%v", exp, c)
+	}
+	_, err = reader.Expect('b')
+	exp := &FileError{File: name, Err: genError(1, 2, fmt.Errorf("expected 'b', got '\\n'"))}
+	if !sameError(err, exp) {
+		t.Errorf("unexpected error:\nexp=%v\ngot=%v", exp, err)
+	}
+	if _, err = NewFromFile(filepath.Join(t.TempDir(), "missing.cfg")); err == nil {
+		t.Errorf("expected error opening missing file")
+	}
+	reader = Builder{}.WithSource(strings.NewReader(`\u00`)).WithFileName("main.cfg").WithUnicodeEscape().Reader()
+	_, err = reader.Next()
+	exp = &FileError{File: "main.cfg", Err: genError(1, 1, fmt.Errorf("unexpected EOF reading unicode escape"))}
+	if !sameError(err, exp) {
+		t.Errorf("unexpected error:\nexp=%v\ngot=%v", exp, err)
+	}
+}
+
+func TestReaderFromFile_LineCol(t *testing.T) {
+	reader := Builder{}.WithString("ab\\u00zz").WithFileName("main.cfg").WithPositionFormat(PositionLineCol).
+		WithUnicodeEscape().Reader()
+	var err error
+	for _, err = range reader.All() {
+		if err != nil {
+			break
+		}
+	}
+	if exp := "main.cfg:1:3: error parsing unicode escaped rune '\\u00zz': invalid syntax"; err == nil ||
+		err.Error() != exp {
+		t.Errorf("unexpected error:\nexp=%v\ngot=%v", exp, err)
+	}
+	var pe *PositionalError
+	if !errors.As(err, &pe) {
+		t.Fatalf("expected positional error, got %v", err)
+	}
+	exp := "main.cfg:1:3: " + pe.Err.Error() + "\nab\\u00zz\n  ^^^^^^"
+	if got := FormatDiagnostic(pe.Diagnostic(), "ab\\u00zz"); got != exp {
+		t.Errorf("unexpected diagnostic:\nexp=%q\ngot=%q", exp, got)
+	}
+	// The format is kept when the start position is overridden
+	reader = Builder{}.WithString("a").WithPositionFormat(PositionLineCol).
+		WithStartPosition(Position{Row: 3, Col: 4}).Reader()
+	if got := reader.Pos().String(); got != "3:4" {
+		t.Errorf("unexpected position: %s", got)
+	}
+}
+
+func TestReaderSourceName(t *testing.T) {
+	source := strings.Repeat("\n", 11) + "key: [value"
+	reader := Builder{}.WithString(source).WithSourceName("config.yaml").WithNormalizeNewline().Reader()
+	if err := reader.Skip(17); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	c, err := reader.Next()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if got := c.Pos.String(); got != "config.yaml:12:7" || c.Pos.Source != "config.yaml" || c.Pos.File != "" {
+		t.Errorf("unexpected position: %s", got)
+	}
+	_, err = reader.Expect(']')
+	var fe *FileError
+	if exp := "config.yaml:12:7: expected ']', got 'v'"; err == nil || err.Error() != exp || errors.As(err, &fe) {
+		t.Errorf("unexpected error:\nexp=%v\ngot=%v", exp, err)
+	}
+	// A line directive sets the file name but keeps the source name
+	reader = Builder{}.WithString("//line gen.y:10:5\nab").WithSourceName("config.yaml").WithLineDirectives().
+		Reader()
+	c, err = reader.Next()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if got := c.Pos.String(); got != "gen.y:10:5" || c.Pos.Source != "config.yaml" {
+		t.Errorf("unexpected position: %s", got)
+	}
+}
+
+func TestReaderFromMappedFile(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "main.cfg")
+	if err := os.WriteFile(name, []byte("ab\ncd"), 0o600); err != nil {
+		t.Fatalf("unexpected error writing file: %s", err)
+	}
+	reader, closer, err := NewFromMappedFile(name)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	var got string
+	for c, err := range reader.All() {
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		got += string(c.Rune)
+	}
+	if got != "ab\ncd" {
+		t.Errorf("unexpected text:\nexp=%q\ngot=%q", "ab\ncd", got)
+	}
+	if err = closer.Close(); err != nil {
+		t.Errorf("unexpected error closing: %s", err)
+	}
+	if err = closer.Close(); err != nil {
+		t.Errorf("unexpected error closing twice: %s", err)
+	}
+	empty := filepath.Join(t.TempDir(), "empty.cfg")
+	if err = os.WriteFile(empty, nil, 0o600); err != nil {
+		t.Fatalf("unexpected error writing file: %s", err)
+	}
+	reader, closer, err = NewFromMappedFile(empty)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer closer.Close()
+	if _, err = reader.Next(); !errors.Is(err, io.EOF) {
+		t.Errorf("expected EOF, got %v", err)
+	}
+	if _, _, err = NewFromMappedFile(filepath.Join(t.TempDir(), "missing.cfg")); err == nil {
+		t.Errorf("expected error opening missing file")
+	}
+}
+
+func TestReaderInclude(t *testing.T) {
+	sources := map[string]string{
+		"x": "c\n#include \"y\"\n",
+		"y": "d",
+	}
+	resolver := func(name string) (io.Reader, error) {
+		source, ok := sources[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown source")
+		}
+		return strings.NewReader(source), nil
+	}
+	reader := Builder{}.WithSource(strings.NewReader("a\n#include \"x\"\n#includes\nb")).
+		WithInclude("#include", resolver).WithNormalizeNewline().Reader()
+	var got []Char
+	for c, err := range reader.All() {
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		got = append(got, c)
+	}
+	exp := []Char{
+		newChar('a', 1, 1),
+		newChar('\n', 1, 2),
+		{Rune: 'c', Pos: Position{Row: 1, Col: 1, File: "x"}},
+		{Rune: '\n', Pos: Position{Row: 1, Col: 2, File: "x"}},
+		{Rune: 'd', Pos: Position{Row: 1, Col: 1, File: "y"}},
+		newChar('#', 3, 1), newChar('i', 3, 2), newChar('n', 3, 3), newChar('c', 3, 4), newChar('l', 3, 5),
+		newChar('u', 3, 6), newChar('d', 3, 7), newChar('e', 3, 8), newChar('s', 3, 9), newChar('\n', 3, 10),
+		newChar('b', 4, 1),
+	}
+	if !slices.Equal(got, exp) {
+		t.Errorf("unexpected chars:\nexp=%v\ngot=%v", exp, got)
+	}
+}
+
+func TestReaderInclude_ZeroBasedMidLine(t *testing.T) {
+	resolver := func(name string) (io.Reader, error) {
+		t.Errorf("unexpected include of %q in the middle of a line", name)
+		return strings.NewReader(""), nil
+	}
+	reader := Builder{}.WithString("x#include \"y\"\nb").WithInclude("#include", resolver).WithNormalizeNewline().
+		WithZeroBased().Reader()
+	var got []Char
+	for c, err := range reader.All() {
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		got = append(got, c)
+	}
+	if text := charsToString(got); text != "x#include \"y\"\nb" {
+		t.Errorf("unexpected text: %q", text)
+	}
+}
+
+func TestReaderInclude_Error(t *testing.T) {
+	resolver := func(name string) (io.Reader, error) {
+		return nil, fmt.Errorf("unknown source")
+	}
+	tests := []struct {
+		name   string
+		source string
+		exp    error
+	}{
+		{name: "unknown", source: "a\n%include \"x\"",
+			exp: genError(2, 1, fmt.Errorf("error including %q: %w", "x", fmt.Errorf("unknown source")))},
+		{name: "malformed", source: "%include x", exp: genError(1, 1, fmt.Errorf("malformed include directive"))},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			reader := Builder{}.WithSource(strings.NewReader(test.source)).WithInclude("%include", resolver).
+				WithNormalizeNewline().Reader()
+			var err error
+			for _, err = range reader.All() {
+				if err != nil {
+					break
+				}
+			}
+			if !sameError(err, test.exp) {
+				t.Errorf("unexpected error:\nexp=%v\ngot=%v", test.exp, err)
+			}
+		})
+	}
+}
+
+func TestReaderSeek(t *testing.T) {
+	source := "ab\r\ncd\nef\r\ngh"
+	tests := []struct {
+		name   string
+		reader func() *Reader
+		read   int
+		seek   Position
+		exp    []Char
+	}{
+		{name: "indexed row", reader: func() *Reader {
+			return Builder{}.WithString(source).WithNewlinePolicy(NewlinePolicyAll).Reader()
+		}, read: 8, seek: Position{Row: 2, Col: 2}, exp: []Char{
+			newChar('d', 2, 2), newChar('\n', 2, 3), newChar('e', 3, 1),
+		}},
+		{name: "row start after CR", reader: func() *Reader {
+			return Builder{}.WithString(source).WithNewlinePolicy(NewlinePolicyAll).Reader()
+		}, read: 6, seek: Position{Row: 2, Col: 1}, exp: []Char{
+			newChar('c', 2, 1), newChar('d', 2, 2), newChar('\n', 2, 3),
+		}},
+		{name: "beyond index", reader: func() *Reader {
+			return Builder{}.WithSource(strings.NewReader(source)).WithNormalizeNewline().Reader()
+		}, read: 1, seek: Position{Row: 4, Col: 2}, exp: []Char{
+			newChar('h', 4, 2),
+		}},
+		{name: "backwards", reader: func() *Reader {
+			return Builder{}.WithBytes([]byte(source)).WithNormalizeNewline().Reader()
+		}, read: 10, seek: Position{Row: 1, Col: 1}, exp: []Char{
+			newChar('a', 1, 1), newChar('b', 1, 2), newChar('\n', 1, 3),
+		}},
+		{name: "column beyond row", reader: func() *Reader {
+			return Builder{}.WithString(source).WithNormalizeNewline().Reader()
+		}, read: 0, seek: Position{Row: 1, Col: 10}, exp: []Char{
+			newChar('c', 2, 1),
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			reader := test.reader()
+			for i := 0; i < test.read; i++ {
+				if _, err := reader.Next(); err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				reader.Consume()
+			}
+			if err := reader.Seek(test.seek); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			for _, exp := range test.exp {
+				c, err := reader.Next()
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				if c != exp {
+					t.Errorf("unexpected char:\nexp=%v\ngot=%v", exp, c)
+				}
+				reader.Consume()
+			}
+		})
+	}
+}
+
+func TestReaderSeek_Error(t *testing.T) {
+	tests := []struct {
+		name   string
+		reader *Reader
+		seek   Position
+		exp    error
+	}{
+		{name: "not seekable", reader: New(bytes.NewBufferString("a")), seek: Position{Row: 1, Col: 1},
+			exp: fmt.Errorf("source doesn't support seeking")},
+		{name: "wrapped source", reader: Builder{}.WithString("a").WithEncoding(UTF16LE).Reader(),
+			seek: Position{Row: 1, Col: 1}, exp: fmt.Errorf("source doesn't support seeking")},
+		{name: "illegal position", reader: NewFromString("a"), seek: Position{Row: 0, Col: 1},
+			exp: fmt.Errorf("illegal seek position 0/1")},
+		{name: "beyond end", reader: NewFromString("a"), seek: Position{Row: 1, Col: 2},
+			exp: fmt.Errorf("seek position 1/2 is beyond the end of the source")},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := test.reader.Seek(test.seek)
+			if !errors.Is(err, ErrInvalidSeek) || err.Error() != test.exp.Error() {
+				t.Errorf("unexpected error:\nexp=%v\ngot=%v", test.exp, err)
+			}
+		})
+	}
+}
+
+func TestReaderSeek_BeyondEnd(t *testing.T) {
+	reader := Builder{}.WithString("ab\ncd").WithNormalizeNewline().Reader()
+	if _, err := reader.Next(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	reader.Consume()
+	if _, err := reader.Peek(2); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err := reader.Seek(Position{Row: 5, Col: 1}); !errors.Is(err, ErrInvalidSeek) {
+		t.Errorf("unexpected error: %v", err)
+	}
+	var got []Char
+	for c, err := range reader.All() {
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		got = append(got, c)
+	}
+	exp := []Char{newChar('b', 1, 2), newChar('\n', 1, 3), newChar('c', 2, 1), newChar('d', 2, 2)}
+	if !slices.Equal(got, exp) {
+		t.Errorf("unexpected chars after failed seek:\nexp=%v\ngot=%v", exp, got)
+	}
+	// A Reader at the end of the source is still at the end of the source after a failed seek
+	if err := reader.Seek(Position{Row: 5, Col: 1}); !errors.Is(err, ErrInvalidSeek) {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if !reader.AtEOF() {
+		t.Errorf("expected reader at EOF after failed seek")
+	}
+}
+
+func TestReaderChain(t *testing.T) {
+	comments := Builder{}.WithSource(strings.NewReader("a/* x */\\u0062\\n/**/\\u00")).
+		WithCommentStrip("//", "/*", "*/").Reader()
+	reader := Builder{}.WithReader(comments).WithUnicodeEscape().Reader()
+	exp := []Char{newChar('a', 1, 1), newChar('b', 1, 9), newChar('\\', 1, 15), newChar('n', 1, 16)}
+	for _, e := range exp {
+		c, err := reader.Next()
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if c != e {
+			t.Errorf("unexpected char:\nexp=%v\ngot=%v", e, c)
+		}
+		reader.Consume()
+	}
+	_, err := reader.Next()
+	expErr := genError(1, 21, fmt.Errorf("unexpected EOF reading unicode escape"))
+	if !sameError(err, expErr) {
+		t.Errorf("unexpected error:\nexp=%v\ngot=%v", expErr, err)
+	}
+}
+
+func TestReaderChain_Commit(t *testing.T) {
+	upstream := NewFromString(strings.Repeat("a\\u0062", 100000))
+	reader := Builder{}.WithReader(upstream).WithUnicodeEscape().Reader()
+	for {
+		if _, err := reader.Next(); errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		reader.Consume()
+		reader.Commit()
+		if n := len(upstream.buffer.chars); n > 1000 {
+			t.Fatalf("unexpected number of Chars in the source Reader buffer: %d", n)
+		}
+	}
+}
+
+// timeoutConn is a source supporting read deadlines. Each read returns the next chunk. An empty chunk results in a
+// timeout.
+type timeoutConn struct {
+	chunks    []string
+	deadlines int
+}
+
+func (c *timeoutConn) Read(p []byte) (int, error) {
+	if len(c.chunks) == 0 {
+		return 0, io.EOF
+	}
+	chunk := c.chunks[0]
+	c.chunks = c.chunks[1:]
+	if chunk == "" {
+		return 0, os.ErrDeadlineExceeded
+	}
+	return copy(p, chunk), nil
+}
+
+func (c *timeoutConn) SetReadDeadline(time.Time) error {
+	c.deadlines++
+	return nil
+}
+
+func TestReaderReadTimeout(t *testing.T) {
+	conn := &timeoutConn{chunks: []string{"a\\u00", "", "62", "", "c"}}
+	reader := Builder{}.WithSource(conn).WithReadTimeout(time.Second).WithUnicodeEscape().Reader()
+	exp := []Char{newChar('a', 1, 1), newChar('b', 1, 2), newChar('c', 1, 8)}
+	for _, e := range exp {
+		c, err := reader.Next()
+		if err != nil {
+			var timeout *TimeoutError
+			if !errors.As(err, &timeout) || !errors.Is(err, os.ErrDeadlineExceeded) {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			// Retry after timeout
+			c, err = reader.Next()
+			if err != nil {
+				t.Fatalf("unexpected error retrying: %v", err)
+			}
+		}
+		if c != e {
+			t.Errorf("unexpected char:\nexp=%v\ngot=%v", e, c)
+		}
+		reader.Consume()
+	}
+	if _, err := reader.Next(); !errors.Is(err, io.EOF) {
+		t.Errorf("expected EOF, got %v", err)
+	}
+	if conn.deadlines == 0 {
+		t.Errorf("expected read deadlines to be set")
+	}
+}
+
+func TestReaderReadTimeout_SplitRune(t *testing.T) {
+	conn := &timeoutConn{chunks: []string{"a\xc3", "", "\xa9b"}}
+	reader := Builder{}.WithSource(conn).WithReadTimeout(time.Second).Reader()
+	var got []Char
+	for {
+		c, err := reader.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		var timeout *TimeoutError
+		if errors.As(err, &timeout) {
+			// Retry after timeout
+			continue
+		}
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		got = append(got, c)
+		reader.Consume()
+	}
+	exp := []Char{newChar('a', 1, 1), newChar('é', 1, 2), newChar('b', 1, 3)}
+	if !slices.Equal(got, exp) {
+		t.Errorf("unexpected chars:\nexp=%v\ngot=%v", exp, got)
+	}
+}
+
+func TestBuilder_ReadTimeoutPanic(t *testing.T) {
+	defer func() { recover() }()
+	_ = Builder{}.WithSource(strings.NewReader("a")).WithReadTimeout(time.Second)
+	t.Errorf("Builder.WithReadTimeout should have raised a panic.")
+}
+
+func TestReaderQuotedPrintable(t *testing.T) {
+	reader := Builder{}.WithSource(strings.NewReader("caf=C3=A9 =\r\nau =3D lait\r\nx")).WithQuotedPrintable().
+		WithNormalizeNewline().Reader()
+	var got []Char
+	for c, err := range reader.All() {
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		got = append(got, c)
+	}
+	exp := []Char{newChar('c', 1, 1), newChar('a', 1, 2), newChar('f', 1, 3), newChar('é', 1, 4),
+		newChar(' ', 1, 5), newChar('a', 1, 6), newChar('u', 1, 7), newChar(' ', 1, 8), newChar('=', 1, 9),
+		newChar(' ', 1, 10), newChar('l', 1, 11), newChar('a', 1, 12), newChar('i', 1, 13), newChar('t', 1, 14),
+		newChar('\n', 1, 15), newChar('x', 2, 1)}
+	if !slices.Equal(got, exp) {
+		t.Errorf("unexpected chars:\nexp=%v\ngot=%v", exp, got)
+	}
+	reader = Builder{}.WithSource(strings.NewReader("a=ZZ\x01")).WithQuotedPrintable().Reader()
+	if _, err := reader.Next(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	reader.Consume()
+	if c, _ := reader.Next(); c != newChar('=', 1, 2) {
+		t.Errorf("unexpected char:\nexp=%v\ngot=%v", newChar('=', 1, 2), c)
+	}
+	for range 3 {
+		_, _ = reader.Next()
+		reader.Consume()
+	}
+	if _, err := reader.Next(); err == nil {
+		t.Errorf("expected error reading malformed quoted-printable")
+	}
+}
+
+func TestReaderBase64Source(t *testing.T) {
+	// "ab\ncé" encoded with a line break in the encoded source
+	reader := Builder{}.WithSource(strings.NewReader("YWIK\r\nY8Op")).WithBase64Source().WithNormalizeNewline().Reader()
+	var got []Char
+	for c, err := range reader.All() {
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		got = append(got, c)
+	}
+	exp := []Char{newChar('a', 1, 1), newChar('b', 1, 2), newChar('\n', 1, 3), newChar('c', 2, 1), newChar('é', 2, 2)}
+	if !slices.Equal(got, exp) {
+		t.Errorf("unexpected chars:\nexp=%v\ngot=%v", exp, got)
+	}
+	reader = Builder{}.WithSource(strings.NewReader("YW*K")).WithBase64Source().Reader()
+	if _, err := reader.Next(); err == nil {
+		t.Errorf("expected error reading malformed base64")
+	}
+}
+
+func TestReaderRuneSource(t *testing.T) {
+	reader := Builder{}.WithRuneSource(strings.NewReader("a\\u00e9\nb")).WithUnicodeEscape().WithNormalizeNewline().
+		Reader()
+	var got []Char
+	for c, err := range reader.All() {
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		got = append(got, c)
+	}
+	exp := []Char{newChar('a', 1, 1), newChar('é', 1, 2), newChar('\n', 1, 8), newChar('b', 2, 1)}
+	if !slices.Equal(got, exp) {
+		t.Errorf("unexpected chars:\nexp=%v\ngot=%v", exp, got)
+	}
+	// Bytes read from a rune source are UTF-8 encoded runes
+	reader = Builder{}.WithRuneSource(strings.NewReader("\x00\x00\x00a")).WithEncoding(UTF32BE).Reader()
+	if c, err := reader.Next(); err != nil || c != newChar('a', 1, 1) {
+		t.Errorf("unexpected char %v (error %v)", c, err)
+	}
+}
+
+func TestReaderColumnUnit(t *testing.T) {
+	tests := []struct {
+		name   string
+		unit   ColumnUnit
+		exp    []Char
+		expEnd Position
+	}{
+		{name: "runes", unit: ColumnRunes, exp: []Char{newChar('a', 1, 1), newChar('😀', 1, 2), newChar('é', 1, 3),
+			newChar('\n', 1, 4), newChar('b', 2, 1), newChar('\n', 2, 2), newChar('😀', 3, 1)},
+			expEnd: Position{Row: 3, Col: 2}},
+		{name: "UTF-16", unit: ColumnUTF16, exp: []Char{newChar('a', 1, 1), newChar('😀', 1, 2), newChar('é', 1, 4),
+			newChar('\n', 1, 5), newChar('b', 2, 1), newChar('\n', 2, 2), newChar('😀', 3, 1)},
+			expEnd: Position{Row: 3, Col: 3}},
+		{name: "bytes", unit: ColumnBytes, exp: []Char{newChar('a', 1, 1), newChar('😀', 1, 2), newChar('é', 1, 6),
+			newChar('\n', 1, 8), newChar('b', 2, 1), newChar('\n', 2, 2), newChar('😀', 3, 1)},
+			expEnd: Position{Row: 3, Col: 5}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			reader := Builder{}.WithSource(strings.NewReader("a😀é\nb\r😀")).WithColumnUnit(test.unit).
+				WithNormalizeNewline().Reader()
+			var got []Char
+			for c, err := range reader.All() {
+				if err != nil {
+					t.Fatalf("unexpected error: %s", err)
+				}
+				got = append(got, c)
+			}
+			if !slices.Equal(got, test.exp) {
+				t.Errorf("unexpected chars:\nexp=%v\ngot=%v", test.exp, got)
+			}
+			if pos := reader.Pos(); pos != test.expEnd {
+				t.Errorf("unexpected end position:\nexp=%v\ngot=%v", test.expEnd, pos)
+			}
+		})
+	}
+	reader := Builder{}.WithString("a日本ｘ😀é").WithColumnUnit(ColumnDisplayWidth).Reader()
+	var got []Char
+	for c, err := range reader.All() {
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		got = append(got, c)
+	}
+	exp := []Char{newChar('a', 1, 1), newChar('日', 1, 2), newChar('本', 1, 4), newChar('ｘ', 1, 6),
+		newChar('😀', 1, 8), newChar('é', 1, 10)}
+	if !slices.Equal(got, exp) {
+		t.Errorf("unexpected chars:\nexp=%v\ngot=%v", exp, got)
+	}
+}
+
+func TestReaderByteOffsets(t *testing.T) {
+	offsetChar := func(ru rune, row, col, offset int) Char {
+		return Char{Rune: ru, Pos: Position{Row: row, Col: col, Offset: offset}}
+	}
+	tests := []struct {
+		name   string
+		reader *Reader
+		exp    []Char
+	}{
+		{
+			name: "newline policy",
+			reader: Builder{}.WithString("aé\r\nb").WithNewlinePolicy(NewlinePolicyAll).WithByteOffsets().
+				Reader(),
+			exp: []Char{offsetChar('a', 1, 1, 0), offsetChar('é', 1, 2, 1), offsetChar('\r', 1, 3, 3),
+				offsetChar('\n', 1, 4, 4), offsetChar('b', 2, 1, 5)},
+		},
+		{
+			name:   "normalize newline",
+			reader: Builder{}.WithString("a\r😀").WithNormalizeNewline().WithByteOffsets().Reader(),
+			exp:    []Char{offsetChar('a', 1, 1, 0), offsetChar('\n', 1, 2, 1), offsetChar('😀', 2, 1, 2)},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var got []Char
+			for c, err := range test.reader.All() {
+				if err != nil {
+					t.Fatalf("unexpected error: %s", err)
+				}
+				got = append(got, c)
+			}
+			if !slices.Equal(got, test.exp) {
+				t.Errorf("unexpected chars:\nexp=%v\ngot=%v", test.exp, got)
+			}
+		})
+	}
+	reader := Builder{}.WithString("aé\nb").WithNewlinePolicy(NewlinePolicyLF).WithByteOffsets().Reader()
+	for range reader.All() {
+	}
+	if err := reader.Seek(Position{Row: 2, Col: 1}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if c, _ := reader.Next(); c != offsetChar('b', 2, 1, 4) {
+		t.Errorf("unexpected char after seek:\nexp=%v\ngot=%v", offsetChar('b', 2, 1, 4), c)
+	}
+}
+
+func TestReaderRuneIndex(t *testing.T) {
+	indexChar := func(ru rune, row, col, index int) Char {
+		return Char{Rune: ru, Pos: Position{Row: row, Col: col, Index: index}}
+	}
+	reader := Builder{}.WithString("aé\r\n😀\xFFb").WithNewlinePolicy(NewlinePolicyAll).
+		WithInvalidUTF8Policy(InvalidUTF8Skip).WithRuneIndex().Reader()
+	var got []Char
+	for c, err := range reader.All() {
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		got = append(got, c)
+	}
+	exp := []Char{indexChar('a', 1, 1, 0), indexChar('é', 1, 2, 1), indexChar('\r', 1, 3, 2),
+		indexChar('\n', 1, 4, 3), indexChar('😀', 2, 1, 4), indexChar('b', 2, 2, 6)}
+	if !slices.Equal(got, exp) {
+		t.Errorf("unexpected chars:\nexp=%v\ngot=%v", exp, got)
+	}
+	if err := reader.Seek(Position{Row: 2, Col: 1}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if c, _ := reader.Next(); c != indexChar('😀', 2, 1, 4) {
+		t.Errorf("unexpected char after seek:\nexp=%v\ngot=%v", indexChar('😀', 2, 1, 4), c)
+	}
+}
+
+func TestReaderStartPosition(t *testing.T) {
+	tests := []struct {
+		name   string
+		reader *Reader
+		exp    []Char
+	}{
+		{
+			name:   "zero based",
+			reader: Builder{}.WithString("ab\ncd").WithZeroBased().WithNormalizeNewline().Reader(),
+			exp: []Char{newChar('a', 0, 0), newChar('b', 0, 1), newChar('\n', 0, 2), newChar('c', 1, 0),
+				newChar('d', 1, 1)},
+		},
+		{
+			name: "start position",
+			reader: Builder{}.WithString("ab\ncd").WithStartPosition(Position{Row: 5, Col: 7}).
+				WithNormalizeNewline().Reader(),
+			exp: []Char{newChar('a', 5, 7), newChar('b', 5, 8), newChar('\n', 5, 9), newChar('c', 6, 1),
+				newChar('d', 6, 2)},
+		},
+		{
+			name: "zero based start position",
+			reader: Builder{}.WithString("ab\ncd").WithZeroBased().WithStartPosition(Position{Row: 5, Col: 7}).
+				WithNewlinePolicy(NewlinePolicyLF).Reader(),
+			exp: []Char{newChar('a', 5, 7), newChar('b', 5, 8), newChar('\n', 5, 9), newChar('c', 6, 0),
+				newChar('d', 6, 1)},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var got []Char
+			for c, err := range test.reader.All() {
+				if err != nil {
+					t.Fatalf("unexpected error: %s", err)
+				}
+				got = append(got, c)
+			}
+			if !slices.Equal(got, test.exp) {
+				t.Errorf("unexpected chars:\nexp=%v\ngot=%v", test.exp, got)
+			}
+			if err := test.reader.Seek(test.exp[1].Pos); err != nil {
+				t.Fatalf("unexpected error seeking: %s", err)
+			}
+			if c, _ := test.reader.Next(); c != test.exp[1] {
+				t.Errorf("unexpected char after seek:\nexp=%v\ngot=%v", test.exp[1], c)
+			}
+		})
+	}
+}
+
+func TestReaderTabWidth(t *testing.T) {
+	tests := []struct {
+		name   string
+		reader *Reader
+		exp    []Char
+	}{
+		{
+			name:   "tab stops",
+			reader: Builder{}.WithString("\ta\tbcd\t\n\tx").WithTabWidth(4).WithNormalizeNewline().Reader(),
+			exp: []Char{newChar('\t', 1, 1), newChar('a', 1, 5), newChar('\t', 1, 6), newChar('b', 1, 9),
+				newChar('c', 1, 10), newChar('d', 1, 11), newChar('\t', 1, 12), newChar('\n', 1, 13),
+				newChar('\t', 2, 1), newChar('x', 2, 5)},
+		},
+		{
+			name:   "zero based",
+			reader: Builder{}.WithString("a\tb").WithZeroBased().WithTabWidth(4).Reader(),
+			exp:    []Char{newChar('a', 0, 0), newChar('\t', 0, 1), newChar('b', 0, 4)},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var got []Char
+			for c, err := range test.reader.All() {
+				if err != nil {
+					t.Fatalf("unexpected error: %s", err)
+				}
+				got = append(got, c)
+			}
+			if !slices.Equal(got, test.exp) {
+				t.Errorf("unexpected chars:\nexp=%v\ngot=%v", test.exp, got)
+			}
+		})
+	}
+}
+
+func TestBuilder_TabWidthPanic(t *testing.T) {
+	defer func() { recover() }()
+	_ = Builder{}.WithSource(strings.NewReader("")).WithTabWidth(0)
+	t.Errorf("Builder.WithTabWidth should have raised a panic.")
+}
+
+func TestReaderColumnUnit_Graphemes(t *testing.T) {
+	reader := Builder{}.WithString("e\u0301x👨\u200D👩\u200D👧🇸🇪🇳o\u0308\u0308\r\u0301").
+		WithColumnUnit(ColumnGraphemes).WithNormalizeNewline().Reader()
+	var got []Char
+	for c, err := range reader.All() {
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		got = append(got, c)
+	}
+	exp := []Char{newChar('e', 1, 1), newChar('\u0301', 1, 1), newChar('x', 1, 2), newChar('👨', 1, 3),
+		newChar('\u200D', 1, 3), newChar('👩', 1, 3), newChar('\u200D', 1, 3), newChar('👧', 1, 3),
+		newChar('🇸', 1, 4), newChar('🇪', 1, 4), newChar('🇳', 1, 5), newChar('o', 1, 6), newChar('\u0308', 1, 6),
+		newChar('\u0308', 1, 6), newChar('\n', 1, 7), newChar('\u0301', 2, 1)}
+	if !slices.Equal(got, exp) {
+		t.Errorf("unexpected chars:\nexp=%v\ngot=%v", exp, got)
+	}
+}
+
+func TestReaderSpans(t *testing.T) {
+	spanChar := func(ru rune, row, col, endRow, endCol int) Char {
+		return Char{Rune: ru, Pos: Position{Row: row, Col: col}, End: Position{Row: endRow, Col: endCol}}
+	}
+	reader := Builder{}.WithString("a\\u0058\r\n&amp;b").WithUnicodeEscape().WithEntityDecode().
+		WithNormalizeNewline().WithSpans().Reader()
+	var got []Char
+	for c, err := range reader.All() {
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		got = append(got, c)
+	}
+	exp := []Char{spanChar('a', 1, 1, 1, 2), spanChar('X', 1, 2, 1, 8), spanChar('\n', 1, 8, 2, 1),
+		spanChar('&', 2, 1, 2, 6), spanChar('b', 2, 6, 2, 7)}
+	if !slices.Equal(got, exp) {
+		t.Errorf("unexpected chars:\nexp=%v\ngot=%v", exp, got)
+	}
+}
+
+func TestReaderLineDirectives(t *testing.T) {
+	fileChar := func(ru rune, file string, row, col int) Char {
+		return Char{Rune: ru, Pos: Position{Row: row, Col: col, File: file}}
+	}
+	reader := Builder{}.WithString("a\n//line gen.y:10:5\nb\n#line 20 \"x.c\"\nc\n#line 30\nd\n//linex\n#line x\n").
+		WithLineDirectives().WithNormalizeNewline().Reader()
+	var got []Char
+	var err error
+	for c, e := range reader.All() {
+		if e != nil {
+			err = e
+			break
+		}
+		got = append(got, c)
+	}
+	exp := []Char{fileChar('a', "", 1, 1), fileChar('\n', "", 1, 2), fileChar('b', "gen.y", 10, 5),
+		fileChar('\n', "gen.y", 10, 6), fileChar('c', "x.c", 20, 1), fileChar('\n', "x.c", 20, 2),
+		fileChar('d', "x.c", 30, 1), fileChar('\n', "x.c", 30, 2), fileChar('/', "x.c", 31, 1),
+		fileChar('/', "x.c", 31, 2), fileChar('l', "x.c", 31, 3), fileChar('i', "x.c", 31, 4),
+		fileChar('n', "x.c", 31, 5), fileChar('e', "x.c", 31, 6), fileChar('x', "x.c", 31, 7),
+		fileChar('\n', "x.c", 31, 8)}
+	if !slices.Equal(got, exp) {
+		t.Errorf("unexpected chars:\nexp=%v\ngot=%v", exp, got)
+	}
+	expErr := &FileError{File: "x.c", Err: genError(32, 1, fmt.Errorf("malformed line directive"))}
+	if !sameError(err, expErr) {
+		t.Errorf("unexpected error:\nexp=%v\ngot=%v", expErr, err)
+	}
+}
+
+func TestReaderLineDirectives_MidLine(t *testing.T) {
+	tests := []struct {
+		name   string
+		origin Position
+		reader *Reader
+	}{
+		{name: "one-based", origin: Position{Row: 1, Col: 1},
+			reader: Builder{}.WithString("x#line 10\nabc").WithLineDirectives().WithNormalizeNewline().Reader()},
+		{name: "zero-based", origin: Position{},
+			reader: Builder{}.WithString("x#line 10\nabc").WithLineDirectives().WithNormalizeNewline().
+				WithZeroBased().Reader()},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var got []Char
+			for c, err := range test.reader.All() {
+				if err != nil {
+					t.Fatalf("unexpected error: %s", err)
+				}
+				got = append(got, c)
+			}
+			// A directive in the middle of a line is not applied
+			if text := charsToString(got); text != "x#line 10\nabc" {
+				t.Errorf("unexpected text: %q", text)
+			}
+			exp := Position{Row: test.origin.Row + 1, Col: test.origin.Col + 2}
+			if pos := got[len(got)-1].Pos; pos != exp {
+				t.Errorf("unexpected position of last char:\nexp=%v\ngot=%v", exp, pos)
+			}
+		})
+	}
+}
+
+func TestReaderLine(t *testing.T) {
+	reader := Builder{}.WithString("a\\u0058\r\nbc\rd\ne").WithLineCache(2).WithUnicodeEscape().
+		WithNormalizeNewline().Reader()
+	for _, err := range reader.All() {
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+	tests := []struct {
+		row int
+		exp string
+		err bool
+	}{
+		{row: 1, err: true},
+		{row: 2, exp: "bc"},
+		{row: 3, exp: "d"},
+		{row: 4, exp: "e"},
+		{row: 5, err: true},
+	}
+	for _, test := range tests {
+		got, err := reader.Line(test.row)
+		if test.err != (err != nil) || got != test.exp {
+			t.Errorf("unexpected line %d: %q (error %v)", test.row, got, err)
+		}
+	}
+	if _, err := New(strings.NewReader("a")).Line(1); err == nil {
+		t.Errorf("expected error when lines are not cached")
+	}
+}
+
+func TestBuilder_LineCachePanic(t *testing.T) {
+	defer func() { recover() }()
+	_ = Builder{}.WithSource(strings.NewReader("")).WithLineCache(0)
+	t.Errorf("Builder.WithLineCache should have raised a panic.")
+}
+
+func TestFormatDiagnostic(t *testing.T) {
+	tests := []struct {
+		name string
+		d    Diagnostic
+		line string
+		exp  string
+	}{
+		{
+			name: "span",
+			d: Diagnostic{Pos: Position{Row: 2, Col: 5, File: "main.cfg"}, End: Position{Row: 2, Col: 9},
+				Message: "illegal escape"},
+			line: "x = \\u00",
+			exp:  "main.cfg:2/5: illegal escape\nx = \\u00\n    ^^^^",
+		},
+		{
+			name: "tabs",
+			d:    Diagnostic{Pos: Position{Row: 1, Col: 3}, Message: "unexpected 'x'"},
+			line: "\t\tx",
+			exp:  "1/3: unexpected 'x'\n\t\tx\n\t\t^",
+		},
+		{
+			name: "no line",
+			d:    Diagnostic{Pos: Position{Row: 1, Col: 3}, Message: "unexpected EOF"},
+			exp:  "1/3: unexpected EOF",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := FormatDiagnostic(test.d, test.line); got != test.exp {
+				t.Errorf("unexpected diagnostic:\nexp=%q\ngot=%q", test.exp, got)
+			}
+		})
+	}
+	reader := Builder{}.WithString("a\nb \\u0058c").WithLineCache(10).WithUnicodeEscape().WithNormalizeNewline().
+		WithSpans().Reader()
+	var c Char
+	for next := range reader.All() {
+		if next.Rune == 'X' {
+			c = next
+		}
+	}
+	exp := "2/3: unexpected 'X'\nb \\u0058c\n  ^^^^^^"
+	if got := reader.FormatDiagnostic(Diagnostic{Pos: c.Pos, End: c.End, Message: "unexpected 'X'"}); got != exp {
+		t.Errorf("unexpected diagnostic:\nexp=%q\ngot=%q", exp, got)
+	}
+}
+
+func TestReaderPositionalError(t *testing.T) {
+	reader := Builder{}.WithString("ab\\u00zz").WithFileName("main.cfg").WithUnicodeEscape().Reader()
+	var err error
+	for _, err = range reader.All() {
+		if err != nil {
+			break
+		}
+	}
+	var pe *PositionalError
+	if !errors.As(err, &pe) {
+		t.Fatalf("expected positional error, got %v", err)
+	}
+	expPos := Position{Row: 1, Col: 3, File: "main.cfg"}
+	expEnd := Position{Row: 1, Col: 9, File: "main.cfg"}
+	if pe.Pos != expPos || pe.End != expEnd {
+		t.Errorf("unexpected span:\nexp=%v-%v\ngot=%v-%v", expPos, expEnd, pe.Pos, pe.End)
+	}
+	if exp := genError(1, 3, pe.Err); !sameError(pe, exp) {
+		t.Errorf("unexpected error:\nexp=%v\ngot=%v", exp, pe)
+	}
+	exp := "main.cfg:1/3: " + pe.Err.Error() + "\nab\\u00zz\n  ^^^^^^"
+	if got := FormatDiagnostic(pe.Diagnostic(), "ab\\u00zz"); got != exp {
+		t.Errorf("unexpected diagnostic:\nexp=%q\ngot=%q", exp, got)
+	}
+}
+
+func TestReaderSentinelErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		reader *Reader
+		exp    error
+	}{
+		{name: "incomplete escape", reader: Builder{}.WithString(`a\u00`).WithUnicodeEscape().Reader(),
+			exp: ErrIncompleteEscape},
+		{name: "invalid escape", reader: Builder{}.WithString(`a\q`).WithStrictRuneEscape(nil).Reader(),
+			exp: ErrInvalidEscape},
+		{name: "unknown entity", reader: Builder{}.WithString(`&foo;`).WithEntityDecode().Reader(),
+			exp: ErrInvalidEscape},
+		{name: "invalid UTF-8", reader: Builder{}.WithString("a\xFF").WithInvalidUTF8Policy(InvalidUTF8Error).Reader(),
+			exp: ErrInvalidUTF8},
+		{name: "unterminated comment", reader: Builder{}.WithString("a/* x").WithCommentStrip("//", "/*", "*/").Reader(),
+			exp: ErrUnterminatedComment},
+		{name: "malformed directive", reader: Builder{}.WithString("#line x\n").WithLineDirectives().Reader(),
+			exp: ErrMalformedDirective},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var err error
+			for _, err = range test.reader.All() {
+				if err != nil {
+					break
+				}
+			}
+			if !errors.Is(err, test.exp) {
+				t.Errorf("unexpected error:\nexp=%v\ngot=%v", test.exp, err)
+			}
+		})
+	}
+	reader := NewFromString("a")
+	if _, err := reader.Expect('b'); !errors.Is(err, ErrUnexpectedRune) {
+		t.Errorf("unexpected error:\nexp=%v\ngot=%v", ErrUnexpectedRune, err)
+	}
+	if err := reader.Unconsume(); !errors.Is(err, ErrRollbackInvalid) {
+		t.Errorf("unexpected error:\nexp=%v\ngot=%v", ErrRollbackInvalid, err)
+	}
+	if _, err := reader.Peek(-1); !errors.Is(err, ErrInvalidArgument) ||
+		err.Error() != "illegal negative peek offset -1" {
+		t.Errorf("unexpected error:\nexp=%v\ngot=%v", ErrInvalidArgument, err)
+	}
+	if _, err := reader.Window(-1); !errors.Is(err, ErrInvalidArgument) ||
+		err.Error() != "illegal negative window size -1" {
+		t.Errorf("unexpected error:\nexp=%v\ngot=%v", ErrInvalidArgument, err)
+	}
+	if err := reader.ResetTo("m"); !errors.Is(err, ErrUnknownMark) || err.Error() != `unknown mark "m"` {
+		t.Errorf("unexpected error:\nexp=%v\ngot=%v", ErrUnknownMark, err)
+	}
+	if err := reader.Release("m"); !errors.Is(err, ErrUnknownMark) || err.Error() != `unknown mark "m"` {
+		t.Errorf("unexpected error:\nexp=%v\ngot=%v", ErrUnknownMark, err)
+	}
+	if err := reader.DisableTransformer("escape"); !errors.Is(err, ErrUnknownTransformer) ||
+		err.Error() != `unknown transformer "escape"` {
+		t.Errorf("unexpected error:\nexp=%v\ngot=%v", ErrUnknownTransformer, err)
+	}
+	if _, err := reader.Line(1); !errors.Is(err, ErrNotAvailable) {
+		t.Errorf("unexpected error:\nexp=%v\ngot=%v", ErrNotAvailable, err)
+	}
+	if _, _, err := reader.SourceRange(Position{Row: 1, Col: 1}); !errors.Is(err, ErrNotAvailable) {
+		t.Errorf("unexpected error:\nexp=%v\ngot=%v", ErrNotAvailable, err)
+	}
+	if err := New(bytes.NewBufferString("a")).Seek(Position{Row: 1, Col: 1}); !errors.Is(err, ErrInvalidSeek) {
+		t.Errorf("unexpected error:\nexp=%v\ngot=%v", ErrInvalidSeek, err)
+	}
+	failing := New(&errorReader{Input: "a"})
+	_, _ = failing.Next()
+	failing.Consume()
+	if _, err := failing.Next(); !errors.Is(err, ErrErrorState) || !errors.Is(failing.Err(), ErrErrorState) {
+		t.Errorf("unexpected error:\nexp=%v\ngot=%v", ErrErrorState, err)
+	}
+}
+
+func TestReaderErrorRecovery(t *testing.T) {
+	tests := []struct {
+		name     string
+		recovery ErrorRecovery
+		exp      string
+	}{
+		{name: "skip", recovery: RecoverSkip, exp: "a!A"},
+		{name: "raw", recovery: RecoverRaw, exp: "a!\\u00zzA"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			reader := Builder{}.WithString(`a\u00zz\u0041`).WithUnicodeEscape().
+				WithErrorRecovery(test.recovery).Reader()
+			var got strings.Builder
+			for {
+				c, err := reader.Next()
+				if errors.Is(err, io.EOF) {
+					break
+				}
+				if err != nil {
+					if !errors.Is(err, ErrInvalidEscape) {
+						t.Fatalf("unexpected error: %s", err)
+					}
+					got.WriteRune('!')
+					continue
+				}
+				got.WriteRune(c.Rune)
+				reader.Consume()
+			}
+			if got.String() != test.exp {
+				t.Errorf("unexpected runes:\nexp=%q\ngot=%q", test.exp, got.String())
+			}
+		})
+	}
+}
+
+func TestReaderErrorRecovery_BraceEscape(t *testing.T) {
+	tests := []struct {
+		name     string
+		recovery ErrorRecovery
+		exp      string
+	}{
+		{name: "skip", recovery: RecoverSkip, exp: `"! oops" x = 1; y = "}" z`},
+		{name: "raw", recovery: RecoverRaw, exp: `"!\u{12 oops" x = 1; y = "}" z`},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			reader := Builder{}.WithString(`"\u{12 oops" x = 1; y = "}" z`).WithUnicodeBraceEscape().
+				WithErrorRecovery(test.recovery).Reader()
+			var got strings.Builder
+			for {
+				c, err := reader.Next()
+				if errors.Is(err, io.EOF) {
+					break
+				}
+				if err != nil {
+					if !errors.Is(err, ErrInvalidEscape) {
+						t.Fatalf("unexpected error: %s", err)
+					}
+					got.WriteRune('!')
+					continue
+				}
+				got.WriteRune(c.Rune)
+				reader.Consume()
+			}
+			if got.String() != test.exp {
+				t.Errorf("unexpected runes:\nexp=%q\ngot=%q", test.exp, got.String())
+			}
+		})
+	}
+}
+
+func TestReaderErr(t *testing.T) {
+	reader := Builder{}.WithSource(&errorReader{Input: "ab"}).Reader()
+	if err := reader.Skip(2); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err := reader.Err(); err != nil {
+		t.Fatalf("unexpected error state: %s", err)
+	}
+	_, err := reader.Next()
+	if exp := genError(1, 3, fmt.Errorf("error reading rune from source: %w", errorReaderError)); !sameError(err, exp) {
+		t.Fatalf("unexpected error:\nexp=%v\ngot=%v", exp, err)
+	}
+	if reader.Err() != err {
+		t.Errorf("unexpected error state:\nexp=%v\ngot=%v", err, reader.Err())
+	}
+	// Invalid UTF-8, transformer errors and EOF don't put the Reader in an error state
+	reader = Builder{}.WithString("\xff\\u00zz").WithInvalidUTF8Policy(InvalidUTF8Error).WithUnicodeEscape().Reader()
+	for {
+		_, err := reader.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err == nil {
+			reader.Consume()
+		}
+		if reader.Err() != nil {
+			t.Fatalf("unexpected error state: %s", reader.Err())
+		}
+	}
+}
+
+func TestReaderErrorLimit(t *testing.T) {
+	reader := Builder{}.WithString(`a\u00zzb\u00zzc\u00zzd`).WithUnicodeEscape().WithErrorLimit(2).Reader()
+	var got strings.Builder
+	var errs []error
+	for {
+		c, err := reader.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		got.WriteRune(c.Rune)
+		reader.Consume()
+	}
+	if got.String() != "abcd" {
+		t.Errorf("unexpected runes: %q", got.String())
+	}
+	exp := genError(1, 16, errors.New(`error parsing unicode escaped rune '\u00zz': invalid syntax`))
+	if len(errs) != 1 || !sameError(errs[0], exp) {
+		t.Errorf("unexpected returned errors: %v", errs)
+	}
+	collected := reader.Errors()
+	if len(collected) != 2 {
+		t.Fatalf("unexpected number of collected errors: %d", len(collected))
+	}
+	for i, col := range []int{2, 9} {
+		var pe *PositionalError
+		if !errors.As(collected[i], &pe) || !errors.Is(collected[i], ErrInvalidEscape) ||
+			pe.Pos != (Position{Row: 1, Col: col}) {
+			t.Errorf("unexpected collected error %d: %v", i, collected[i])
+		}
+	}
+}
+
+func TestBuilder_ErrorLimitPanic(t *testing.T) {
+	defer func() { recover() }()
+	_ = Builder{}.WithErrorLimit(0)
+	t.Errorf("Builder.WithErrorLimit should have raised a panic.")
+}
+
+func TestReaderWarningHandler(t *testing.T) {
+	type warning struct {
+		pos  Position
+		kind error
+	}
+	tests := []struct {
+		name    string
+		builder Builder
+		exp     []warning
+	}{
+		{
+			name:    "anomalies",
+			builder: Builder{}.WithString("a\r\nb\n\uFEFFc\xffd\uFFFD").WithNormalizeNewline(),
+			exp: []warning{
+				{pos: Position{Row: 2, Col: 2}, kind: ErrMixedLineEndings},
+				{pos: Position{Row: 3, Col: 1}, kind: ErrUnexpectedBOM},
+				{pos: Position{Row: 3, Col: 3}, kind: ErrInvalidUTF8},
+				{pos: Position{Row: 3, Col: 5}, kind: ErrReplacementCharacter},
+			},
+		},
+		{
+			name:    "lone CR",
+			builder: Builder{}.WithString("a\nb\rc\r\rd").WithNewlinePolicy(NewlinePolicyAll),
+			exp: []warning{
+				{pos: Position{Row: 2, Col: 2}, kind: ErrMixedLineEndings},
+				{pos: Position{Row: 3, Col: 2}, kind: ErrMixedLineEndings},
+				{pos: Position{Row: 4, Col: 1}, kind: ErrMixedLineEndings},
+			},
+		},
+		{
+			name:    "skipped byte",
+			builder: Builder{}.WithString("\uFEFFa\xffb").WithInvalidUTF8Policy(InvalidUTF8Skip),
+			exp: []warning{
+				{pos: Position{Row: 1, Col: 3}, kind: ErrInvalidUTF8},
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var got []warning
+			reader := test.builder.WithWarningHandler(func(pos Position, err error) {
+				for _, kind := range []error{ErrMixedLineEndings, ErrUnexpectedBOM, ErrInvalidUTF8,
+					ErrReplacementCharacter} {
+					if errors.Is(err, kind) {
+						got = append(got, warning{pos: pos, kind: kind})
+					}
+				}
+			}).Reader()
+			for _, err := range reader.All() {
+				if err != nil {
+					t.Fatalf("unexpected error: %s", err)
+				}
+			}
+			if !slices.Equal(got, test.exp) {
+				t.Errorf("unexpected warnings:\nexp=%v\ngot=%v", test.exp, got)
+			}
+		})
+	}
+}
+
+func TestPosition_Compare(t *testing.T) {
+	tests := []struct {
+		p1, p2 Position
+		exp    int
+	}{
+		{p1: Position{Row: 1, Col: 1}, p2: Position{Row: 1, Col: 1}, exp: 0},
+		{p1: Position{Row: 1, Col: 1}, p2: Position{Row: 1, Col: 2}, exp: -1},
+		{p1: Position{Row: 1, Col: 9}, p2: Position{Row: 2, Col: 1}, exp: -1},
+		{p1: Position{Row: 2, Col: 1}, p2: Position{Row: 1, Col: 9}, exp: +1},
+		{p1: Position{Row: 3, Col: 4}, p2: Position{Row: 3, Col: 2}, exp: +1},
+		{p1: Position{Row: 3, Col: 4, File: "a", Offset: 7}, p2: Position{Row: 3, Col: 4, File: "b"}, exp: 0},
+	}
+	for _, test := range tests {
+		if got := test.p1.Compare(test.p2); got != test.exp {
+			t.Errorf("%v.Compare(%v): exp=%d, got=%d", test.p1, test.p2, test.exp, got)
+		}
+		if got := test.p1.Before(test.p2); got != (test.exp < 0) {
+			t.Errorf("%v.Before(%v): got=%t", test.p1, test.p2, got)
+		}
+		if got := test.p1.After(test.p2); got != (test.exp > 0) {
+			t.Errorf("%v.After(%v): got=%t", test.p1, test.p2, got)
+		}
+	}
+}
+
+func TestSpan(t *testing.T) {
+	span := Span{Start: Position{Row: 1, Col: 5}, End: Position{Row: 2, Col: 3}}
+	empty := Span{Start: Position{Row: 1, Col: 7}, End: Position{Row: 1, Col: 7}}
+	for _, test := range []struct {
+		pos Position
+		exp bool
+	}{
+		{pos: Position{Row: 1, Col: 4}, exp: false},
+		{pos: Position{Row: 1, Col: 5}, exp: true},
+		{pos: Position{Row: 1, Col: 80}, exp: true},
+		{pos: Position{Row: 2, Col: 2}, exp: true},
+		{pos: Position{Row: 2, Col: 3}, exp: false},
+	} {
+		if got := span.Contains(test.pos); got != test.exp {
+			t.Errorf("Contains(%v): exp=%t, got=%t", test.pos, test.exp, got)
+		}
+	}
+	if empty.Contains(empty.Start) {
+		t.Errorf("empty span should not contain any position")
+	}
+	for _, test := range []struct {
+		other Span
+		exp   bool
+	}{
+		{other: Span{Start: Position{Row: 1, Col: 1}, End: Position{Row: 1, Col: 5}}, exp: false},
+		{other: Span{Start: Position{Row: 1, Col: 1}, End: Position{Row: 1, Col: 6}}, exp: true},
+		{other: Span{Start: Position{Row: 2, Col: 2}, End: Position{Row: 3, Col: 1}}, exp: true},
+		{other: Span{Start: Position{Row: 2, Col: 3}, End: Position{Row: 3, Col: 1}}, exp: false},
+		{other: span, exp: true},
+		{other: empty, exp: false},
+	} {
+		if got := span.Overlap(test.other); got != test.exp {
+			t.Errorf("Overlap(%v): exp=%t, got=%t", test.other, test.exp, got)
+		}
+		if got := test.other.Overlap(span); got != test.exp {
+			t.Errorf("reversed Overlap(%v): exp=%t, got=%t", test.other, test.exp, got)
+		}
+	}
+}
+
+func TestReaderCaptureSince(t *testing.T) {
+	reader := Builder{}.WithString("ab cd").Reader()
+	if err := reader.Skip(1); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	state := reader.State()
+	if cs, text := reader.CaptureSince(state); len(cs) != 0 || text != "" {
+		t.Errorf("unexpected capture before consuming: %v %q", cs, text)
+	}
+	if err := reader.Skip(2); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	cs, text := reader.CaptureSince(state)
+	if exp := []Char{newChar('b', 1, 2), newChar(' ', 1, 3)}; !slices.Equal(cs, exp) || text != "b " {
+		t.Errorf("unexpected capture:\nexp=%v\ngot=%v %q", exp, cs, text)
+	}
+	// The read state is not changed by a capture
+	if c, err := reader.Next(); err != nil || c != newChar('c', 1, 4) {
+		t.Errorf("unexpected next char: %v (%v)", c, err)
+	}
+	if err := reader.Unconsume(); err != nil {
+		t.Errorf("unexpected unconsume error: %s", err)
+	}
+	if c, err := reader.Next(); err != nil || c != newChar(' ', 1, 3) {
+		t.Errorf("unexpected next char after unconsume: %v (%v)", c, err)
+	}
+	// Capture using a zero state
+	if cs, text := reader.CaptureSince(State{}); cs != nil || text != "" {
+		t.Errorf("unexpected capture using zero state: %v %q", cs, text)
+	}
+}
+
+func TestReaderLexeme(t *testing.T) {
+	reader := Builder{}.WithString("foo = 12;").WithNewlinePolicy(NewlinePolicyAll).Reader()
+	if lexeme := reader.EndLexeme(); lexeme != (Lexeme{Span: Span{Start: Position{Row: 1, Col: 1},
+		End: Position{Row: 1, Col: 1}}}) {
+		t.Errorf("unexpected lexeme when not started: %v", lexeme)
+	}
+	reader.StartLexeme()
+	if _, err := reader.ReadWhile(unicode.IsLetter); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	exp := Lexeme{Text: "foo", Span: Span{Start: Position{Row: 1, Col: 1}, End: Position{Row: 1, Col: 4}}}
+	if lexeme := reader.EndLexeme(); lexeme != exp {
+		t.Errorf("unexpected lexeme:\nexp=%v\ngot=%v", exp, lexeme)
+	}
+	// Runes consumed when no lexeme is started are not captured and a rollback removes runes from the lexeme
+	if err := reader.Skip(3); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	reader.StartLexeme()
+	if err := reader.Skip(1); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	state := reader.State()
+	if err := reader.Skip(2); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err := reader.Rollback(state); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err := reader.Skip(1); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	exp = Lexeme{Text: "12", Span: Span{Start: Position{Row: 1, Col: 7}, End: Position{Row: 1, Col: 9}}}
+	if lexeme := reader.EndLexeme(); lexeme != exp {
+		t.Errorf("unexpected lexeme:\nexp=%v\ngot=%v", exp, lexeme)
+	}
+}
+
+func TestReaderSourceMap(t *testing.T) {
+	src := "a\\u00e9\r\nb"
+	reader := Builder{}.WithString(src).WithUnicodeEscape().WithNormalizeNewline().WithSourceMap().Reader()
+	var got []string
+	for c, err := range reader.All() {
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		start, end, err := reader.SourceRange(c.Pos)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		got = append(got, src[start:end])
+	}
+	if exp := []string{"a", `\u00e9`, "\r\n", "b"}; !slices.Equal(got, exp) {
+		t.Errorf("unexpected source text:\nexp=%q\ngot=%q", exp, got)
+	}
+	if _, _, err := reader.SourceRange(Position{Row: 1, Col: 3}); err == nil {
+		t.Errorf("expected an error for a position not of a read Char")
+	}
+	reader = NewFromString("a")
+	if _, err := reader.Next(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if _, _, err := reader.SourceRange(Position{Row: 1, Col: 1}); err == nil {
+		t.Errorf("expected an error when no source map is recorded")
+	}
+}
+
+func TestReaderStats(t *testing.T) {
+	reader := Builder{}.WithString("a\\tb\nc\xff").WithRuneEscape(nil).WithNewlinePolicy(NewlinePolicyAll).Reader()
+	if got := reader.Stats(); got != (Stats{}) {
+		t.Errorf("unexpected stats before reading: %+v", got)
+	}
+	if _, err := reader.Peek(1); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	// The plain rune 'b' following the escape sequence is buffered in the same batch
+	exp := Stats{RunesRead: 4, BytesRead: 4, Rows: 1, Escapes: 1, Buffered: 3}
+	if got := reader.Stats(); got != exp {
+		t.Errorf("unexpected stats after peek:\nexp=%+v\ngot=%+v", exp, got)
+	}
+	state := reader.State()
+	for _, err := range reader.All() {
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+	exp = Stats{RunesRead: 7, RunesConsumed: 6, BytesRead: 7, Rows: 2, Escapes: 1}
+	if got := reader.Stats(); got != exp {
+		t.Errorf("unexpected stats after reading:\nexp=%+v\ngot=%+v", exp, got)
+	}
+	// Chars unread by a rollback are not counted as consumed
+	if err := reader.Rollback(state); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	exp = Stats{RunesRead: 7, BytesRead: 7, Rows: 2, Escapes: 1, Buffered: 6}
+	if got := reader.Stats(); got != exp {
+		t.Errorf("unexpected stats after rollback:\nexp=%+v\ngot=%+v", exp, got)
+	}
+}
+
+func TestReaderProgress(t *testing.T) {
+	var got [][2]int64
+	reader := Builder{}.WithString("abcdefghij").WithProgress(4, func(read, total int64) {
+		got = append(got, [2]int64{read, total})
+	}).Reader()
+	if read, total := reader.Progress(); read != 0 || total != 10 {
+		t.Errorf("unexpected progress before reading: %d/%d", read, total)
+	}
+	for _, err := range reader.All() {
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+	if exp := [][2]int64{{4, 10}, {8, 10}, {10, 10}}; !slices.Equal(got, exp) {
+		t.Errorf("unexpected progress reports:\nexp=%v\ngot=%v", exp, got)
+	}
+	// The size of a source not seekable is unknown
+	reader = Builder{}.WithSource(bytes.NewBufferString("ab")).Reader()
+	if err := reader.Skip(2); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if read, total := reader.Progress(); read != 2 || total != -1 {
+		t.Errorf("unexpected progress of source not seekable: %d/%d", read, total)
+	}
+}
+
+func TestBuilder_ProgressPanic(t *testing.T) {
+	defer func() { recover() }()
+	_ = Builder{}.WithString("a").WithProgress(0, func(int64, int64) {})
+	t.Errorf("Builder.WithProgress should have raised a panic.")
+}
+
+func TestReaderCommit_NoAllocs(t *testing.T) {
+	reader := Builder{}.WithString(strings.Repeat("hello world\n", 100)).WithSize(10, 2).Reader()
+	// Grow the buffer to hold the Chars read between commits
+	if _, err := reader.Peek(5); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	allocs := testing.AllocsPerRun(1000, func() {
+		if _, err := reader.Next(); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		reader.Consume()
+		reader.Commit()
+	})
+	if allocs != 0 {
+		t.Errorf("unexpected number of allocations per read rune: %v", allocs)
+	}
+	// The last consumed Char is not removed by a commit
+	if err := reader.Unconsume(); err != nil {
+		t.Errorf("unexpected error unconsuming after commit: %s", err)
+	}
+}
+
+func TestReaderBatch(t *testing.T) {
+	tests := []struct {
+		name   string
+		reader *Reader
+		exp    int
+	}{
+		{name: "in-memory source", reader: NewFromString(strings.Repeat("a", 100)), exp: runeBatchSize},
+		{name: "short source", reader: NewFromString("abcdefgh"), exp: 5},
+		{name: "ascii transformers", reader: Builder{}.WithString("abcdefgh").WithNormalizeNewline().Reader(), exp: 5},
+		{name: "escape rune", reader: Builder{}.WithString("ab\\ncdefgh").WithRuneEscape(nil).Reader(), exp: 2},
+		{name: "transformers", reader: Builder{}.WithString("abcdefgh").WithTypographicNormalization().Reader(), exp: 1},
+		{name: "unbuffered source", reader: New(iotest.OneByteReader(strings.NewReader("abcdefgh"))), exp: 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := test.reader.Next(); err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if got := test.reader.Stats().Buffered; got != test.exp {
+				t.Errorf("unexpected number of buffered Chars: exp=%d, got=%d", test.exp, got)
+			}
+		})
+	}
+}
+
+func TestReaderASCIIFastPath(t *testing.T) {
+	source := strings.Repeat("plain text \\u0041\\t&amp; \u00e9\r\nrow ", 20)
+	build := func(src io.Reader) *Reader {
+		return Builder{}.WithSource(src).WithUnicodeEscape().WithRuneEscape(nil).WithEntityDecode().
+			WithNormalizeNewline().WithRawText().Reader()
+	}
+	// Plain runes read in batches should be read as when read one at a time by the transformers
+	var exp, got []Char
+	for c, err := range build(iotest.OneByteReader(strings.NewReader(source))).All() {
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		exp = append(exp, c)
+	}
+	reader := build(strings.NewReader(source))
+	if _, err := reader.Next(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if n := reader.Stats().Buffered; n <= 1 {
+		t.Errorf("expected plain runes to be buffered in a batch (buffered Chars: %d)", n)
+	}
+	for c, err := range reader.All() {
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		got = append(got, c)
+	}
+	if !slices.Equal(got, exp) {
+		t.Errorf("unexpected chars:\nexp=%v\ngot=%v", exp, got)
+	}
+}
+
+func TestTransformFuncOf(t *testing.T) {
+	source := "a\\u0041\\x42''&#67;\\t\u00A0\u0430\r\nb\\"
+	build := func() *Reader {
+		return Builder{}.WithString(source).WithNormalizeNewline().WithUnicodeEscape().WithHexEscape(HexEscapeLatin1).
+			WithDoubledEscape('\'').WithYAMLEscape().WithCharRefDecode().WithSpaceNormalization(nil).
+			WithConfusables(LatinConfusables, nil).WithMapFunc(unicode.ToUpper).WithErrorRecovery(RecoverRaw).Reader()
+	}
+	read := func(reader *Reader) (chars []Char, errs []string) {
+		for {
+			c, err := reader.Next()
+			if errors.Is(err, io.EOF) {
+				return
+			}
+			if err != nil {
+				errs = append(errs, err.Error())
+				continue
+			}
+			chars = append(chars, c)
+			reader.Consume()
+		}
+	}
+	// The resolved transform functions should behave as the transformers applied through the transformer interface
+	generic := build()
+	for i := range generic.transformers {
+		generic.transformers[i].apply = generic.transformers[i].transform
+	}
+	expChars, expErrs := read(generic)
+	gotChars, gotErrs := read(build())
+	if !slices.Equal(gotChars, expChars) {
+		t.Errorf("unexpected chars:\nexp=%v\ngot=%v", expChars, gotChars)
+	}
+	if !slices.Equal(gotErrs, expErrs) {
+		t.Errorf("unexpected errors:\nexp=%v\ngot=%v", expErrs, gotErrs)
+	}
+	if len(expErrs) == 0 {
+		t.Errorf("expected the source to fail the escape transformers")
+	}
+}
+
+func BenchmarkReader_Transformers(b *testing.B) {
+	source := strings.Repeat("åäö text \\u00e9\\t &#38; row\r\n", 1000)
+	for range b.N {
+		reader := Builder{}.WithString(source).WithNormalizeNewline().WithUnicodeEscape().WithRuneEscape(nil).
+			WithCharRefDecode().WithTypographicNormalization().Reader()
+		for {
+			if _, err := reader.Next(); err != nil {
+				break
+			}
+			reader.Consume()
+			reader.Commit()
+		}
+	}
+}
+
+func TestReaderMatchRegexp_Longest(t *testing.T) {
+	re := regexp.MustCompile(`a|ab`)
+	reader := NewFromString("abcabcabc")
+	cs, err := reader.MatchRegexp(re)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if got := charsToString(cs); got != "a" {
+		t.Errorf("unexpected leftmost-first match: %q", got)
+	}
+	reader.Consume()
+	reader.Consume()
+	cs, err = reader.MatchRegexpLongest(re)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if got := charsToString(cs); got != "ab" {
+		t.Errorf("unexpected leftmost-longest match: %q", got)
+	}
+	reader.Consume()
+	// The leftmost-longest match must not change the cached leftmost-first regular expression
+	cs, err = reader.MatchRegexp(re)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if got := charsToString(cs); got != "a" {
+		t.Errorf("unexpected leftmost-first match: %q", got)
+	}
+	if got := re.FindString("ab"); got != "a" {
+		t.Errorf("unexpected change of the provided regular expression: %q", got)
+	}
+}
+
+func TestReaderCharset(t *testing.T) {
+	reader := Builder{}.WithSource(strings.NewReader("a\xE9\x80")).WithCharset("windows-1252").Reader()
+	var got []Char
+	for c, err := range reader.All() {
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		got = append(got, c)
+	}
+	exp := []Char{newChar('a', 1, 1), newChar('é', 1, 2), newChar('€', 1, 3)}
+	if !slices.Equal(got, exp) {
+		t.Errorf("unexpected chars:\nexp=%v\ngot=%v", exp, got)
+	}
+}
+
+func TestReaderCharset_Unknown(t *testing.T) {
+	reader := Builder{}.WithSource(strings.NewReader("a")).WithCharset("unknown").Reader()
+	_, err := reader.Next()
+	if err == nil || !strings.Contains(err.Error(), `unknown charset "unknown"`) {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestReaderAll(t *testing.T) {
+	reader := New(strings.NewReader("abcd"))
+	var got []Char
+	for c, err := range reader.All() {
+		if err != nil {
+			t.Errorf("unexpected error from all: %v", err)
+			return
+		}
+		got = append(got, c)
+		if c.Rune == 'c' {
+			break
+		}
+	}
+	exp := []Char{newChar('a', 1, 1), newChar('b', 1, 2), newChar('c', 1, 3)}
+	if !slices.Equal(got, exp) {
+		t.Errorf("unexpected chars from all:\nexp=%v\ngot=%v", exp, got)
+	}
+	got = slices.Collect(func(yield func(Char) bool) {
+		for c := range reader.All() {
+			if !yield(c) {
+				return
+			}
+		}
+	})
+	exp = []Char{newChar('d', 1, 4)}
+	if !slices.Equal(got, exp) {
+		t.Errorf("unexpected chars from all:\nexp=%v\ngot=%v", exp, got)
+	}
+}
+
+func TestReaderAll_Error(t *testing.T) {
+	reader := New(&errorReader{Input: "a"})
+	var errs []error
+	for _, err := range reader.All() {
+		errs = append(errs, err)
+	}
+	exp := []error{nil, genError(1, 2, fmt.Errorf("error reading rune from source: %w", errorReaderError))}
+	if !slices.EqualFunc(errs, exp, sameError) {
+		t.Errorf("unexpected errors from all:\nexp=%v\ngot=%v", exp, errs)
+	}
+}
+
+func TestReaderLines(t *testing.T) {
+	tests := []struct {
+		name   string
+		reader *Reader
+		exp    []Line
+	}{
+		{
+			name:   "line endings",
+			reader: New(strings.NewReader("ab\n\nc\rd\r\ne")),
+			exp: []Line{
+				{Chars: []Char{newChar('a', 1, 1), newChar('b', 1, 2)}, Text: "ab", Row: 1, Ending: LF},
+				{Text: "", Row: 1, Ending: LF},
+				{Chars: []Char{newChar('c', 1, 5)}, Text: "c", Row: 1, Ending: CR},
+				{Chars: []Char{newChar('d', 1, 7)}, Text: "d", Row: 1, Ending: CRLF},
+				{Chars: []Char{newChar('e', 1, 10)}, Text: "e", Row: 1, Ending: NoLineEnding},
+			},
+		},
+		{
+			name:   "normalized newline",
+			reader: Builder{}.WithSource(strings.NewReader("ab\r\n\rc\n")).WithNormalizeNewline().Reader(),
+			exp: []Line{
+				{Chars: []Char{newChar('a', 1, 1), newChar('b', 1, 2)}, Text: "ab", Row: 1, Ending: LF},
+				{Text: "", Row: 2, Ending: LF},
+				{Chars: []Char{newChar('c', 3, 1)}, Text: "c", Row: 3, Ending: LF},
+			},
+		},
+		{
+			name:   "empty",
+			reader: New(strings.NewReader("")),
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var got []Line
+			for line, err := range test.reader.Lines() {
+				if err != nil {
+					t.Errorf("unexpected error from lines: %v", err)
+					return
+				}
+				got = append(got, line)
+			}
+			if !slices.EqualFunc(got, test.exp, func(l1, l2 Line) bool {
+				return slices.Equal(l1.Chars, l2.Chars) && l1.Text == l2.Text && l1.Row == l2.Row &&
+					l1.Ending == l2.Ending
+			}) {
+				t.Errorf("unexpected lines:\nexp=%v\ngot=%v", test.exp, got)
+			}
+		})
+	}
+}
+
+func TestReader(t *testing.T) {
+	tests := []struct {
+		name   string
+		reader *Reader
+		ops    []any
+	}{
+		{
+			name:   "multiple next and single consume",
+			reader: Builder{}.WithSource(strings.NewReader("a")).Reader(),
+			ops: []any{
+				opNext[Char]{newChar('a', 1, 1)},
+				opNext[Char]{newChar('a', 1, 1)},
+				opNext[Char]{newChar('a', 1, 1)},
+				opConsume{},
+				opEOF{},
+			},
+		},
+		{
+			name:   "multiple EOF at end",
+			reader: Builder{}.WithSource(strings.NewReader("a")).Reader(),
+			ops: []any{
+				opNextAndConsume[Char]{newChar('a', 1, 1)},
+				opEOF{},
+				opEOF{},
+				opEOF{},
+			},
+		},
+		{
+			name:   "multiple next and consume",
+			reader: Builder{}.WithSource(strings.NewReader("abc")).Reader(),
+			ops: []any{
+				opNext[Char]{newChar('a', 1, 1)},
+				opNext[Char]{newChar('a', 1, 1)},
+				opConsume{},
+				opNext[Char]{newChar('b', 1, 2)},
+				opConsume{},
+				opNext[Char]{newChar('c', 1, 3)},
+				opNext[Char]{newChar('c', 1, 3)},
+				opConsume{},
+				opEOF{},
+			},
+		},
+		{
+			name:   "pos",
+			reader: Builder{}.WithSource(strings.NewReader("ab\nc")).WithNormalizeNewline().Reader(),
+			ops: []any{
+				opPos{Pos: Position{Row: 1, Col: 1}},
+				opNext[Char]{newChar('a', 1, 1)},
+				opPos{Pos: Position{Row: 1, Col: 1}},
+				opConsume{},
+				opPos{Pos: Position{Row: 1, Col: 2}},
+				opNext[Char]{newChar('b', 1, 2)},
+				opConsume{},
+				opPos{Pos: Position{Row: 1, Col: 3}},
+				opNext[Char]{newChar('\n', 1, 3)},
+				opConsume{},
+				opPos{Pos: Position{Row: 2, Col: 1}},
+				opNext[Char]{newChar('c', 2, 1)},
+				opPos{Pos: Position{Row: 2, Col: 1}},
+				opConsume{},
+				opEOF{},
+			},
+		},
+		{
+			name: "pos rollback",
+			reader: Builder{}.WithSource(strings.NewReader("a\r\nb\\u0063d")).WithNormalizeNewline().
+				WithUnicodeEscape().Reader(),
+			ops: []any{
+				opNextAndConsume[Char]{newChar('a', 1, 1)},
+				opState{},
+				opPos{Pos: Position{Row: 1, Col: 2}},
+				opPeek{N: 3, Exp: newChar('d', 2, 8)},
+				opPos{Pos: Position{Row: 1, Col: 2}},
+				opSkip{N: 3},
+				opPos{Pos: Position{Row: 2, Col: 8}},
+				opRollback{},
+				opPos{Pos: Position{Row: 1, Col: 2}},
+				opNextAndConsume[Char]{newChar('\n', 1, 2)},
+				opPos{Pos: Position{Row: 2, Col: 1}},
+			},
+		},
+		{
+			name:   "repeating EOF",
+			reader: Builder{}.WithSource(strings.NewReader("a")).Reader(),
+			ops: []any{
+				opNextAndConsume[Char]{newChar('a', 1, 1)},
+				opEOF{},
+				opEOF{},
+				opEOF{},
+			},
+		},
+		{
+			name:   "error from internal reader",
+			reader: Builder{}.WithSource(&errorReader{Input: "ab"}).Reader(),
+			ops: []any{
+				opNextAndConsume[Char]{newChar('a', 1, 1)},
+				opNextAndConsume[Char]{newChar('b', 1, 2)},
+				opNextErr[Char]{Err: genError(1, 3, fmt.Errorf("error reading rune from source: %w", errorReaderError))},
+				opNextErr[Char]{Err: genError(1, 3, fmt.Errorf("error reading rune from source: %w", errorReaderError))},
+				opNextErr[Char]{Err: genError(1, 3, fmt.Errorf("error reading rune from source: %w", errorReaderError))},
+			},
+		},
+		{
+			name:   "invalid UTF-8 replace",
+			reader: Builder{}.WithSource(strings.NewReader("a\xffb\uFFFD")).Reader(),
+			ops: []any{
+				opNextAndConsume[Char]{newChar('a', 1, 1)},
+				opNextAndConsume[Char]{newChar('\uFFFD', 1, 2)},
+				opNextAndConsume[Char]{newChar('b', 1, 3)},
+				opNextAndConsume[Char]{newChar('\uFFFD', 1, 4)},
+				opEOF{},
+			},
+		},
+		{
+			name:   "invalid UTF-8 error",
+			reader: Builder{}.WithSource(strings.NewReader("a\xffb\uFFFD")).WithInvalidUTF8Policy(InvalidUTF8Error).Reader(),
+			ops: []any{
+				opNextAndConsume[Char]{newChar('a', 1, 1)},
+				opNextErr[Char]{Err: genError(1, 2, errors.New("error reading rune from source: invalid UTF-8 encoded byte 0xFF"))},
+				opNextAndConsume[Char]{newChar('b', 1, 3)},
+				opNextAndConsume[Char]{newChar('\uFFFD', 1, 4)},
+				opEOF{},
+			},
+		},
+		{
+			name:   "invalid UTF-8 skip",
+			reader: Builder{}.WithSource(strings.NewReader("a\xff\xfeb\uFFFD")).WithInvalidUTF8Policy(InvalidUTF8Skip).Reader(),
+			ops: []any{
+				opNextAndConsume[Char]{newChar('a', 1, 1)},
+				opNextAndConsume[Char]{newChar('b', 1, 2)},
+				opNextAndConsume[Char]{newChar('\uFFFD', 1, 3)},
+				opEOF{},
+			},
+		},
+		{
+			name:   "state and rollback",
+			reader: Builder{}.WithSource(strings.NewReader("abcd")).Reader(),
+			ops: []any{
+				opNextAndConsume[Char]{newChar('a', 1, 1)},
+				opState{},
+				opNextAndConsume[Char]{newChar('b', 1, 2)},
+				opNextAndConsume[Char]{newChar('c', 1, 3)},
+				opRollback{},
+				opNextAndConsume[Char]{newChar('b', 1, 2)},
+				opNextAndConsume[Char]{newChar('c', 1, 3)},
+				opNextAndConsume[Char]{newChar('d', 1, 4)},
+				opEOF{},
+			},
+		},
+		{
+			name:   "state and rollback after EOF",
+			reader: Builder{}.WithSource(strings.NewReader("abc")).Reader(),
+			ops: []any{
+				opNextAndConsume[Char]{newChar('a', 1, 1)},
+				opState{},
+				opNextAndConsume[Char]{newChar('b', 1, 2)},
+				opNextAndConsume[Char]{newChar('c', 1, 3)},
+				opEOF{},
+				opRollback{},
+				opNextAndConsume[Char]{newChar('b', 1, 2)},
+				opNextAndConsume[Char]{newChar('c', 1, 3)},
+				opEOF{},
+			},
+		},
+		{
+			name:   "state and rollback after internal reader error",
+			reader: Builder{}.WithSource(&errorReader{Input: "ab"}).Reader(),
+			ops: []any{
+				opNextAndConsume[Char]{newChar('a', 1, 1)},
+				opState{},
+				opNextAndConsume[Char]{newChar('b', 1, 2)},
+				opNextErr[Char]{Err: genError(1, 3, fmt.Errorf("error reading rune from source: %w", errorReaderError))},
+				opRollback{},
+				opNextAndConsume[Char]{newChar('b', 1, 2)},
+				opNextErr[Char]{Err: genError(1, 3, fmt.Errorf("error reading rune from source: %w", errorReaderError))},
+			},
+		},
+		{
+			name:   "transformer NormalizeNewline",
+			reader: Builder{}.WithSource(strings.NewReader("a\u000Ab\u000Dc\u000D\u000Ad")).WithNormalizeNewline().Reader(),
+			ops: []any{
+				opNextAndConsume[Char]{newChar('a', 1, 1)},
+				opNextAndConsume[Char]{newChar('\n', 1, 2)},
+				opNextAndConsume[Char]{newChar('b', 2, 1)},
+				opNextAndConsume[Char]{newChar('\n', 2, 2)},
+				opNextAndConsume[Char]{newChar('c', 3, 1)},
+				opNextAndConsume[Char]{newChar('\n', 3, 2)},
+				opNextAndConsume[Char]{newChar('d', 4, 1)},
+				opEOF{},
+			},
+		},
+		{
+			name:   "transformer NormalizeNewline EOF after NL",
+			reader: Builder{}.WithSource(strings.NewReader("a\u000Ab\u000A")).WithNormalizeNewline().Reader(),
+			ops: []any{
+				opNextAndConsume[Char]{newChar('a', 1, 1)},
+				opNextAndConsume[Char]{newChar('\n', 1, 2)},
+				opNextAndConsume[Char]{newChar('b', 2, 1)},
+				opNextAndConsume[Char]{newChar('\n', 2, 2)},
+				opEOF{},
+			},
+		},
+		{
+			name:   "transformer NormalizeNewline EOF after CR",
+			reader: Builder{}.WithSource(strings.NewReader("a\u000Ab\u000D")).WithNormalizeNewline().Reader(),
+			ops: []any{
+				opNextAndConsume[Char]{newChar('a', 1, 1)},
+				opNextAndConsume[Char]{newChar('\n', 1, 2)},
+				opNextAndConsume[Char]{newChar('b', 2, 1)},
+				opNextAndConsume[Char]{newChar('\n', 2, 2)},
+				opEOF{},
+			},
+		},
+		{
+			name:   "transformer NormalizeNewline EOF after CR + NL",
+			reader: Builder{}.WithSource(strings.NewReader("a\u000Ab\u000D\u000A")).WithNormalizeNewline().Reader(),
+			ops: []any{
+				opNextAndConsume[Char]{newChar('a', 1, 1)},
+				opNextAndConsume[Char]{newChar('\n', 1, 2)},
+				opNextAndConsume[Char]{newChar('b', 2, 1)},
+				opNextAndConsume[Char]{newChar('\n', 2, 2)},
+				opEOF{},
+			},
+		},
+		{
+			name: "transformer UnicodeNewlines",
+			reader: Builder{}.WithSource(strings.NewReader("a\u0085b\u2028c\r\nd\u2029e\ff")).
+				WithUnicodeNewlines(NewlineNEL | NewlineLS | NewlineFF).Reader(),
+			ops: []any{
+				opNextAndConsume[Char]{newChar('a', 1, 1)},
+				opNextAndConsume[Char]{newChar('\n', 1, 2)},
+				opNextAndConsume[Char]{newChar('b', 2, 1)},
+				opNextAndConsume[Char]{newChar('\n', 2, 2)},
+				opNextAndConsume[Char]{newChar('c', 3, 1)},
+				opNextAndConsume[Char]{newChar('\n', 3, 2)},
+				opNextAndConsume[Char]{newChar('d', 4, 1)},
+				opNextAndConsume[Char]{newChar('\u2029', 4, 2)},
+				opNextAndConsume[Char]{newChar('e', 4, 3)},
+				opNextAndConsume[Char]{newChar('\n', 4, 4)},
+				opNextAndConsume[Char]{newChar('f', 5, 1)},
+				opEOF{},
+			},
+		},
+		{
+			name:   "newline policy LF",
+			reader: Builder{}.WithSource(strings.NewReader("a\nb\r\nc\rd")).WithNewlinePolicy(NewlinePolicyLF).Reader(),
+			ops: []any{
+				opNextAndConsume[Char]{newChar('a', 1, 1)},
+				opNextAndConsume[Char]{newChar('\n', 1, 2)},
+				opNextAndConsume[Char]{newChar('b', 2, 1)},
+				opNextAndConsume[Char]{newChar('\r', 2, 2)},
+				opNextAndConsume[Char]{newChar('\n', 2, 3)},
+				opNextAndConsume[Char]{newChar('c', 3, 1)},
+				opNextAndConsume[Char]{newChar('\r', 3, 2)},
+				opNextAndConsume[Char]{newChar('d', 3, 3)},
+				opEOF{},
+			},
+		},
+		{
+			name:   "newline policy all",
+			reader: Builder{}.WithSource(strings.NewReader("a\nb\r\nc\rd")).WithNewlinePolicy(NewlinePolicyAll).Reader(),
+			ops: []any{
+				opNextAndConsume[Char]{newChar('a', 1, 1)},
+				opNextAndConsume[Char]{newChar('\n', 1, 2)},
+				opNextAndConsume[Char]{newChar('b', 2, 1)},
+				opNextAndConsume[Char]{newChar('\r', 2, 2)},
+				opNextAndConsume[Char]{newChar('\n', 2, 3)},
+				opNextAndConsume[Char]{newChar('c', 3, 1)},
+				opNextAndConsume[Char]{newChar('\r', 3, 2)},
+				opNextAndConsume[Char]{newChar('d', 4, 1)},
+				opEOF{},
+			},
+		},
+		{
+			name: "newline policy all with normalize newline",
+			reader: Builder{}.WithSource(strings.NewReader("a\nb\r\nc\rd")).WithNewlinePolicy(NewlinePolicyAll).
+				WithNormalizeNewline().Reader(),
+			ops: []any{
+				opNextAndConsume[Char]{newChar('a', 1, 1)},
+				opNextAndConsume[Char]{newChar('\n', 1, 2)},
+				opNextAndConsume[Char]{newChar('b', 2, 1)},
+				opNextAndConsume[Char]{newChar('\n', 2, 2)},
+				opNextAndConsume[Char]{newChar('c', 3, 1)},
+				opNextAndConsume[Char]{newChar('\n', 3, 2)},
+				opNextAndConsume[Char]{newChar('d', 4, 1)},
+				opEOF{},
+			},
+		},
+		{
+			name:   "transformer UnicodeEscape",
+			reader: Builder{}.WithSource(strings.NewReader(`a\u0058`)).WithUnicodeEscape().Reader(),
+			ops: []any{
+				opNextAndConsume[Char]{newChar('a', 1, 1)},
+				opNextAndConsume[Char]{newChar('X', 1, 2)},
+				opEOF{},
+			},
+		},
+		{
+			name:   "transformer UnicodeEscape long",
+			reader: Builder{}.WithSource(strings.NewReader(`a\U0001F600\U00000058`)).WithUnicodeEscape().Reader(),
+			ops: []any{
+				opNextAndConsume[Char]{newChar('a', 1, 1)},
+				opNextAndConsume[Char]{newChar('\U0001F600', 1, 2)},
+				opNextAndConsume[Char]{newChar('X', 1, 12)},
+				opEOF{},
+			},
+		},
+		{
+			name:   "transformer UnicodeEscape long invalid code point",
+			reader: Builder{}.WithSource(strings.NewReader(`a\U00110000`)).WithUnicodeEscape().Reader(),
+			ops: []any{
+				opNextAndConsume[Char]{newChar('a', 1, 1)},
+				opNextErr[Char]{Err: genError(1, 2, errors.New(`error parsing unicode escaped rune '\U00110000': invalid syntax`))},
+				opEOF{},
+			},
+		},
+		{
+			name:   "transformer UnicodeEscape long unexpected EOF",
+			reader: Builder{}.WithSource(strings.NewReader(`a\U0001F60`)).WithUnicodeEscape().Reader(),
+			ops: []any{
+				opNextAndConsume[Char]{newChar('a', 1, 1)},
+				opNextErr[Char]{Err: genError(1, 2, errors.New("unexpected EOF reading unicode escape"))},
+				opEOF{},
+			},
+		},
+		{
+			name:   "transformer UnicodeEscape surrogate pair",
+			reader: Builder{}.WithSource(strings.NewReader(`a\uD83D\uDE00b`)).WithUnicodeEscape().Reader(),
+			ops: []any{
+				opNextAndConsume[Char]{newChar('a', 1, 1)},
+				opNextAndConsume[Char]{newChar('\U0001F600', 1, 2)},
+				opNextAndConsume[Char]{newChar('b', 1, 14)},
+				opEOF{},
+			},
+		},
+		{
+			name:   "transformer UnicodeEscape unpaired high surrogate",
+			reader: Builder{}.WithSource(strings.NewReader(`a\uD83D\u0058`)).WithUnicodeEscape().Reader(),
+			ops: []any{
+				opNextAndConsume[Char]{newChar('a', 1, 1)},
+				opNextErr[Char]{Err: genError(1, 2, errors.New(`unpaired surrogate in unicode escape '\uD83D'`))},
+				opEOF{},
+			},
+		},
+		{
+			name:   "transformer UnicodeEscape high surrogate without escape",
+			reader: Builder{}.WithSource(strings.NewReader(`a\uD83Db`)).WithUnicodeEscape().Reader(),
+			ops: []any{
+				opNextAndConsume[Char]{newChar('a', 1, 1)},
+				opNextErr[Char]{Err: genError(1, 2,
+					errors.New("high surrogate in unicode escape not followed by an escaped low surrogate"))},
+				opEOF{},
+			},
+		},
+		{
+			name:   "transformer UnicodeEscape unpaired low surrogate",
+			reader: Builder{}.WithSource(strings.NewReader(`a\uDE00`)).WithUnicodeEscape().Reader(),
+			ops: []any{
+				opNextAndConsume[Char]{newChar('a', 1, 1)},
+				opNextErr[Char]{Err: genError(1, 2, errors.New(`error parsing unicode escaped rune '\uDE00': invalid syntax`))},
+				opEOF{},
+			},
+		},
+		{
+			name:   "transformer UnicodeEscape invalid hex number",
+			reader: Builder{}.WithSource(strings.NewReader(`a\u005X`)).WithUnicodeEscape().Reader(),
+			ops: []any{
+				opNextAndConsume[Char]{newChar('a', 1, 1)},
+				opNextErr[Char]{Err: genError(1, 2, errors.New(`error parsing unicode escaped rune '\u005X': invalid syntax`))},
+				opEOF{},
+			},
+		},
+		{
+			name:   "transformer UnicodeEscape invalid hex number space",
+			reader: Builder{}.WithSource(strings.NewReader(`a\u005 `)).WithUnicodeEscape().Reader(),
+			ops: []any{
+				opNextAndConsume[Char]{newChar('a', 1, 1)},
+				opNextErr[Char]{Err: genError(1, 2, errors.New(`error parsing unicode escaped rune '\u005 ': invalid syntax`))},
+				opEOF{},
+			},
+		},
+		{
+			name:   "transformer UnicodeEscape unexpected EOF",
+			reader: Builder{}.WithSource(strings.NewReader(`a\u005`)).WithUnicodeEscape().Reader(),
+			ops: []any{
+				opNextAndConsume[Char]{newChar('a', 1, 1)},
+				opNextErr[Char]{Err: genError(1, 2, errors.New("unexpected EOF reading unicode escape"))},
+				opEOF{},
+			},
+		},
+		{
+			name:   "transformer UnicodeEscape rune escape",
+			reader: Builder{}.WithSource(strings.NewReader(`a\X`)).WithUnicodeEscape().Reader(),
+			ops: []any{
+				opNextAndConsume[Char]{newChar('a', 1, 1)},
+				opNextAndConsume[Char]{newChar('\\', 1, 2)},
+				opNextAndConsume[Char]{newChar('X', 1, 3)},
+				opEOF{},
+			},
+		},
+		{
+			name:   "peek",
+			reader: Builder{}.WithSource(strings.NewReader("abc")).WithSize(2, 1).Reader(),
+			ops: []any{
+				opPeek{N: 2, Exp: newChar('c', 1, 3)},
+				opPeek{N: 0, Exp: newChar('a', 1, 1)},
+				opNextAndConsume[Char]{newChar('a', 1, 1)},
+				opPeek{N: 1, Exp: newChar('c', 1, 3)},
+				opNextAndConsume[Char]{newChar('b', 1, 2)},
+				opNextAndConsume[Char]{newChar('c', 1, 3)},
+				opEOF{},
+			},
+		},
+		{
+			name:   "peek EOF",
+			reader: Builder{}.WithSource(strings.NewReader("ab")).Reader(),
+			ops: []any{
+				opPeekErr{N: 2, Err: io.EOF},
+				opNextAndConsume[Char]{newChar('a', 1, 1)},
+				opNextAndConsume[Char]{newChar('b', 1, 2)},
+				opPeekErr{N: 0, Err: io.EOF},
+			},
+		},
+		{
+			name:   "window",
+			reader: Builder{}.WithSource(strings.NewReader("a<<=")).Reader(),
+			ops: []any{
+				opNextAndConsume[Char]{newChar('a', 1, 1)},
+				opWindow{K: 2, Exp: []Char{newChar('<', 1, 2), newChar('<', 1, 3)}},
+				opWindow{K: 5, Exp: []Char{newChar('<', 1, 2), newChar('<', 1, 3), newChar('=', 1, 4)}},
+				opNextAndConsume[Char]{newChar('<', 1, 2)},
+				opNextAndConsume[Char]{newChar('<', 1, 3)},
+				opNextAndConsume[Char]{newChar('=', 1, 4)},
+				opWindowErr{K: 1, Err: io.EOF},
+			},
+		},
+		{
+			name:   "prev",
+			reader: Builder{}.WithSource(strings.NewReader("abc")).Reader(),
+			ops: []any{
+				opPrev{},
+				opNextAndConsume[Char]{newChar('a', 1, 1)},
+				opPrev{Exp: newChar('a', 1, 1), Ok: true},
+				opState{},
+				opNextAndConsume[Char]{newChar('b', 1, 2)},
+				opNext[Char]{newChar('c', 1, 3)},
+				opPrev{Exp: newChar('b', 1, 2), Ok: true},
+				opRollback{},
+				opPrev{Exp: newChar('a', 1, 1), Ok: true},
+				opNextAndConsume[Char]{newChar('b', 1, 2)},
+				opNextAndConsume[Char]{newChar('c', 1, 3)},
+				opEOF{},
+				opConsume{},
+				opPrev{Exp: newChar('c', 1, 3), Ok: true},
+			},
+		},
+		{
+			name:   "unconsume",
+			reader: Builder{}.WithSource(strings.NewReader("abc")).Reader(),
+			ops: []any{
+				opUnconsume{Err: errNoUnconsume},
+				opNextAndConsume[Char]{newChar('a', 1, 1)},
+				opNextAndConsume[Char]{newChar('b', 1, 2)},
+				opUnconsume{},
+				opPrev{Exp: newChar('a', 1, 1), Ok: true},
+				opUnconsume{Err: errNoUnconsume},
+				opNextAndConsume[Char]{newChar('b', 1, 2)},
+				opNextAndConsume[Char]{newChar('c', 1, 3)},
+				opEOF{},
+				opUnconsume{},
+				opNextAndConsume[Char]{newChar('c', 1, 3)},
+				opEOF{},
+			},
+		},
+		{
+			name:   "push back",
+			reader: Builder{}.WithSource(strings.NewReader("ab")).Reader(),
+			ops: []any{
+				opNextAndConsume[Char]{newChar('a', 1, 1)},
+				opPushBack{C: newChar('x', 1, 2)},
+				opState{},
+				opPushBackRunes{Pos: Position{Row: 1, Col: 2}, Runes: []rune("yz")},
+				opPeek{N: 3, Exp: newChar('b', 1, 2)},
+				opNextAndConsume[Char]{newChar('y', 1, 2)},
+				opNextAndConsume[Char]{newChar('z', 1, 2)},
+				opRollback{},
+				opNextAndConsume[Char]{newChar('x', 1, 2)},
+				opUnconsume{},
+				opNextAndConsume[Char]{newChar('x', 1, 2)},
+				opNextAndConsume[Char]{newChar('b', 1, 2)},
+				opEOF{},
+			},
+		},
+		{
+			name:   "skip",
+			reader: Builder{}.WithSource(strings.NewReader("abcd")).Reader(),
+			ops: []any{
+				opSkip{N: 2},
+				opNextAndConsume[Char]{newChar('c', 1, 3)},
+				opSkip{N: 0},
+				opSkip{N: 2, Err: io.EOF},
+				opPrev{Exp: newChar('d', 1, 4), Ok: true},
+				opEOF{},
+			},
+		},
+		{
+			name:   "read while",
+			reader: Builder{}.WithSource(strings.NewReader("ab12c3")).Reader(),
+			ops: []any{
+				opReadWhile{Pred: unicode.IsLetter, Exp: []Char{newChar('a', 1, 1), newChar('b', 1, 2)}},
+				opReadWhile{Pred: unicode.IsLetter},
+				opReadWhile{Pred: unicode.IsDigit, Exp: []Char{newChar('1', 1, 3), newChar('2', 1, 4)}},
+				opNextAndConsume[Char]{newChar('c', 1, 5)},
+				opReadWhile{Pred: unicode.IsDigit, Exp: []Char{newChar('3', 1, 6)}},
+				opReadWhile{Pred: unicode.IsDigit},
+				opEOF{},
+			},
+		},
+		{
+			name:   "read while error from internal reader",
+			reader: Builder{}.WithSource(&errorReader{Input: "ab"}).Reader(),
+			ops: []any{
+				opReadWhile{Pred: unicode.IsLetter, Exp: []Char{newChar('a', 1, 1), newChar('b', 1, 2)},
+					Err: genError(1, 3, fmt.Errorf("error reading rune from source: %w", errorReaderError))},
+			},
+		},
+		{
+			name:   "read until",
+			reader: Builder{}.WithSource(strings.NewReader("ab,c;;d")).Reader(),
+			ops: []any{
+				opReadUntil{Delims: []rune{',', ';'}, Exp: []Char{newChar('a', 1, 1), newChar('b', 1, 2)}},
+				opNextAndConsume[Char]{newChar(',', 1, 3)},
+				opReadUntil{Delims: []rune{',', ';'}, Exp: []Char{newChar('c', 1, 4)}},
+				opNextAndConsume[Char]{newChar(';', 1, 5)},
+				opReadUntil{Delims: []rune{',', ';'}},
+				opNextAndConsume[Char]{newChar(';', 1, 6)},
+				opReadUntil{Delims: []rune{',', ';'}, Exp: []Char{newChar('d', 1, 7)}, Err: io.EOF},
+				opEOF{},
+			},
+		},
+		{
+			name:   "skip whitespace",
+			reader: Builder{}.WithSource(strings.NewReader("a \t\n\u00A0b \t\nc  ")).Reader(),
+			ops: []any{
+				opNextAndConsume[Char]{newChar('a', 1, 1)},
+				opSkipWhitespace{},
+				opNextAndConsume[Char]{newChar('b', 1, 6)},
+				opSkipWhitespace{Inline: true},
+				opNextAndConsume[Char]{newChar('\n', 1, 9)},
+				opSkipWhitespace{Inline: true},
+				opNextAndConsume[Char]{newChar('c', 1, 10)},
+				opSkipWhitespace{},
+				opEOF{},
+				opSkipWhitespace{},
+			},
+		},
+		{
+			name:   "expect and accept",
+			reader: Builder{}.WithSource(strings.NewReader("abc")).Reader(),
+			ops: []any{
+				opExpect{R: 'a', Exp: newChar('a', 1, 1)},
+				opExpect{R: 'x', Err: genError(1, 2, errors.New(`expected 'x', got 'b'`))},
+				opAccept{R: 'x'},
+				opAccept{R: 'b', Ok: true},
+				opAccept{R: 'c', Ok: true},
+				opAccept{R: 'd'},
+				opExpect{R: 'd', Err: genError(1, 4, errors.New(`expected 'd', got EOF`))},
+			},
+		},
+		{
+			name:   "match",
+			reader: Builder{}.WithSource(strings.NewReader("<<=<")).Reader(),
+			ops: []any{
+				opMatch{S: "<="},
+				opMatch{S: "<<=", Ok: true},
+				opMatch{S: "<<"},
+				opMatch{S: "", Ok: true},
+				opNextAndConsume[Char]{newChar('<', 1, 4)},
+				opMatch{S: "<"},
+				opEOF{},
+			},
+		},
+		{
+			name:   "match regexp",
+			reader: Builder{}.WithSource(strings.NewReader("x12.5åé")).Reader(),
+			ops: []any{
+				opMatchRegexp{Re: regexp.MustCompile(`[0-9]+`)},
+				opMatchRegexp{Re: regexp.MustCompile(`[a-z]*`), Exp: []Char{newChar('x', 1, 1)}},
+				opMatchRegexp{Re: regexp.MustCompile(`[a-z]*`), Exp: []Char{}},
+				opMatchRegexp{Re: regexp.MustCompile(`[0-9]+(\.[0-9]+)?`),
+					Exp: []Char{newChar('1', 1, 2), newChar('2', 1, 3), newChar('.', 1, 4), newChar('5', 1, 5)}},
+				opMatchRegexp{Re: regexp.MustCompile(`\pL`), Exp: []Char{newChar('å', 1, 6)}},
+				opMatchRegexp{Re: regexp.MustCompile(`é|e`), Exp: []Char{newChar('é', 1, 7)}},
+				opMatchRegexp{Re: regexp.MustCompile(`.`)},
+				opEOF{},
+			},
+		},
+		{
+			name:   "consume to end of line",
+			reader: Builder{}.WithSource(strings.NewReader("a# b\nc# d\r\ne# f")).Reader(),
+			ops: []any{
+				opNextAndConsume[Char]{newChar('a', 1, 1)},
+				opConsumeToEndOfLine{},
+				opNextAndConsume[Char]{newChar('\n', 1, 5)},
+				opNextAndConsume[Char]{newChar('c', 1, 6)},
+				opConsumeToEndOfLine{Include: true},
+				opNextAndConsume[Char]{newChar('e', 1, 12)},
+				opConsumeToEndOfLine{Include: true},
+				opEOF{},
+				opConsumeToEndOfLine{Include: true},
+			},
+		},
+		{
+			name:   "marks",
+			reader: Builder{}.WithSource(strings.NewReader("abcd")).Reader(),
+			ops: []any{
+				opResetTo{Name: "m1", Err: errors.New(`unknown mark "m1"`), Kind: ErrUnknownMark},
+				opNextAndConsume[Char]{newChar('a', 1, 1)},
+				opMark{Name: "m1"},
+				opNextAndConsume[Char]{newChar('b', 1, 2)},
+				opMark{Name: "m2"},
+				opNextAndConsume[Char]{newChar('c', 1, 3)},
+				opResetTo{Name: "m2"},
+				opNextAndConsume[Char]{newChar('c', 1, 3)},
+				opResetTo{Name: "m1"},
+				opNextAndConsume[Char]{newChar('b', 1, 2)},
+				opRelease{Name: "m1"},
+				opRelease{Name: "m1", Err: errors.New(`unknown mark "m1"`), Kind: ErrUnknownMark},
+				opResetTo{Name: "m1", Err: errors.New(`unknown mark "m1"`), Kind: ErrUnknownMark},
+				opResetTo{Name: "m2"},
+				opNextAndConsume[Char]{newChar('c', 1, 3)},
+				opNextAndConsume[Char]{newChar('d', 1, 4)},
+				opEOF{},
+			},
+		},
+		{
+			name:   "try next",
+			reader: Builder{}.WithSource(strings.NewReader("a")).Reader(),
+			ops: []any{
+				opTryNext{Exp: newChar('a', 1, 1), Ok: true},
+				opConsume{},
+				opTryNext{},
+				opTryNext{},
+			},
+		},
+		{
+			name:   "try next error from internal reader",
+			reader: Builder{}.WithSource(&errorReader{Input: "a"}).Reader(),
+			ops: []any{
+				opTryNext{Exp: newChar('a', 1, 1), Ok: true},
+				opConsume{},
+				opTryNext{Err: genError(1, 2, fmt.Errorf("error reading rune from source: %w", errorReaderError))},
+			},
+		},
+		{
+			name:   "at EOF",
+			reader: Builder{}.WithSource(strings.NewReader("a")).Reader(),
+			ops: []any{
+				opAtEOF{},
+				opNextAndConsume[Char]{newChar('a', 1, 1)},
+				opAtEOF{Exp: true},
+				opAtEOF{Exp: true},
+				opEOF{},
+			},
+		},
+		{
+			name:   "at EOF error from internal reader",
+			reader: Builder{}.WithSource(&errorReader{Input: "a"}).Reader(),
+			ops: []any{
+				opNextAndConsume[Char]{newChar('a', 1, 1)},
+				opAtEOF{},
+				opNextErr[Char]{Err: genError(1, 2, fmt.Errorf("error reading rune from source: %w", errorReaderError))},
+			},
+		},
+		{
+			name:   "at EOF error from transformer",
+			reader: Builder{}.WithSource(strings.NewReader(`a\u12zz`)).WithUnicodeEscape().Reader(),
+			ops: []any{
+				opNextAndConsume[Char]{newChar('a', 1, 1)},
+				opAtEOF{},
+				opAtEOF{},
+				opNextErr[Char]{Err: genError(1, 2, errors.New(`error parsing unicode escaped rune '\u12zz': invalid syntax`))},
+				opEOF{},
+			},
+		},
+		{
+			name:   "at EOF error from failing transformer",
+			reader: Builder{}.WithSource(strings.NewReader("ax")).WithTransformer(failTransformer{}).Reader(),
+			ops: []any{
+				opNextAndConsume[Char]{newChar('a', 1, 1)},
+				opAtEOF{},
+				opPeekErr{N: 0, Err: errFailTransformer},
+				opEOF{},
+			},
+		},
+		{
+			name:   "transformer HexEscape",
+			reader: Builder{}.WithSource(strings.NewReader(`a\x58\xe5\n`)).WithHexEscape(HexEscapeLatin1).Reader(),
+			ops: []any{
+				opNextAndConsume[Char]{newChar('a', 1, 1)},
+				opNextAndConsume[Char]{newChar('X', 1, 2)},
+				opNextAndConsume[Char]{newChar('å', 1, 6)},
+				opNextAndConsume[Char]{newChar('\\', 1, 10)},
+				opNextAndConsume[Char]{newChar('n', 1, 11)},
+				opEOF{},
+			},
+		},
 		{
-			name:   "multiple next and single consume",
-			reader: Builder{}.WithSource(strings.NewReader("a")).Reader(),
+			name:   "transformer HexEscape ASCII",
+			reader: Builder{}.WithSource(strings.NewReader(`\x7F\x80`)).WithHexEscape(HexEscapeASCII).Reader(),
 			ops: []any{
-				opNext[Char]{newChar('a', 1, 1)},
-				opNext[Char]{newChar('a', 1, 1)},
-				opNext[Char]{newChar('a', 1, 1)},
-				opConsume{},
+				opNextAndConsume[Char]{newChar('\x7F', 1, 1)},
+				opNextErr[Char]{Err: genError(1, 5, errors.New(`hex escape '\x80' is out of ASCII range`))},
 				opEOF{},
 			},
 		},
 		{
-			name:   "multiple EOF at end",
-			reader: Builder{}.WithSource(strings.NewReader("a")).Reader(),
+			name:   "transformer HexEscape invalid hex number",
+			reader: Builder{}.WithSource(strings.NewReader(`a\x5X`)).WithHexEscape(HexEscapeLatin1).Reader(),
 			ops: []any{
 				opNextAndConsume[Char]{newChar('a', 1, 1)},
+				opNextErr[Char]{Err: genError(1, 2, errors.New(`error parsing hex escape '\x5X': invalid syntax`))},
 				opEOF{},
+			},
+		},
+		{
+			name:   "transformer HexEscape unexpected EOF",
+			reader: Builder{}.WithSource(strings.NewReader(`a\x5`)).WithHexEscape(HexEscapeLatin1).Reader(),
+			ops: []any{
+				opNextAndConsume[Char]{newChar('a', 1, 1)},
+				opNextErr[Char]{Err: genError(1, 2, errors.New("unexpected EOF reading hex escape"))},
 				opEOF{},
+			},
+		},
+		{
+			name:   "transformer EntityDecode",
+			reader: Builder{}.WithSource(strings.NewReader("&lt;a&amp;&quot; & &NotEqualTilde;")).WithEntityDecode().Reader(),
+			ops: []any{
+				opNextAndConsume[Char]{newChar('<', 1, 1)},
+				opNextAndConsume[Char]{newChar('a', 1, 5)},
+				opNextAndConsume[Char]{newChar('&', 1, 6)},
+				opNextAndConsume[Char]{newChar('"', 1, 11)},
+				opNextAndConsume[Char]{newChar(' ', 1, 17)},
+				opNextAndConsume[Char]{newChar('&', 1, 18)},
+				opNextAndConsume[Char]{newChar(' ', 1, 19)},
+				opNextAndConsume[Char]{newChar('\u2242', 1, 20)},
+				opNextAndConsume[Char]{newChar('\u0338', 1, 20)},
 				opEOF{},
 			},
 		},
 		{
-			name:   "multiple next and consume",
-			reader: Builder{}.WithSource(strings.NewReader("abc")).Reader(),
+			name:   "transformer EntityDecode unknown entity",
+			reader: Builder{}.WithSource(strings.NewReader("a&foo;&ampx;")).WithEntityDecode().Reader(),
 			ops: []any{
-				opNext[Char]{newChar('a', 1, 1)},
-				opNext[Char]{newChar('a', 1, 1)},
-				opConsume{},
-				opNext[Char]{newChar('b', 1, 2)},
-				opConsume{},
-				opNext[Char]{newChar('c', 1, 3)},
-				opNext[Char]{newChar('c', 1, 3)},
-				opConsume{},
+				opNextAndConsume[Char]{newChar('a', 1, 1)},
+				opNextErr[Char]{Err: genError(1, 2, errors.New("unknown entity &foo;"))},
+				opNextErr[Char]{Err: genError(1, 7, errors.New("unknown entity &ampx;"))},
 				opEOF{},
 			},
 		},
 		{
-			name:   "pos",
-			reader: Builder{}.WithSource(strings.NewReader("ab\nc")).WithNormalizeNewline().Reader(),
+			name:   "transformer EntityDecode illegal rune",
+			reader: Builder{}.WithSource(strings.NewReader("a&amp b")).WithEntityDecode().Reader(),
 			ops: []any{
-				opPos{Pos: Position{Row: 1, Col: 1}},
-				opNext[Char]{newChar('a', 1, 1)},
-				opPos{Pos: Position{Row: 1, Col: 1}},
-				opConsume{},
-				opPos{Pos: Position{Row: 1, Col: 2}},
-				opNext[Char]{newChar('b', 1, 2)},
-				opConsume{},
-				opPos{Pos: Position{Row: 1, Col: 3}},
-				opNext[Char]{newChar('\n', 1, 3)},
-				opConsume{},
-				opPos{Pos: Position{Row: 2, Col: 1}},
-				opNext[Char]{newChar('c', 2, 1)},
-				opPos{Pos: Position{Row: 2, Col: 1}},
-				opConsume{},
+				opNextAndConsume[Char]{newChar('a', 1, 1)},
+				opNextErr[Char]{Err: genError(1, 2, errors.New("illegal rune ' ' in entity &amp"))},
+				opNextAndConsume[Char]{newChar('b', 1, 7)},
+				opEOF{},
+			},
+		},
+		{
+			name:   "transformer EntityDecode unexpected EOF",
+			reader: Builder{}.WithSource(strings.NewReader("a&amp")).WithEntityDecode().Reader(),
+			ops: []any{
+				opNextAndConsume[Char]{newChar('a', 1, 1)},
+				opNextErr[Char]{Err: genError(1, 2, errors.New("unexpected EOF reading entity"))},
+				opEOF{},
+			},
+		},
+		{
+			name:   "transformer CharRefDecode",
+			reader: Builder{}.WithSource(strings.NewReader("&#65;&#x1F600;&#X58;&a")).WithCharRefDecode().Reader(),
+			ops: []any{
+				opNextAndConsume[Char]{newChar('A', 1, 1)},
+				opNextAndConsume[Char]{newChar('\U0001F600', 1, 6)},
+				opNextAndConsume[Char]{newChar('X', 1, 15)},
+				opNextAndConsume[Char]{newChar('&', 1, 21)},
+				opNextAndConsume[Char]{newChar('a', 1, 22)},
+				opEOF{},
+			},
+		},
+		{
+			name: "transformer CharRefDecode with EntityDecode",
+			reader: Builder{}.WithSource(strings.NewReader("&lt;&#62;")).WithEntityDecode().WithCharRefDecode().
+				Reader(),
+			ops: []any{
+				opNextAndConsume[Char]{newChar('<', 1, 1)},
+				opNextAndConsume[Char]{newChar('>', 1, 5)},
+				opEOF{},
+			},
+		},
+		{
+			name:   "transformer CharRefDecode malformed",
+			reader: Builder{}.WithSource(strings.NewReader("&#6A;&#;&#x;")).WithCharRefDecode().Reader(),
+			ops: []any{
+				opNextErr[Char]{Err: genError(1, 1, errors.New("malformed character reference &#6A"))},
+				opNextAndConsume[Char]{newChar(';', 1, 5)},
+				opNextErr[Char]{Err: genError(1, 6, errors.New("malformed character reference &#;"))},
+				opNextErr[Char]{Err: genError(1, 9, errors.New("malformed character reference &#x;"))},
+				opEOF{},
+			},
+		},
+		{
+			name:   "transformer CharRefDecode invalid code point",
+			reader: Builder{}.WithSource(strings.NewReader("&#xD800;&#x110000;")).WithCharRefDecode().Reader(),
+			ops: []any{
+				opNextErr[Char]{Err: genError(1, 1, errors.New("character reference &#xD800; is not a valid code point"))},
+				opNextErr[Char]{Err: genError(1, 9, errors.New("character reference &#x110000; is not a valid code point"))},
+				opEOF{},
+			},
+		},
+		{
+			name:   "transformer CharRefDecode unexpected EOF",
+			reader: Builder{}.WithSource(strings.NewReader("&#65")).WithCharRefDecode().Reader(),
+			ops: []any{
+				opNextErr[Char]{Err: genError(1, 1, errors.New("unexpected EOF reading character reference"))},
+				opEOF{},
+			},
+		},
+		{
+			name: "transformer LineContinuation",
+			reader: Builder{}.WithSource(strings.NewReader("a\\\nb\\\r\nc\\\rd\\e\\")).WithLineContinuation().
+				WithNormalizeNewline().Reader(),
+			ops: []any{
+				opNextAndConsume[Char]{newChar('a', 1, 1)},
+				opNextAndConsume[Char]{newChar('b', 2, 1)},
+				opNextAndConsume[Char]{newChar('c', 3, 1)},
+				opNextAndConsume[Char]{newChar('d', 4, 1)},
+				opNextAndConsume[Char]{newChar('\\', 4, 2)},
+				opNextAndConsume[Char]{newChar('e', 4, 3)},
+				opNextAndConsume[Char]{newChar('\\', 4, 4)},
+				opEOF{},
+			},
+		},
+		{
+			name: "transformer LineContinuation consecutive",
+			reader: Builder{}.WithSource(strings.NewReader("a\\\n\\\nb")).WithLineContinuation().
+				WithNormalizeNewline().Reader(),
+			ops: []any{
+				opNextAndConsume[Char]{newChar('a', 1, 1)},
+				opNextAndConsume[Char]{newChar('b', 3, 1)},
+				opEOF{},
+			},
+		},
+		{
+			name: "transformer CommentStrip",
+			reader: Builder{}.WithSource(strings.NewReader("a// x\nb/* x\n*/c/d/**/")).WithCommentStrip("//", "/*", "*/").
+				WithNormalizeNewline().Reader(),
+			ops: []any{
+				opNextAndConsume[Char]{newChar('a', 1, 1)},
+				opNextAndConsume[Char]{newChar('\n', 1, 6)},
+				opNextAndConsume[Char]{newChar('b', 2, 1)},
+				opNextAndConsume[Char]{newChar('c', 3, 3)},
+				opNextAndConsume[Char]{newChar('/', 3, 4)},
+				opNextAndConsume[Char]{newChar('d', 3, 5)},
+				opEOF{},
+			},
+		},
+		{
+			name: "transformer CommentReplace",
+			reader: Builder{}.WithSource(strings.NewReader("a--x\nb--[[x]]c--[x")).
+				WithCommentReplace("--", "--[[", "]]").Reader(),
+			ops: []any{
+				opNextAndConsume[Char]{newChar('a', 1, 1)},
+				opNextAndConsume[Char]{newChar(' ', 1, 2)},
+				opNextAndConsume[Char]{newChar('\n', 1, 5)},
+				opNextAndConsume[Char]{newChar('b', 1, 6)},
+				opNextAndConsume[Char]{newChar(' ', 1, 7)},
+				opNextAndConsume[Char]{newChar('c', 1, 14)},
+				opNextAndConsume[Char]{newChar(' ', 1, 15)},
+				opEOF{},
+			},
+		},
+		{
+			name:   "transformer CommentStrip block comment end",
+			reader: Builder{}.WithSource(strings.NewReader("a(* x **)b")).WithCommentStrip("", "(*", "*)").Reader(),
+			ops: []any{
+				opNextAndConsume[Char]{newChar('a', 1, 1)},
+				opNextAndConsume[Char]{newChar('b', 1, 10)},
+				opEOF{},
+			},
+		},
+		{
+			name:   "transformer CommentStrip unterminated block comment",
+			reader: Builder{}.WithSource(strings.NewReader("a/* x *")).WithCommentStrip("//", "/*", "*/").Reader(),
+			ops: []any{
+				opNextAndConsume[Char]{newChar('a', 1, 1)},
+				opNextErr[Char]{Err: genError(1, 2, errors.New("unterminated block comment"))},
+				opEOF{},
+			},
+		},
+		{
+			name:   "transformer CollapseWhitespace",
+			reader: Builder{}.WithSource(strings.NewReader(" a \t b\t\n c ")).WithCollapseWhitespace(false).Reader(),
+			ops: []any{
+				opNextAndConsume[Char]{newChar(' ', 1, 1)},
+				opNextAndConsume[Char]{newChar('a', 1, 2)},
+				opNextAndConsume[Char]{newChar(' ', 1, 3)},
+				opNextAndConsume[Char]{newChar('b', 1, 6)},
+				opNextAndConsume[Char]{newChar(' ', 1, 7)},
+				opNextAndConsume[Char]{newChar('\n', 1, 8)},
+				opNextAndConsume[Char]{newChar(' ', 1, 9)},
+				opNextAndConsume[Char]{newChar('c', 1, 10)},
+				opNextAndConsume[Char]{newChar(' ', 1, 11)},
+				opEOF{},
+			},
+		},
+		{
+			name:   "transformer CollapseWhitespace trim",
+			reader: Builder{}.WithSource(strings.NewReader(" a \t b\t\n c ")).WithCollapseWhitespace(true).Reader(),
+			ops: []any{
+				opNextAndConsume[Char]{newChar('a', 1, 2)},
+				opNextAndConsume[Char]{newChar(' ', 1, 3)},
+				opNextAndConsume[Char]{newChar('b', 1, 6)},
+				opNextAndConsume[Char]{newChar('\n', 1, 8)},
+				opNextAndConsume[Char]{newChar('c', 1, 10)},
+				opEOF{},
+			},
+		},
+		{
+			name: "transformer ControlCharPolicy error",
+			reader: Builder{}.WithSource(strings.NewReader("a\tb\x00\n\x1b\u0085")).
+				WithControlCharPolicy([]rune{'\t', '\n'}, ControlCharError).Reader(),
+			ops: []any{
+				opNextAndConsume[Char]{newChar('a', 1, 1)},
+				opNextAndConsume[Char]{newChar('\t', 1, 2)},
+				opNextAndConsume[Char]{newChar('b', 1, 3)},
+				opNextErr[Char]{Err: genError(1, 4, errors.New("illegal control character U+0000"))},
+				opNextAndConsume[Char]{newChar('\n', 1, 5)},
+				opNextErr[Char]{Err: genError(1, 6, errors.New("illegal control character U+001B"))},
+				opNextErr[Char]{Err: genError(1, 7, errors.New("illegal control character U+0085"))},
+				opEOF{},
+			},
+		},
+		{
+			name: "transformer ControlCharPolicy strip",
+			reader: Builder{}.WithSource(strings.NewReader("a\x00\tb\x7f")).
+				WithControlCharPolicy(nil, ControlCharStrip).Reader(),
+			ops: []any{
+				opNextAndConsume[Char]{newChar('a', 1, 1)},
+				opNextAndConsume[Char]{newChar('b', 1, 4)},
+				opEOF{},
+			},
+		},
+		{
+			name: "transformer ControlCharPolicy replace",
+			reader: Builder{}.WithSource(strings.NewReader("a\x00")).
+				WithControlCharPolicy(nil, ControlCharReplace).Reader(),
+			ops: []any{
+				opNextAndConsume[Char]{newChar('a', 1, 1)},
+				opNextAndConsume[Char]{newChar('\uFFFD', 1, 2)},
+				opEOF{},
+			},
+		},
+		{
+			name: "transformer RuneEscape",
+			reader: Builder{}.WithSource(strings.NewReader(`a\a\b \c\X\\`)).WithRuneEscape(map[rune]rune{
+				'a': 'x',
+				'b': 'y',
+				'c': 'z',
+			}).Reader(),
+			ops: []any{
+				opNextAndConsume[Char]{newChar('a', 1, 1)},
+				opNextAndConsume[Char]{newCharEscaped('x', 1, 2)},
+				opNextAndConsume[Char]{newCharEscaped('y', 1, 4)},
+				opNextAndConsume[Char]{newChar(' ', 1, 6)},
+				opNextAndConsume[Char]{newCharEscaped('z', 1, 7)},
+				opNextAndConsume[Char]{newCharEscaped('X', 1, 9)},
+				opNextAndConsume[Char]{newCharEscaped('\\', 1, 11)},
+				opEOF{},
+			},
+		},
+		{
+			name: "transformer StrictRuneEscape",
+			reader: Builder{}.WithSource(strings.NewReader(`a\t\\\qb`)).WithStrictRuneEscape(map[rune]rune{
+				't':  '\t',
+				'\\': '\\',
+			}).Reader(),
+			ops: []any{
+				opNextAndConsume[Char]{newChar('a', 1, 1)},
+				opNextAndConsume[Char]{newCharEscaped('\t', 1, 2)},
+				opNextAndConsume[Char]{newCharEscaped('\\', 1, 4)},
+				opNextErr[Char]{Err: genError(1, 6, errors.New(`unknown escape sequence \q`))},
+				opNextAndConsume[Char]{newChar('b', 1, 8)},
+				opEOF{},
+			},
+		},
+		{
+			name: "transformer RuneEscapeExpand",
+			reader: Builder{}.WithSource(strings.NewReader(`a\e\x\0b`)).WithRuneEscapeExpand(map[rune]string{
+				'e': "\x1b[",
+				'0': "",
+			}).Reader(),
+			ops: []any{
+				opNextAndConsume[Char]{newChar('a', 1, 1)},
+				opNextAndConsume[Char]{newCharEscaped('\x1b', 1, 2)},
+				opNextAndConsume[Char]{newCharEscaped('[', 1, 2)},
+				opNextAndConsume[Char]{newCharEscaped('x', 1, 4)},
+				opNextAndConsume[Char]{newChar('b', 1, 8)},
+				opEOF{},
+			},
+		},
+		{
+			name: "transformer disable and enable",
+			reader: Builder{}.WithSource(strings.NewReader(`\n"\n"\n`)).
+				WithRuneEscape(map[rune]rune{'n': '\n'}).WithName("escape").Reader(),
+			ops: []any{
+				opNextAndConsume[Char]{newCharEscaped('\n', 1, 1)},
+				opDisableTransformer{Name: "escape"},
+				opNextAndConsume[Char]{newChar('"', 1, 3)},
+				opNextAndConsume[Char]{newChar('\\', 1, 4)},
+				opNextAndConsume[Char]{newChar('n', 1, 5)},
+				opNextAndConsume[Char]{newChar('"', 1, 6)},
+				opEnableTransformer{Name: "escape"},
+				opNextAndConsume[Char]{newCharEscaped('\n', 1, 7)},
+				opEOF{},
+			},
+		},
+		{
+			name:   "transformer disable unknown",
+			reader: Builder{}.WithSource(strings.NewReader("a")).WithNormalizeNewline().WithName("newline").Reader(),
+			ops: []any{
+				opDisableTransformer{Name: "escape", Err: errors.New(`unknown transformer "escape"`),
+					Kind: ErrUnknownTransformer},
+				opEnableTransformer{Name: "escape", Err: errors.New(`unknown transformer "escape"`),
+					Kind: ErrUnknownTransformer},
+				opNextAndConsume[Char]{newChar('a', 1, 1)},
+				opEOF{},
+			},
+		},
+		{
+			name: "transformer region",
+			reader: Builder{}.WithSource(strings.NewReader(`\u0041"\u0042\u0022"\u0043`)).
+				WithUnicodeEscape().WithRegion('"', '"').Reader(),
+			ops: []any{
+				opNextAndConsume[Char]{newChar('\\', 1, 1)},
+				opNextAndConsume[Char]{newChar('u', 1, 2)},
+				opNextAndConsume[Char]{newChar('0', 1, 3)},
+				opNextAndConsume[Char]{newChar('0', 1, 4)},
+				opNextAndConsume[Char]{newChar('4', 1, 5)},
+				opNextAndConsume[Char]{newChar('1', 1, 6)},
+				opNextAndConsume[Char]{newChar('"', 1, 7)},
+				opNextAndConsume[Char]{newChar('B', 1, 8)},
+				opNextAndConsume[Char]{newChar('"', 1, 14)},
+				opNextAndConsume[Char]{newChar('"', 1, 20)},
+				opNextAndConsume[Char]{newChar('\\', 1, 21)},
+				opNextAndConsume[Char]{newChar('u', 1, 22)},
+				opNextAndConsume[Char]{newChar('0', 1, 23)},
+				opNextAndConsume[Char]{newChar('0', 1, 24)},
+				opNextAndConsume[Char]{newChar('4', 1, 25)},
+				opNextAndConsume[Char]{newChar('3', 1, 26)},
+				opEOF{},
+			},
+		},
+		{
+			name: "transformer region different delimiters",
+			reader: Builder{}.WithSource(strings.NewReader("--(--)--")).
+				WithTransformer(dashTransformer{}).WithRegion('(', ')').Reader(),
+			ops: []any{
+				opNextAndConsume[Char]{newChar('-', 1, 1)},
+				opNextAndConsume[Char]{newChar('-', 1, 2)},
+				opNextAndConsume[Char]{newChar('(', 1, 3)},
+				opNextAndConsume[Char]{newChar('—', 1, 4)},
+				opNextAndConsume[Char]{newChar(')', 1, 6)},
+				opNextAndConsume[Char]{newChar('-', 1, 7)},
+				opNextAndConsume[Char]{newChar('-', 1, 8)},
+				opEOF{},
+			},
+		},
+		{
+			name: "raw text",
+			reader: Builder{}.WithSource(strings.NewReader("a\\u0058\r\n\\e")).WithRawText().WithNormalizeNewline().
+				WithUnicodeEscape().WithRuneEscapeExpand(map[rune]string{'e': "\x1b["}).Reader(),
+			ops: []any{
+				opNextAndConsume[Char]{Char{Rune: 'a', Pos: Position{Row: 1, Col: 1}, Raw: "a"}},
+				opNextAndConsume[Char]{Char{Rune: 'X', Pos: Position{Row: 1, Col: 2}, Raw: `\u0058`}},
+				opNextAndConsume[Char]{Char{Rune: '\n', Pos: Position{Row: 1, Col: 8}, Raw: "\r\n"}},
+				opNextAndConsume[Char]{Char{Rune: '\x1b', Pos: Position{Row: 2, Col: 1}, Escaped: true, Raw: `\e`}},
+				opNextAndConsume[Char]{Char{Rune: '[', Pos: Position{Row: 2, Col: 1}, Escaped: true, Raw: `\e`}},
+				opEOF{},
+			},
+		},
+		{
+			name:   "raw mode",
+			reader: Builder{}.WithSource(strings.NewReader(`\u0041\u0042\u0043`)).WithUnicodeEscape().Reader(),
+			ops: []any{
+				opNextAndConsume[Char]{newChar('A', 1, 1)},
+				opSetRaw{Raw: true},
+				opNextAndConsume[Char]{newChar('\\', 1, 7)},
+				opNextAndConsume[Char]{newChar('u', 1, 8)},
+				opNextAndConsume[Char]{newChar('0', 1, 9)},
+				opNextAndConsume[Char]{newChar('0', 1, 10)},
+				opNextAndConsume[Char]{newChar('4', 1, 11)},
+				opNextAndConsume[Char]{newChar('2', 1, 12)},
+				opSetRaw{Raw: false},
+				opNextAndConsume[Char]{newChar('C', 1, 13)},
+				opEOF{},
+			},
+		},
+		{
+			name: "transformer TypographicNormalization",
+			reader: Builder{}.WithSource(strings.NewReader("\u201Ca\u2019\u201D\u2014\u2026b")).
+				WithTypographicNormalization().Reader(),
+			ops: []any{
+				opNextAndConsume[Char]{newChar('"', 1, 1)},
+				opNextAndConsume[Char]{newChar('a', 1, 2)},
+				opNextAndConsume[Char]{newChar('\'', 1, 3)},
+				opNextAndConsume[Char]{newChar('"', 1, 4)},
+				opNextAndConsume[Char]{newChar('-', 1, 5)},
+				opNextAndConsume[Char]{newChar('.', 1, 6)},
+				opNextAndConsume[Char]{newChar('.', 1, 6)},
+				opNextAndConsume[Char]{newChar('.', 1, 6)},
+				opNextAndConsume[Char]{newChar('b', 1, 7)},
+				opEOF{},
+			},
+		},
+		{
+			name:   "transformer SpaceNormalization",
+			reader: Builder{}.WithSource(strings.NewReader("a\u00A0b \u202F")).WithSpaceNormalization(nil).Reader(),
+			ops: []any{
+				opNextAndConsume[Char]{newChar('a', 1, 1)},
+				opNextAndConsume[Char]{newChar(' ', 1, 2)},
+				opNextAndConsume[Char]{newChar('b', 1, 3)},
+				opNextAndConsume[Char]{newChar(' ', 1, 4)},
+				opNextAndConsume[Char]{newChar(' ', 1, 5)},
+				opEOF{},
+			},
+		},
+		{
+			name:   "transformer BidiPolicy strip",
+			reader: Builder{}.WithSource(strings.NewReader("a\u202Eb\u200Bc\u2069")).WithBidiPolicy(BidiStrip).Reader(),
+			ops: []any{
+				opNextAndConsume[Char]{newChar('a', 1, 1)},
+				opNextAndConsume[Char]{newChar('b', 1, 3)},
+				opNextAndConsume[Char]{newChar('c', 1, 5)},
+				opEOF{},
+			},
+		},
+		{
+			name:   "transformer BidiPolicy error",
+			reader: Builder{}.WithSource(strings.NewReader("a\u2066b\uFEFF")).WithBidiPolicy(BidiError).Reader(),
+			ops: []any{
+				opNextAndConsume[Char]{newChar('a', 1, 1)},
+				opNextErr[Char]{Err: genError(1, 2, fmt.Errorf("illegal bidirectional control character U+2066"))},
+			},
+		},
+		{
+			name:   "transformer BidiPolicy error zero-width",
+			reader: Builder{}.WithSource(strings.NewReader("\uFEFF")).WithBidiPolicy(BidiError).Reader(),
+			ops: []any{
+				opNextErr[Char]{Err: genError(1, 1, fmt.Errorf("illegal zero-width character U+FEFF"))},
+			},
+		},
+		{
+			name:   "transformer SkipShebang",
+			reader: Builder{}.WithSource(strings.NewReader("#!/bin/sh\r\na\n#!")).WithSkipShebang().Reader(),
+			ops: []any{
+				opNextAndConsume[Char]{newChar('a', 2, 1)},
+				opNextAndConsume[Char]{newChar('\n', 2, 2)},
+				opNextAndConsume[Char]{newChar('#', 2, 3)},
+				opNextAndConsume[Char]{newChar('!', 2, 4)},
+				opEOF{},
+			},
+		},
+		{
+			name:   "transformer SkipShebang no shebang",
+			reader: Builder{}.WithSource(strings.NewReader("#a")).WithSkipShebang().Reader(),
+			ops: []any{
+				opNextAndConsume[Char]{newChar('#', 1, 1)},
+				opNextAndConsume[Char]{newChar('a', 1, 2)},
+				opEOF{},
+			},
+		},
+		{
+			name: "transformer SkipShebang newline policy",
+			reader: Builder{}.WithSource(strings.NewReader("#!/bin/sh\r\na\nb")).WithNewlinePolicy(NewlinePolicyAll).
+				WithSkipShebang().Reader(),
+			ops: []any{
+				opNextAndConsume[Char]{newChar('a', 2, 1)},
+				opNextAndConsume[Char]{newChar('\n', 2, 2)},
+				opNextAndConsume[Char]{newChar('b', 3, 1)},
 				opEOF{},
 			},
 		},
 		{
-			name:   "repeating EOF",
-			reader: Builder{}.WithSource(strings.NewReader("a")).Reader(),
+			name:   "transformer Translation trigraphs",
+			reader: Builder{}.WithSource(strings.NewReader("???=??x??")).WithTranslation(CTrigraphs).Reader(),
 			ops: []any{
-				opNextAndConsume[Char]{newChar('a', 1, 1)},
-				opEOF{},
-				opEOF{},
+				opNextAndConsume[Char]{newChar('?', 1, 1)},
+				opNextAndConsume[Char]{newChar('#', 1, 2)},
+				opNextAndConsume[Char]{newChar('?', 1, 5)},
+				opNextAndConsume[Char]{newChar('?', 1, 6)},
+				opNextAndConsume[Char]{newChar('x', 1, 7)},
+				opNextAndConsume[Char]{newChar('?', 1, 8)},
+				opNextAndConsume[Char]{newChar('?', 1, 9)},
 				opEOF{},
 			},
 		},
 		{
-			name:   "error from internal reader",
-			reader: Builder{}.WithSource(&errorReader{Input: "ab"}).Reader(),
+			name:   "transformer Translation digraphs",
+			reader: Builder{}.WithSource(strings.NewReader("%:%:%:<%")).WithTranslation(CDigraphs).Reader(),
 			ops: []any{
-				opNextAndConsume[Char]{newChar('a', 1, 1)},
-				opNextAndConsume[Char]{newChar('b', 1, 2)},
-				opNextErr[Char]{Err: genError(1, 3, fmt.Errorf("error reading rune from source: %w", errorReaderError))},
-				opNextErr[Char]{Err: genError(1, 3, fmt.Errorf("error reading rune from source: %w", errorReaderError))},
-				opNextErr[Char]{Err: genError(1, 3, fmt.Errorf("error reading rune from source: %w", errorReaderError))},
+				opNextAndConsume[Char]{newChar('#', 1, 1)},
+				opNextAndConsume[Char]{newChar('#', 1, 1)},
+				opNextAndConsume[Char]{newChar('#', 1, 5)},
+				opNextAndConsume[Char]{newChar('{', 1, 7)},
+				opEOF{},
 			},
 		},
 		{
-			name:   "state and rollback",
-			reader: Builder{}.WithSource(strings.NewReader("abcd")).Reader(),
+			name:   "transformer YAMLEscape",
+			reader: Builder{}.WithSource(strings.NewReader(`a\e\_\x41\u00e9\U0001F600\\`)).WithYAMLEscape().Reader(),
 			ops: []any{
 				opNextAndConsume[Char]{newChar('a', 1, 1)},
-				opState{},
-				opNextAndConsume[Char]{newChar('b', 1, 2)},
-				opNextAndConsume[Char]{newChar('c', 1, 3)},
-				opRollback{},
-				opNextAndConsume[Char]{newChar('b', 1, 2)},
-				opNextAndConsume[Char]{newChar('c', 1, 3)},
-				opNextAndConsume[Char]{newChar('d', 1, 4)},
+				opNextAndConsume[Char]{newCharEscaped('\x1b', 1, 2)},
+				opNextAndConsume[Char]{newCharEscaped('\u00A0', 1, 4)},
+				opNextAndConsume[Char]{newChar('A', 1, 6)},
+				opNextAndConsume[Char]{newChar('é', 1, 10)},
+				opNextAndConsume[Char]{newChar('😀', 1, 16)},
+				opNextAndConsume[Char]{newCharEscaped('\\', 1, 26)},
 				opEOF{},
 			},
 		},
 		{
-			name:   "state and rollback after EOF",
-			reader: Builder{}.WithSource(strings.NewReader("abc")).Reader(),
+			name:   "transformer YAMLEscape unknown",
+			reader: Builder{}.WithSource(strings.NewReader(`\q`)).WithYAMLEscape().Reader(),
 			ops: []any{
-				opNextAndConsume[Char]{newChar('a', 1, 1)},
-				opState{},
-				opNextAndConsume[Char]{newChar('b', 1, 2)},
-				opNextAndConsume[Char]{newChar('c', 1, 3)},
+				opNextErr[Char]{Err: genError(1, 1, fmt.Errorf("unknown escape sequence \\q"))},
+			},
+		},
+		{
+			name:   "transformer YAMLEscape invalid",
+			reader: Builder{}.WithSource(strings.NewReader(`\U00110000`)).WithYAMLEscape().Reader(),
+			ops: []any{
+				opNextErr[Char]{Err: genError(1, 1, fmt.Errorf("error parsing YAML escape '\\U00110000': %w", strconv.ErrSyntax))},
+			},
+		},
+		{
+			name:   "transformer DoubledEscape",
+			reader: Builder{}.WithSource(strings.NewReader(`'a''b'''"`)).WithDoubledEscape('\'', '"').Reader(),
+			ops: []any{
+				opNextAndConsume[Char]{newChar('\'', 1, 1)},
+				opNextAndConsume[Char]{newChar('a', 1, 2)},
+				opNextAndConsume[Char]{newCharEscaped('\'', 1, 3)},
+				opNextAndConsume[Char]{newChar('b', 1, 5)},
+				opNextAndConsume[Char]{newCharEscaped('\'', 1, 6)},
+				opNextAndConsume[Char]{newChar('\'', 1, 8)},
+				opNextAndConsume[Char]{newChar('"', 1, 9)},
 				opEOF{},
-				opRollback{},
-				opNextAndConsume[Char]{newChar('b', 1, 2)},
-				opNextAndConsume[Char]{newChar('c', 1, 3)},
+			},
+		},
+		{
+			name: "transformer escape char",
+			reader: Builder{}.WithSource(strings.NewReader("%uD83D%uDE00`n\\n%x41")).WithUnicodeEscape().WithEscapeChar('%').
+				WithRuneEscape(map[rune]rune{'n': '\n'}).WithEscapeChar('`').
+				WithHexEscape(HexEscapeASCII).WithEscapeChar('%').Reader(),
+			ops: []any{
+				opNextAndConsume[Char]{newChar('😀', 1, 1)},
+				opNextAndConsume[Char]{newCharEscaped('\n', 1, 13)},
+				opNextAndConsume[Char]{newChar('\\', 1, 15)},
+				opNextAndConsume[Char]{newChar('n', 1, 16)},
+				opNextAndConsume[Char]{newChar('A', 1, 17)},
 				opEOF{},
 			},
 		},
 		{
-			name:   "state and rollback after internal reader error",
-			reader: Builder{}.WithSource(&errorReader{Input: "ab"}).Reader(),
+			name:   "transformer escape char unknown escape",
+			reader: Builder{}.WithSource(strings.NewReader("`q")).WithStrictRuneEscape(nil).WithEscapeChar('`').Reader(),
 			ops: []any{
-				opNextAndConsume[Char]{newChar('a', 1, 1)},
-				opState{},
-				opNextAndConsume[Char]{newChar('b', 1, 2)},
-				opNextErr[Char]{Err: genError(1, 3, fmt.Errorf("error reading rune from source: %w", errorReaderError))},
-				opRollback{},
-				opNextAndConsume[Char]{newChar('b', 1, 2)},
-				opNextErr[Char]{Err: genError(1, 3, fmt.Errorf("error reading rune from source: %w", errorReaderError))},
+				opNextErr[Char]{Err: genError(1, 1, fmt.Errorf("unknown escape sequence `q"))},
 			},
 		},
 		{
-			name:   "transformer NormalizeNewline",
-			reader: Builder{}.WithSource(strings.NewReader("a\u000Ab\u000Dc\u000D\u000Ad")).WithNormalizeNewline().Reader(),
+			name:   "transformer UnicodeBraceEscape",
+			reader: Builder{}.WithSource(strings.NewReader(`\u{1F600}\u{41}\u0042`)).WithUnicodeBraceEscape().Reader(),
 			ops: []any{
-				opNextAndConsume[Char]{newChar('a', 1, 1)},
-				opNextAndConsume[Char]{newChar('\n', 1, 2)},
-				opNextAndConsume[Char]{newChar('b', 2, 1)},
-				opNextAndConsume[Char]{newChar('\n', 2, 2)},
-				opNextAndConsume[Char]{newChar('c', 3, 1)},
-				opNextAndConsume[Char]{newChar('\n', 3, 2)},
-				opNextAndConsume[Char]{newChar('d', 4, 1)},
+				opNextAndConsume[Char]{newChar('😀', 1, 1)},
+				opNextAndConsume[Char]{newChar('A', 1, 10)},
+				opNextAndConsume[Char]{newChar('B', 1, 16)},
 				opEOF{},
 			},
 		},
 		{
-			name:   "transformer NormalizeNewline EOF after NL",
-			reader: Builder{}.WithSource(strings.NewReader("a\u000Ab\u000A")).WithNormalizeNewline().Reader(),
+			name:   "transformer UnicodeBraceEscape empty",
+			reader: Builder{}.WithSource(strings.NewReader(`\u{}`)).WithUnicodeBraceEscape().Reader(),
+			ops: []any{
+				opNextErr[Char]{Err: genError(1, 1, fmt.Errorf("empty unicode escape \\u{}"))},
+			},
+		},
+		{
+			name:   "transformer UnicodeBraceEscape out of range",
+			reader: Builder{}.WithSource(strings.NewReader(`\u{110000}`)).WithUnicodeBraceEscape().Reader(),
+			ops: []any{
+				opNextErr[Char]{Err: genError(1, 1, fmt.Errorf("unicode escape \\u{110000} is not a valid rune"))},
+			},
+		},
+		{
+			name:   "transformer UnicodeBraceEscape too many digits",
+			reader: Builder{}.WithSource(strings.NewReader(`\u{0000041}`)).WithUnicodeBraceEscape().Reader(),
+			ops: []any{
+				opNextErr[Char]{Err: genError(1, 1,
+					fmt.Errorf("error parsing unicode escape \\u{000004 followed by '1': %w", strconv.ErrSyntax))},
+			},
+		},
+		{
+			name:   "lenient EOF unicode escape",
+			reader: Builder{}.WithSource(strings.NewReader(`a\u12`)).WithLenientEOF().WithUnicodeEscape().Reader(),
 			ops: []any{
 				opNextAndConsume[Char]{newChar('a', 1, 1)},
-				opNextAndConsume[Char]{newChar('\n', 1, 2)},
-				opNextAndConsume[Char]{newChar('b', 2, 1)},
-				opNextAndConsume[Char]{newChar('\n', 2, 2)},
+				opNextAndConsume[Char]{newChar('\\', 1, 2)},
+				opNextAndConsume[Char]{newChar('u', 1, 3)},
+				opNextAndConsume[Char]{newChar('1', 1, 4)},
+				opNextAndConsume[Char]{newChar('2', 1, 5)},
 				opEOF{},
 			},
 		},
 		{
-			name:   "transformer NormalizeNewline EOF after CR",
-			reader: Builder{}.WithSource(strings.NewReader("a\u000Ab\u000D")).WithNormalizeNewline().Reader(),
+			name:   "lenient EOF rune escape",
+			reader: Builder{}.WithSource(strings.NewReader(`a\`)).WithLenientEOF().WithRuneEscape(nil).Reader(),
 			ops: []any{
 				opNextAndConsume[Char]{newChar('a', 1, 1)},
-				opNextAndConsume[Char]{newChar('\n', 1, 2)},
-				opNextAndConsume[Char]{newChar('b', 2, 1)},
-				opNextAndConsume[Char]{newChar('\n', 2, 2)},
+				opNextAndConsume[Char]{newChar('\\', 1, 2)},
 				opEOF{},
 			},
 		},
 		{
-			name:   "transformer NormalizeNewline EOF after CR + NL",
-			reader: Builder{}.WithSource(strings.NewReader("a\u000Ab\u000D\u000A")).WithNormalizeNewline().Reader(),
+			name:   "lenient EOF other error",
+			reader: Builder{}.WithSource(strings.NewReader(`\q`)).WithLenientEOF().WithStrictRuneEscape(nil).Reader(),
 			ops: []any{
-				opNextAndConsume[Char]{newChar('a', 1, 1)},
-				opNextAndConsume[Char]{newChar('\n', 1, 2)},
-				opNextAndConsume[Char]{newChar('b', 2, 1)},
-				opNextAndConsume[Char]{newChar('\n', 2, 2)},
+				opNextErr[Char]{Err: genError(1, 1, fmt.Errorf("unknown escape sequence \\q"))},
+			},
+		},
+		{
+			name: "transformer StripANSI",
+			reader: Builder{}.WithSource(strings.NewReader("\x1b[1;31ma\x1b[0m\x1b]0;title\x07b\x1b]8;;x\x1b\\c\x1bd\x1b[")).
+				WithStripANSI().Reader(),
+			ops: []any{
+				opNextAndConsume[Char]{newChar('a', 1, 8)},
+				opNextAndConsume[Char]{newChar('b', 1, 23)},
+				opNextAndConsume[Char]{newChar('c', 1, 32)},
+				opNextAndConsume[Char]{newChar('\x1b', 1, 33)},
+				opNextAndConsume[Char]{newChar('d', 1, 34)},
 				opEOF{},
 			},
 		},
 		{
-			name:   "transformer UnicodeEscape",
-			reader: Builder{}.WithSource(strings.NewReader(`a\u0058`)).WithUnicodeEscape().Reader(),
+			name:   "transformer MapFunc",
+			reader: Builder{}.WithSource(strings.NewReader("a\\b")).WithRuneEscape(nil).WithMapFunc(unicode.ToUpper).Reader(),
 			ops: []any{
-				opNextAndConsume[Char]{newChar('a', 1, 1)},
-				opNextAndConsume[Char]{newChar('X', 1, 2)},
+				opNextAndConsume[Char]{newChar('A', 1, 1)},
+				opNextAndConsume[Char]{newCharEscaped('B', 1, 2)},
 				opEOF{},
 			},
 		},
 		{
-			name:   "transformer UnicodeEscape invalid hex number",
-			reader: Builder{}.WithSource(strings.NewReader(`a\u005X`)).WithUnicodeEscape().Reader(),
+			name: "transformer RuneEscape unexpected EOF",
+			reader: Builder{}.WithSource(strings.NewReader(`a\`)).WithRuneEscape(map[rune]rune{
+				'a': 'x',
+				'b': 'y',
+				'c': 'z',
+			}).Reader(),
 			ops: []any{
 				opNextAndConsume[Char]{newChar('a', 1, 1)},
-				opNextErr[Char]{Err: genError(1, 2, errors.New(`error parsing unicode escaped rune '\u005X': invalid syntax`))},
+				opNextErr[Char]{Err: genError(1, 2, errors.New("unexpected EOF reading rune escape"))},
 				opEOF{},
 			},
 		},
 		{
-			name:   "transformer UnicodeEscape invalid hex number space",
-			reader: Builder{}.WithSource(strings.NewReader(`a\u005 `)).WithUnicodeEscape().Reader(),
+			name:   "transformer Normalization NFC",
+			reader: Builder{}.WithSource(strings.NewReader("ae\u0301\u0323b")).WithNormalization(norm.NFC).Reader(),
 			ops: []any{
 				opNextAndConsume[Char]{newChar('a', 1, 1)},
-				opNextErr[Char]{Err: genError(1, 2, errors.New(`error parsing unicode escaped rune '\u005 ': invalid syntax`))},
+				opNextAndConsume[Char]{newChar('\u1EB9', 1, 2)},
+				opNextAndConsume[Char]{newChar('\u0301', 1, 2)},
+				opNextAndConsume[Char]{newChar('b', 1, 5)},
 				opEOF{},
 			},
 		},
 		{
-			name:   "transformer UnicodeEscape unexpected EOF",
-			reader: Builder{}.WithSource(strings.NewReader(`a\u005`)).WithUnicodeEscape().Reader(),
+			name:   "transformer Normalization NFD",
+			reader: Builder{}.WithSource(strings.NewReader("aéb")).WithNormalization(norm.NFD).Reader(),
 			ops: []any{
 				opNextAndConsume[Char]{newChar('a', 1, 1)},
-				opNextErr[Char]{Err: genError(1, 2, errors.New("unexpected EOF reading unicode escape"))},
+				opNextAndConsume[Char]{newChar('e', 1, 2)},
+				opNextAndConsume[Char]{newChar('\u0301', 1, 2)},
+				opNextAndConsume[Char]{newChar('b', 1, 3)},
 				opEOF{},
 			},
 		},
 		{
-			name:   "transformer UnicodeEscape rune escape",
-			reader: Builder{}.WithSource(strings.NewReader(`a\X`)).WithUnicodeEscape().Reader(),
+			name:   "transformer Normalization NFKC",
+			reader: Builder{}.WithSource(strings.NewReader("\uFB01x")).WithNormalization(norm.NFKC).Reader(),
 			ops: []any{
-				opNextAndConsume[Char]{newChar('a', 1, 1)},
-				opNextAndConsume[Char]{newChar('\\', 1, 2)},
-				opNextAndConsume[Char]{newChar('X', 1, 3)},
+				opNextAndConsume[Char]{newChar('f', 1, 1)},
+				opNextAndConsume[Char]{newChar('i', 1, 1)},
+				opNextAndConsume[Char]{newChar('x', 1, 2)},
 				opEOF{},
 			},
 		},
 		{
-			name: "transformer RuneEscape",
-			reader: Builder{}.WithSource(strings.NewReader(`a\a\b \c\X\\`)).WithRuneEscape(map[rune]rune{
-				'a': 'x',
-				'b': 'y',
-				'c': 'z',
-			}).Reader(),
+			name:   "transformer custom",
+			reader: Builder{}.WithSource(strings.NewReader("a--b-")).WithTransformer(dashTransformer{}).Reader(),
 			ops: []any{
 				opNextAndConsume[Char]{newChar('a', 1, 1)},
-				opNextAndConsume[Char]{newCharEscaped('x', 1, 2)},
-				opNextAndConsume[Char]{newCharEscaped('y', 1, 4)},
-				opNextAndConsume[Char]{newChar(' ', 1, 6)},
-				opNextAndConsume[Char]{newCharEscaped('z', 1, 7)},
-				opNextAndConsume[Char]{newCharEscaped('X', 1, 9)},
-				opNextAndConsume[Char]{newCharEscaped('\\', 1, 11)},
+				opNextAndConsume[Char]{newChar('—', 1, 2)},
+				opNextAndConsume[Char]{newChar('b', 1, 4)},
+				opNextAndConsume[Char]{newChar('-', 1, 5)},
 				opEOF{},
 			},
 		},
 		{
-			name: "transformer RuneEscape unexpected EOF",
-			reader: Builder{}.WithSource(strings.NewReader(`a\`)).WithRuneEscape(map[rune]rune{
-				'a': 'x',
-				'b': 'y',
-				'c': 'z',
-			}).Reader(),
+			name:   "transformer custom multi",
+			reader: Builder{}.WithSource(strings.NewReader("axbx")).WithMultiTransformer(filterTransformer{}).Reader(),
 			ops: []any{
 				opNextAndConsume[Char]{newChar('a', 1, 1)},
-				opNextErr[Char]{Err: genError(1, 2, errors.New("unexpected EOF reading rune escape"))},
+				opNextAndConsume[Char]{newChar('b', 1, 3)},
+				opNextAndConsume[Char]{newChar('b', 1, 3)},
 				opEOF{},
 			},
 		},
@@ -326,6 +3687,146 @@ func TestReader(t *testing.T) {
 					if err == nil || err.Error() != op.Err.Error() {
 						t.Errorf("[%d] unexpected next error:\nexp=%v\ngot=%v", i, op.Err, err)
 					}
+				case opPeek:
+					c, err := reader.Peek(op.N)
+					if err != nil {
+						t.Errorf("[%d] unexpected peek error: %s", i, err)
+					}
+					if c != op.Exp {
+						t.Errorf("[%d] unexpected char from peek:\nexp=%v\ngot=%v", i, op.Exp, c)
+					}
+				case opPeekErr:
+					_, err := reader.Peek(op.N)
+					if !errors.Is(err, op.Err) {
+						t.Errorf("[%d] unexpected peek error:\nexp=%v\ngot=%v", i, op.Err, err)
+					}
+				case opWindow:
+					cs, err := reader.Window(op.K)
+					if err != nil {
+						t.Errorf("[%d] unexpected window error: %s", i, err)
+					}
+					if !slices.Equal(cs, op.Exp) {
+						t.Errorf("[%d] unexpected chars from window:\nexp=%v\ngot=%v", i, op.Exp, cs)
+					}
+				case opWindowErr:
+					_, err := reader.Window(op.K)
+					if !errors.Is(err, op.Err) {
+						t.Errorf("[%d] unexpected window error:\nexp=%v\ngot=%v", i, op.Err, err)
+					}
+				case opPrev:
+					c, ok := reader.Prev()
+					if c != op.Exp || ok != op.Ok {
+						t.Errorf("[%d] unexpected char from prev:\nexp=%v (%t)\ngot=%v (%t)", i, op.Exp, op.Ok, c, ok)
+					}
+				case opUnconsume:
+					err := reader.Unconsume()
+					if !sameError(err, op.Err) {
+						t.Errorf("[%d] unexpected unconsume error:\nexp=%v\ngot=%v", i, op.Err, err)
+					}
+				case opPushBack:
+					reader.PushBack(op.C)
+				case opPushBackRunes:
+					reader.PushBackRunes(op.Pos, op.Runes...)
+				case opSkip:
+					err := reader.Skip(op.N)
+					if !errors.Is(err, op.Err) {
+						t.Errorf("[%d] unexpected skip error:\nexp=%v\ngot=%v", i, op.Err, err)
+					}
+				case opReadWhile:
+					cs, err := reader.ReadWhile(op.Pred)
+					if !sameError(err, op.Err) {
+						t.Errorf("[%d] unexpected read while error:\nexp=%v\ngot=%v", i, op.Err, err)
+					}
+					if !slices.Equal(cs, op.Exp) {
+						t.Errorf("[%d] unexpected chars from read while:\nexp=%v\ngot=%v", i, op.Exp, cs)
+					}
+				case opReadUntil:
+					cs, err := reader.ReadUntil(op.Delims...)
+					if !sameError(err, op.Err) {
+						t.Errorf("[%d] unexpected read until error:\nexp=%v\ngot=%v", i, op.Err, err)
+					}
+					if !slices.Equal(cs, op.Exp) {
+						t.Errorf("[%d] unexpected chars from read until:\nexp=%v\ngot=%v", i, op.Exp, cs)
+					}
+				case opSkipWhitespace:
+					skip := reader.SkipWhitespace
+					if op.Inline {
+						skip = reader.SkipInlineWhitespace
+					}
+					err := skip()
+					if err != nil {
+						t.Errorf("[%d] unexpected skip whitespace error: %s", i, err)
+					}
+				case opExpect:
+					c, err := reader.Expect(op.R)
+					if !sameError(err, op.Err) {
+						t.Errorf("[%d] unexpected expect error:\nexp=%v\ngot=%v", i, op.Err, err)
+					}
+					if err == nil && c != op.Exp {
+						t.Errorf("[%d] unexpected char from expect:\nexp=%v\ngot=%v", i, op.Exp, c)
+					}
+				case opAccept:
+					ok := reader.Accept(op.R)
+					if ok != op.Ok {
+						t.Errorf("[%d] unexpected result from accept %c: exp=%t got=%t", i, op.R, op.Ok, ok)
+					}
+				case opMatch:
+					ok, err := reader.Match(op.S)
+					if err != nil {
+						t.Errorf("[%d] unexpected match error: %s", i, err)
+					}
+					if ok != op.Ok {
+						t.Errorf("[%d] unexpected result from match %q: exp=%t got=%t", i, op.S, op.Ok, ok)
+					}
+				case opMatchRegexp:
+					cs, err := reader.MatchRegexp(op.Re)
+					if err != nil {
+						t.Errorf("[%d] unexpected match regexp error: %s", i, err)
+					}
+					if !slices.Equal(cs, op.Exp) || (cs == nil) != (op.Exp == nil) {
+						t.Errorf("[%d] unexpected chars from match regexp:\nexp=%v\ngot=%v", i, op.Exp, cs)
+					}
+				case opConsumeToEndOfLine:
+					err := reader.ConsumeToEndOfLine(op.Include)
+					if err != nil {
+						t.Errorf("[%d] unexpected consume to end of line error: %s", i, err)
+					}
+				case opMark:
+					reader.Mark(op.Name)
+				case opResetTo:
+					err := reader.ResetTo(op.Name)
+					if !sameError(err, op.Err) || op.Kind != nil && !errors.Is(err, op.Kind) {
+						t.Errorf("[%d] unexpected reset to error:\nexp=%v\ngot=%v", i, op.Err, err)
+					}
+				case opRelease:
+					err := reader.Release(op.Name)
+					if !sameError(err, op.Err) || op.Kind != nil && !errors.Is(err, op.Kind) {
+						t.Errorf("[%d] unexpected release error:\nexp=%v\ngot=%v", i, op.Err, err)
+					}
+				case opTryNext:
+					c, ok, err := reader.TryNext()
+					if !sameError(err, op.Err) {
+						t.Errorf("[%d] unexpected try next error:\nexp=%v\ngot=%v", i, op.Err, err)
+					}
+					if c != op.Exp || ok != op.Ok {
+						t.Errorf("[%d] unexpected char from try next:\nexp=%v (%t)\ngot=%v (%t)", i, op.Exp, op.Ok, c, ok)
+					}
+				case opAtEOF:
+					if eof := reader.AtEOF(); eof != op.Exp {
+						t.Errorf("[%d] unexpected result from at EOF: exp=%t got=%t", i, op.Exp, eof)
+					}
+				case opSetRaw:
+					reader.SetRaw(op.Raw)
+				case opDisableTransformer:
+					err := reader.DisableTransformer(op.Name)
+					if !sameError(err, op.Err) || op.Kind != nil && !errors.Is(err, op.Kind) {
+						t.Errorf("[%d] unexpected disable transformer error:\nexp=%v\ngot=%v", i, op.Err, err)
+					}
+				case opEnableTransformer:
+					err := reader.EnableTransformer(op.Name)
+					if !sameError(err, op.Err) || op.Kind != nil && !errors.Is(err, op.Kind) {
+						t.Errorf("[%d] unexpected enable transformer error:\nexp=%v\ngot=%v", i, op.Err, err)
+					}
 				case opConsume:
 					reader.Consume()
 				case opState:
@@ -337,6 +3838,10 @@ func TestReader(t *testing.T) {
 					}
 				case opCommit:
 					reader.Commit()
+				case opPos:
+					if pos := reader.Pos(); pos != op.Pos {
+						t.Errorf("[%d] unexpected pos:\nexp=%v\ngot=%v", i, op.Pos, pos)
+					}
 				case opEOF:
 					c, err := reader.Next()
 					if !errors.Is(err, io.EOF) {
@@ -368,6 +3873,134 @@ type opNextErr[T any] struct {
 	Err error
 }
 
+type opPeek struct {
+	N   int
+	Exp Char
+}
+
+type opPeekErr struct {
+	N   int
+	Err error
+}
+
+type opWindow struct {
+	K   int
+	Exp []Char
+}
+
+type opWindowErr struct {
+	K   int
+	Err error
+}
+
+type opPrev struct {
+	Exp Char
+	Ok  bool
+}
+
+type opUnconsume struct {
+	Err error
+}
+
+var errNoUnconsume = errors.New("no consumed char to unconsume")
+
+type opPushBack struct {
+	C Char
+}
+
+type opPushBackRunes struct {
+	Pos   Position
+	Runes []rune
+}
+
+type opSkip struct {
+	N   int
+	Err error
+}
+
+type opReadWhile struct {
+	Pred func(rune) bool
+	Exp  []Char
+	Err  error
+}
+
+type opReadUntil struct {
+	Delims []rune
+	Exp    []Char
+	Err    error
+}
+
+type opSkipWhitespace struct {
+	Inline bool
+}
+
+type opExpect struct {
+	R   rune
+	Exp Char
+	Err error
+}
+
+type opAccept struct {
+	R  rune
+	Ok bool
+}
+
+type opMatch struct {
+	S  string
+	Ok bool
+}
+
+type opMatchRegexp struct {
+	Re  *regexp.Regexp
+	Exp []Char
+}
+
+type opConsumeToEndOfLine struct {
+	Include bool
+}
+
+type opMark struct {
+	Name string
+}
+
+type opResetTo struct {
+	Name string
+	Err  error
+	Kind error // Sentinel error wrapped by Err (if any)
+}
+
+type opRelease struct {
+	Name string
+	Err  error
+	Kind error // Sentinel error wrapped by Err (if any)
+}
+
+type opTryNext struct {
+	Exp Char
+	Ok  bool
+	Err error
+}
+
+type opAtEOF struct {
+	Exp bool
+}
+
+type opSetRaw struct {
+	Raw bool
+}
+
+type opDisableTransformer struct {
+	Name string
+	Err  error
+	Kind error // Sentinel error wrapped by Err (if any)
+}
+
+type opEnableTransformer struct {
+	Name string
+	Err  error
+	Kind error // Sentinel error wrapped by Err (if any)
+}
+
 type opConsume struct{}
 
 type opState struct{}
@@ -384,6 +4017,52 @@ type opPos struct {
 	Pos Position
 }
 
+// dashTransformer is a custom Transformer transforming "--" to an em dash.
+type dashTransformer struct{}
+
+func (d dashTransformer) Transform(src RuneSource, c Char) (Char, error) {
+	if c.Rune != '-' {
+		return c, nil
+	}
+	r, _, err := src.Read()
+	if errors.Is(err, io.EOF) {
+		return c, nil
+	}
+	if err != nil {
+		return c, err
+	}
+	if r != '-' {
+		return c, src.Unread()
+	}
+	c.Rune = '—'
+	return c, nil
+}
+
+var errFailTransformer = errors.New("fail transformer test error")
+
+// failTransformer is a custom Transformer failing on 'x'.
+type failTransformer struct{}
+
+func (f failTransformer) Transform(_ RuneSource, c Char) (Char, error) {
+	if c.Rune == 'x' {
+		return c, NewPositionalError(c.Pos, errFailTransformer)
+	}
+	return c, nil
+}
+
+// filterTransformer is a custom MultiTransformer filtering out 'x' and doubling 'b'.
+type filterTransformer struct{}
+
+func (d filterTransformer) TransformMulti(src RuneSource, c Char, dst []Char) ([]Char, error) {
+	switch c.Rune {
+	case 'x':
+		return dst, nil
+	case 'b':
+		return append(dst, c, c), nil
+	}
+	return append(dst, c), nil
+}
+
 var errorReaderError = errors.New("reader test error")
 
 type errorReader struct {
@@ -391,6 +4070,14 @@ type errorReader struct {
 	idx   int
 }
 
+// sameError returns true if both errors are nil or both errors have the same error message.
+func sameError(err1, err2 error) bool {
+	if err1 == nil || err2 == nil {
+		return err1 == err2
+	}
+	return err1.Error() == err2.Error()
+}
+
 func genError(row, col int, err error) error {
 	return goerrors.NewPositionalError(row, col, err)
 }